@@ -1,10 +1,18 @@
 package abi
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"math"
 	"math/big"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	cbor "gx/ipfs/QmRoARq3nkUb13HSKZGepCZSWe5GrVPwx7xURJGZ7KWv9V/go-ipld-cbor"
 	"gx/ipfs/QmSKyB5faguXT4NqbrXpnRXqaVj5DhSm7x9BtzFydBY1UK/go-leb128"
 	"gx/ipfs/QmY5Grm8pJdiSSVsYxx4uNRgweY72EmYwuSDbRnbFok3iY/go-libp2p-peer"
@@ -32,7 +40,8 @@ const (
 	ChannelID
 	// BlockHeight is a *types.BlockHeight
 	BlockHeight
-	// Integer is a *big.Int
+	// Integer is a *big.Int, encoded as its big-endian magnitude, preceded by
+	// a zero byte if it is negative
 	Integer
 	// Bytes is a []byte
 	Bytes
@@ -46,6 +55,28 @@ const (
 	SectorID
 	// CommitmentsMap is a map of stringified sector id (uint64) to commitments
 	CommitmentsMap
+	// Duration is a non-negative time.Duration, encoded as a whole number of seconds
+	Duration
+	// BitField is a *types.BitField
+	BitField
+	// ProofPath is a *types.ProofPath
+	ProofPath
+	// Rational is a *big.Rat
+	Rational
+	// RunLengthInts is a []uint64, encoded as runs of evenly spaced values so
+	// that repetitive and sequential arrays are compact
+	RunLengthInts
+	// LogEntry is a *types.LogEntry
+	LogEntry
+	// Boolean is a bool
+	Boolean
+	// Uint64 is a uint64, encoded as an unsigned LEB128 integer like SectorID
+	Uint64
+	// Cid is a cid.Cid, encoded in its binary form
+	Cid
+	// Fixed128 is a *big.Int holding a fixed-point number scaled by 2^128,
+	// encoded as a sign byte followed by its big-endian magnitude
+	Fixed128
 )
 
 func (t Type) String() string {
@@ -76,6 +107,26 @@ func (t Type) String() string {
 		return "uint64"
 	case CommitmentsMap:
 		return "map[string]Commitments"
+	case Duration:
+		return "time.Duration"
+	case BitField:
+		return "*types.BitField"
+	case ProofPath:
+		return "*types.ProofPath"
+	case Rational:
+		return "*big.Rat"
+	case RunLengthInts:
+		return "[]uint64"
+	case LogEntry:
+		return "*types.LogEntry"
+	case Boolean:
+		return "bool"
+	case Uint64:
+		return "uint64"
+	case Cid:
+		return "cid.Cid"
+	case Fixed128:
+		return "fixed128"
 	default:
 		return "<unknown type>"
 	}
@@ -87,6 +138,121 @@ type Value struct {
 	Val  interface{}
 }
 
+// AddressValue returns an ABI Value holding the given address.
+func AddressValue(addr address.Address) *Value {
+	return &Value{Type: Address, Val: addr}
+}
+
+// AttoFILValue returns an ABI Value holding the given AttoFIL amount.
+func AttoFILValue(af *types.AttoFIL) *Value {
+	return &Value{Type: AttoFIL, Val: af}
+}
+
+// BytesAmountValue returns an ABI Value holding the given BytesAmount.
+func BytesAmountValue(ba *types.BytesAmount) *Value {
+	return &Value{Type: BytesAmount, Val: ba}
+}
+
+// ChannelIDValue returns an ABI Value holding the given ChannelID.
+func ChannelIDValue(id *types.ChannelID) *Value {
+	return &Value{Type: ChannelID, Val: id}
+}
+
+// BlockHeightValue returns an ABI Value holding the given BlockHeight.
+func BlockHeightValue(bh *types.BlockHeight) *Value {
+	return &Value{Type: BlockHeight, Val: bh}
+}
+
+// BigIntValue returns an ABI Value holding the given integer.
+func BigIntValue(i *big.Int) *Value {
+	return &Value{Type: Integer, Val: i}
+}
+
+// BytesValue returns an ABI Value holding the given bytes.
+func BytesValue(b []byte) *Value {
+	return &Value{Type: Bytes, Val: b}
+}
+
+// StringValue returns an ABI Value holding the given string.
+func StringValue(s string) *Value {
+	return &Value{Type: String, Val: s}
+}
+
+// UintArrayValue returns an ABI Value holding the given array of uint64.
+func UintArrayValue(arr []uint64) *Value {
+	return &Value{Type: UintArray, Val: arr}
+}
+
+// PeerIDValue returns an ABI Value holding the given peer ID.
+func PeerIDValue(pid peer.ID) *Value {
+	return &Value{Type: PeerID, Val: pid}
+}
+
+// SectorIDValue returns an ABI Value holding the given sector ID.
+func SectorIDValue(id uint64) *Value {
+	return &Value{Type: SectorID, Val: id}
+}
+
+// CommitmentsMapValue returns an ABI Value holding the given commitments map.
+func CommitmentsMapValue(m map[string]types.Commitments) *Value {
+	return &Value{Type: CommitmentsMap, Val: m}
+}
+
+// DurationValue returns an ABI Value holding the given duration.
+func DurationValue(d time.Duration) *Value {
+	return &Value{Type: Duration, Val: d}
+}
+
+// BitFieldValue returns an ABI Value holding the given bitfield.
+func BitFieldValue(bf *types.BitField) *Value {
+	return &Value{Type: BitField, Val: bf}
+}
+
+// ProofPathValue returns an ABI Value holding the given proof path.
+func ProofPathValue(pp *types.ProofPath) *Value {
+	return &Value{Type: ProofPath, Val: pp}
+}
+
+// RationalValue returns an ABI Value holding the given rational number.
+func RationalValue(r *big.Rat) *Value {
+	return &Value{Type: Rational, Val: r}
+}
+
+// BooleanValue returns an ABI Value holding the given boolean.
+func BooleanValue(b bool) *Value {
+	return &Value{Type: Boolean, Val: b}
+}
+
+// Uint64Value returns an ABI Value holding the given uint64. ToValues converts
+// a uint64 to a SectorID Value, which has the same encoding.
+func Uint64Value(n uint64) *Value {
+	return &Value{Type: Uint64, Val: n}
+}
+
+// CidValue returns an ABI Value holding the given cid.
+func CidValue(c cid.Cid) *Value {
+	return &Value{Type: Cid, Val: c}
+}
+
+// Fixed128Value returns an ABI Value holding the fixed-point number x/2^128.
+func Fixed128Value(x *big.Int) *Value {
+	return &Value{Type: Fixed128, Val: x}
+}
+
+// LogEntryValue returns an ABI Value holding the given log entry.
+func LogEntryValue(le *types.LogEntry) *Value {
+	return &Value{Type: LogEntry, Val: le}
+}
+
+// RunLengthIntsValue returns an ABI Value holding the given array, to be
+// encoded run-length compressed.
+func RunLengthIntsValue(arr []uint64) *Value {
+	return &Value{Type: RunLengthInts, Val: arr}
+}
+
+// String renders the value for humans, e.g. in logs: numbers in decimal,
+// addresses, peer IDs and cids in their usual string forms, bytes as hex and
+// strings quoted.
 func (av *Value) String() string {
 	switch av.Type {
 	case Invalid:
@@ -104,9 +270,9 @@ func (av *Value) String() string {
 	case Integer:
 		return av.Val.(*big.Int).String()
 	case Bytes:
-		return string(av.Val.([]byte))
+		return hex.EncodeToString(av.Val.([]byte))
 	case String:
-		return av.Val.(string)
+		return strconv.Quote(av.Val.(string))
 	case UintArray:
 		return fmt.Sprint(av.Val.([]uint64))
 	case PeerID:
@@ -115,11 +281,296 @@ func (av *Value) String() string {
 		return fmt.Sprint(av.Val.(uint64))
 	case CommitmentsMap:
 		return fmt.Sprint(av.Val.(map[string]types.Commitments))
+	case Duration:
+		return av.Val.(time.Duration).String()
+	case BitField:
+		return av.Val.(*types.BitField).String()
+	case ProofPath:
+		return av.Val.(*types.ProofPath).String()
+	case Rational:
+		return av.Val.(*big.Rat).RatString()
+	case RunLengthInts:
+		return fmt.Sprint(av.Val.([]uint64))
+	case LogEntry:
+		return av.Val.(*types.LogEntry).String()
+	case Boolean:
+		return fmt.Sprint(av.Val.(bool))
+	case Uint64:
+		return fmt.Sprint(av.Val.(uint64))
+	case Cid:
+		return av.Val.(cid.Cid).String()
+	case Fixed128:
+		f := new(big.Float).SetPrec(fixed128Bits * 2).SetInt(av.Val.(*big.Int))
+		return f.SetMantExp(f, -fixed128Bits).Text('g', 20)
 	default:
 		return "<unknown type>"
 	}
 }
 
+// FormatValues renders vals on one line, separated by commas, e.g. for
+// logging the decoded parameters of a message.
+func FormatValues(vals []*Value) string {
+	strs := make([]string, len(vals))
+	for i, val := range vals {
+		strs[i] = val.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+// Equals returns whether av and other have the same type and semantically
+// equal values. Numeric values are compared by value rather than by their
+// internal representation.
+func (av *Value) Equals(other *Value) bool {
+	if av == nil || other == nil {
+		return av == other
+	}
+	if av.Type != other.Type {
+		return false
+	}
+
+	switch av.Type {
+	case Address:
+		a, aok := av.Val.(address.Address)
+		b, bok := other.Val.(address.Address)
+		return aok && bok && bytes.Equal(a.Bytes(), b.Bytes())
+	case AttoFIL:
+		a, aok := av.Val.(*types.AttoFIL)
+		b, bok := other.Val.(*types.AttoFIL)
+		if !aok || !bok || a == nil || b == nil {
+			return aok && bok && a == b
+		}
+		return a.Equal(b)
+	case BytesAmount:
+		a, aok := av.Val.(*types.BytesAmount)
+		b, bok := other.Val.(*types.BytesAmount)
+		if !aok || !bok || a == nil || b == nil {
+			return aok && bok && a == b
+		}
+		return a.Equal(b)
+	case ChannelID:
+		a, aok := av.Val.(*types.ChannelID)
+		b, bok := other.Val.(*types.ChannelID)
+		if !aok || !bok || a == nil || b == nil {
+			return aok && bok && a == b
+		}
+		return a.Equal(b)
+	case BlockHeight:
+		a, aok := av.Val.(*types.BlockHeight)
+		b, bok := other.Val.(*types.BlockHeight)
+		if !aok || !bok || a == nil || b == nil {
+			return aok && bok && a == b
+		}
+		return a.Equal(b)
+	case Integer:
+		a, aok := av.Val.(*big.Int)
+		b, bok := other.Val.(*big.Int)
+		if !aok || !bok || a == nil || b == nil {
+			return aok && bok && a == b
+		}
+		return a.Cmp(b) == 0
+	case Bytes:
+		a, aok := av.Val.([]byte)
+		b, bok := other.Val.([]byte)
+		return aok && bok && bytes.Equal(a, b)
+	case String:
+		a, aok := av.Val.(string)
+		b, bok := other.Val.(string)
+		return aok && bok && a == b
+	case UintArray:
+		a, aok := av.Val.([]uint64)
+		b, bok := other.Val.([]uint64)
+		if !aok || !bok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	case PeerID:
+		a, aok := av.Val.(peer.ID)
+		b, bok := other.Val.(peer.ID)
+		return aok && bok && a == b
+	case SectorID:
+		a, aok := av.Val.(uint64)
+		b, bok := other.Val.(uint64)
+		return aok && bok && a == b
+	case CommitmentsMap:
+		a, aok := av.Val.(map[string]types.Commitments)
+		b, bok := other.Val.(map[string]types.Commitments)
+		if !aok || !bok || len(a) != len(b) {
+			return false
+		}
+		for k, ac := range a {
+			if bc, ok := b[k]; !ok || ac != bc {
+				return false
+			}
+		}
+		return true
+	case Duration:
+		a, aok := av.Val.(time.Duration)
+		b, bok := other.Val.(time.Duration)
+		return aok && bok && a == b
+	case BitField:
+		a, aok := av.Val.(*types.BitField)
+		b, bok := other.Val.(*types.BitField)
+		if !aok || !bok || a == nil || b == nil {
+			return aok && bok && a == b
+		}
+		return a.Equal(b)
+	case ProofPath:
+		a, aok := av.Val.(*types.ProofPath)
+		b, bok := other.Val.(*types.ProofPath)
+		if !aok || !bok || a == nil || b == nil {
+			return aok && bok && a == b
+		}
+		return a.Equal(b)
+	case Rational:
+		a, aok := av.Val.(*big.Rat)
+		b, bok := other.Val.(*big.Rat)
+		if !aok || !bok || a == nil || b == nil {
+			return aok && bok && a == b
+		}
+		return a.Cmp(b) == 0
+	case RunLengthInts:
+		a, aok := av.Val.([]uint64)
+		b, bok := other.Val.([]uint64)
+		if !aok || !bok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	case LogEntry:
+		a, aok := av.Val.(*types.LogEntry)
+		b, bok := other.Val.(*types.LogEntry)
+		if !aok || !bok || a == nil || b == nil {
+			return aok && bok && a == b
+		}
+		return a.Equal(b)
+	case Boolean:
+		a, aok := av.Val.(bool)
+		b, bok := other.Val.(bool)
+		return aok && bok && a == b
+	case Uint64:
+		a, aok := av.Val.(uint64)
+		b, bok := other.Val.(uint64)
+		return aok && bok && a == b
+	case Cid:
+		a, aok := av.Val.(cid.Cid)
+		b, bok := other.Val.(cid.Cid)
+		return aok && bok && a.Equals(b)
+	case Fixed128:
+		a, aok := av.Val.(*big.Int)
+		b, bok := other.Val.(*big.Int)
+		if !aok || !bok || a == nil || b == nil {
+			return aok && bok && a == b
+		}
+		return a.Cmp(b) == 0
+	default:
+		return false
+	}
+}
+
+// Copy returns a deep copy of av, sharing no memory with it, so that
+// modifying one, e.g. the bytes of a Bytes value, doesn't affect the other.
+// Values whose Val doesn't match their Type are copied shallowly.
+func (av *Value) Copy() *Value {
+	if av == nil {
+		return nil
+	}
+
+	cp := &Value{Type: av.Type, Val: av.Val}
+	switch v := av.Val.(type) {
+	case *types.AttoFIL:
+		if v != nil {
+			cp.Val = types.NewAttoFILFromBytes(v.Bytes())
+		}
+	case *types.BytesAmount:
+		if v != nil {
+			cp.Val = types.NewBytesAmountFromBytes(v.Bytes())
+		}
+	case *types.ChannelID:
+		if v != nil {
+			cp.Val = types.NewChannelIDFromBytes(v.Bytes())
+		}
+	case *types.BlockHeight:
+		if v != nil {
+			cp.Val = types.NewBlockHeightFromBytes(v.Bytes())
+		}
+	case *big.Int:
+		if v != nil {
+			cp.Val = new(big.Int).Set(v)
+		}
+	case []byte:
+		if v != nil {
+			cp.Val = append([]byte{}, v...)
+		}
+	case []uint64:
+		if v != nil {
+			cp.Val = append([]uint64{}, v...)
+		}
+	case map[string]types.Commitments:
+		if v != nil {
+			m := make(map[string]types.Commitments, len(v))
+			for k, c := range v {
+				m[k] = c
+			}
+			cp.Val = m
+		}
+	case *types.BitField:
+		if v != nil {
+			// A BitField's own encoding always decodes.
+			cp.Val, _ = types.NewBitFieldFromBytes(v.Bytes())
+		}
+	case *types.ProofPath:
+		if v != nil {
+			pp := &types.ProofPath{}
+			if v.Cids != nil {
+				pp.Cids = append([]cid.Cid{}, v.Cids...)
+			}
+			if v.Leaf != nil {
+				pp.Leaf = append([]byte{}, v.Leaf...)
+			}
+			cp.Val = pp
+		}
+	case *big.Rat:
+		if v != nil {
+			cp.Val = new(big.Rat).Set(v)
+		}
+	case *types.LogEntry:
+		if v != nil {
+			le := &types.LogEntry{Prev: v.Prev}
+			if v.Payload != nil {
+				le.Payload = append([]byte{}, v.Payload...)
+			}
+			cp.Val = le
+		}
+	}
+	return cp
+}
+
+// Values is a list of ABI values.
+type Values []*Value
+
+// Equals returns whether vs and other have the same length and pairwise equal
+// values, as determined by Value.Equals.
+func (vs Values) Equals(other Values) bool {
+	if len(vs) != len(other) {
+		return false
+	}
+	for i := range vs {
+		if !vs[i].Equals(other[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 type typeError struct {
 	exp interface{}
 	got interface{}
@@ -172,7 +623,7 @@ func (av *Value) Serialize() ([]byte, error) {
 		if !ok {
 			return nil, &typeError{&big.Int{}, av.Val}
 		}
-		return intgr.Bytes(), nil
+		return encodeInteger(intgr), nil
 	case Bytes:
 		b, ok := av.Val.([]byte)
 		if !ok {
@@ -214,6 +665,97 @@ func (av *Value) Serialize() ([]byte, error) {
 		}
 
 		return cbor.DumpObject(m)
+	case Duration:
+		d, ok := av.Val.(time.Duration)
+		if !ok {
+			return nil, &typeError{time.Duration(0), av.Val}
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("duration must not be negative: %s", d)
+		}
+		if d%time.Second != 0 {
+			return nil, fmt.Errorf("duration must be a whole number of seconds: %s", d)
+		}
+
+		return leb128.FromUInt64(uint64(d / time.Second)), nil
+	case BitField:
+		bf, ok := av.Val.(*types.BitField)
+		if !ok {
+			return nil, &typeError{types.BitField{}, av.Val}
+		}
+
+		return bf.Bytes(), nil
+	case ProofPath:
+		pp, ok := av.Val.(*types.ProofPath)
+		if !ok {
+			return nil, &typeError{types.ProofPath{}, av.Val}
+		}
+
+		return cbor.DumpObject(pp)
+	case Rational:
+		r, ok := av.Val.(*big.Rat)
+		if !ok {
+			return nil, &typeError{&big.Rat{}, av.Val}
+		}
+		if r == nil {
+			return nil, fmt.Errorf("rational must not be nil")
+		}
+
+		// A uvarint length prefixed numerator followed by the denominator.
+		num := encodeSignedInt(r.Num())
+		buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(num))
+		buf = append(buf[:binary.PutUvarint(buf, uint64(len(num)))], num...)
+		return append(buf, encodeSignedInt(r.Denom())...), nil
+	case RunLengthInts:
+		arr, ok := av.Val.([]uint64)
+		if !ok {
+			return nil, &typeError{[]uint64{}, av.Val}
+		}
+
+		return encodeRunLengthInts(arr), nil
+	case LogEntry:
+		le, ok := av.Val.(*types.LogEntry)
+		if !ok {
+			return nil, &typeError{types.LogEntry{}, av.Val}
+		}
+
+		return cbor.DumpObject(le)
+	case Boolean:
+		b, ok := av.Val.(bool)
+		if !ok {
+			return nil, &typeError{false, av.Val}
+		}
+		if b {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case Uint64:
+		n, ok := av.Val.(uint64)
+		if !ok {
+			return nil, &typeError{uint64(0), av.Val}
+		}
+
+		return leb128.FromUInt64(n), nil
+	case Cid:
+		c, ok := av.Val.(cid.Cid)
+		if !ok {
+			return nil, &typeError{cid.Cid{}, av.Val}
+		}
+		if !c.Defined() {
+			return nil, fmt.Errorf("cid must not be undefined")
+		}
+
+		return c.Bytes(), nil
+	case Fixed128:
+		x, ok := av.Val.(*big.Int)
+		if !ok {
+			return nil, &typeError{&big.Int{}, av.Val}
+		}
+		if x == nil {
+			return nil, fmt.Errorf("fixed-point number must not be nil")
+		}
+
+		return encodeSignedInt(x), nil
 	default:
 		return nil, fmt.Errorf("unrecognized Type: %d", av.Type)
 	}
@@ -230,29 +772,43 @@ func ToValues(i []interface{}) ([]*Value, error) {
 	for _, v := range i {
 		switch v := v.(type) {
 		case address.Address:
-			out = append(out, &Value{Type: Address, Val: v})
+			out = append(out, AddressValue(v))
 		case *types.AttoFIL:
-			out = append(out, &Value{Type: AttoFIL, Val: v})
+			out = append(out, AttoFILValue(v))
 		case *types.BytesAmount:
-			out = append(out, &Value{Type: BytesAmount, Val: v})
+			out = append(out, BytesAmountValue(v))
 		case *types.ChannelID:
-			out = append(out, &Value{Type: ChannelID, Val: v})
+			out = append(out, ChannelIDValue(v))
 		case *types.BlockHeight:
-			out = append(out, &Value{Type: BlockHeight, Val: v})
+			out = append(out, BlockHeightValue(v))
 		case *big.Int:
-			out = append(out, &Value{Type: Integer, Val: v})
+			out = append(out, BigIntValue(v))
 		case []byte:
-			out = append(out, &Value{Type: Bytes, Val: v})
+			out = append(out, BytesValue(v))
 		case string:
-			out = append(out, &Value{Type: String, Val: v})
+			out = append(out, StringValue(v))
 		case []uint64:
-			out = append(out, &Value{Type: UintArray, Val: v})
+			out = append(out, UintArrayValue(v))
 		case peer.ID:
-			out = append(out, &Value{Type: PeerID, Val: v})
+			out = append(out, PeerIDValue(v))
 		case uint64:
-			out = append(out, &Value{Type: SectorID, Val: v})
+			out = append(out, SectorIDValue(v))
 		case map[string]types.Commitments:
-			out = append(out, &Value{Type: CommitmentsMap, Val: v})
+			out = append(out, CommitmentsMapValue(v))
+		case time.Duration:
+			out = append(out, DurationValue(v))
+		case *types.BitField:
+			out = append(out, BitFieldValue(v))
+		case *types.ProofPath:
+			out = append(out, ProofPathValue(v))
+		case *big.Rat:
+			out = append(out, RationalValue(v))
+		case *types.LogEntry:
+			out = append(out, LogEntryValue(v))
+		case bool:
+			out = append(out, BooleanValue(v))
+		case cid.Cid:
+			out = append(out, CidValue(v))
 		default:
 			return nil, fmt.Errorf("unsupported type: %T", v)
 		}
@@ -314,9 +870,14 @@ func Deserialize(data []byte, t Type) (*Value, error) {
 			Val:  types.NewBlockHeightFromBytes(data),
 		}, nil
 	case Integer:
+		intgr, err := decodeInteger(data)
+		if err != nil {
+			return nil, err
+		}
+
 		return &Value{
 			Type: t,
-			Val:  big.NewInt(0).SetBytes(data),
+			Val:  intgr,
 		}, nil
 	case String:
 		return &Value{
@@ -325,6 +886,9 @@ func Deserialize(data []byte, t Type) (*Value, error) {
 		}, nil
 	case UintArray:
 		var arr []uint64
+		if err := checkDefiniteLength(data); err != nil {
+			return nil, err
+		}
 		if err := cbor.DecodeInto(data, &arr); err != nil {
 			return nil, err
 		}
@@ -350,6 +914,9 @@ func Deserialize(data []byte, t Type) (*Value, error) {
 
 	case CommitmentsMap:
 		var m map[string]types.Commitments
+		if err := checkDefiniteLength(data); err != nil {
+			return nil, err
+		}
 		if err := cbor.DecodeInto(data, &m); err != nil {
 			return nil, err
 		}
@@ -357,6 +924,147 @@ func Deserialize(data []byte, t Type) (*Value, error) {
 			Type: t,
 			Val:  m,
 		}, nil
+	case Duration:
+		secs := leb128.ToUInt64(data)
+		if secs > math.MaxInt64/uint64(time.Second) {
+			return nil, fmt.Errorf("duration of %d seconds is out of range", secs)
+		}
+
+		return &Value{
+			Type: t,
+			Val:  time.Duration(secs) * time.Second,
+		}, nil
+	case BitField:
+		bf, err := types.NewBitFieldFromBytes(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Value{
+			Type: t,
+			Val:  bf,
+		}, nil
+	case ProofPath:
+		var pp types.ProofPath
+		if err := checkDefiniteLength(data); err != nil {
+			return nil, err
+		}
+		if err := cbor.DecodeInto(data, &pp); err != nil {
+			return nil, err
+		}
+
+		return &Value{
+			Type: t,
+			Val:  &pp,
+		}, nil
+	case Rational:
+		numLen, n := binary.Uvarint(data)
+		if n <= 0 || numLen > uint64(len(data)-n) {
+			return nil, fmt.Errorf("malformed rational numerator")
+		}
+		num, err := decodeSignedInt(data[n : n+int(numLen)])
+		if err != nil {
+			return nil, err
+		}
+		denom, err := decodeSignedInt(data[n+int(numLen):])
+		if err != nil {
+			return nil, err
+		}
+		if denom.Sign() == 0 {
+			return nil, fmt.Errorf("rational must have a non-zero denominator")
+		}
+
+		// Only the canonical encoding, in lowest terms with the sign on the
+		// numerator and no leading zeros, is accepted, so that every value
+		// encodes to the same bytes.
+		val := &Value{
+			Type: t,
+			Val:  new(big.Rat).SetFrac(num, denom),
+		}
+		canonical, err := val.Serialize()
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(canonical, data) {
+			return nil, fmt.Errorf("malformed rational: not in canonical form")
+		}
+
+		return val, nil
+	case LogEntry:
+		var le types.LogEntry
+		if err := checkDefiniteLength(data); err != nil {
+			return nil, err
+		}
+		if err := cbor.DecodeInto(data, &le); err != nil {
+			return nil, err
+		}
+
+		return &Value{
+			Type: t,
+			Val:  &le,
+		}, nil
+	case Boolean:
+		if len(data) != 1 || data[0] > 1 {
+			return nil, fmt.Errorf("malformed boolean: expected a single 0x00 or 0x01 byte, got %x", data)
+		}
+
+		return &Value{
+			Type: t,
+			Val:  data[0] == 1,
+		}, nil
+	case Uint64:
+		n, read := binary.Uvarint(data)
+		switch {
+		case read < 0:
+			return nil, fmt.Errorf("unsupported uint64 encoding: overflows 64 bits")
+		case read == 0 || read != len(data):
+			return nil, fmt.Errorf("unsupported uint64 encoding: malformed unsigned LEB128 integer")
+		case len(data) > 1 && data[len(data)-1] == 0:
+			return nil, fmt.Errorf("unsupported uint64 encoding: non-minimal unsigned LEB128 integer")
+		}
+
+		return &Value{
+			Type: t,
+			Val:  n,
+		}, nil
+	case Cid:
+		c, err := cid.Cast(data)
+		if err != nil {
+			return nil, fmt.Errorf("malformed cid: %s", err)
+		}
+
+		return &Value{
+			Type: t,
+			Val:  c,
+		}, nil
+	case Fixed128:
+		// Only the canonical encoding is accepted, so that every value
+		// encodes to the same bytes.
+		if len(data) > 1 && data[1] == 0 {
+			return nil, fmt.Errorf("malformed fixed-point number: magnitude has leading zeros")
+		}
+		if len(data) == 1 && data[0] == 1 {
+			return nil, fmt.Errorf("malformed fixed-point number: negative zero")
+		}
+		x, err := decodeSignedInt(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Value{
+			Type: t,
+			Val:  x,
+		}, nil
+	case RunLengthInts:
+		arr, err := decodeRunLengthInts(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Value{
+			Type: t,
+			Val:  arr,
+		}, nil
 	case Invalid:
 		return nil, ErrInvalidType
 	default:
@@ -377,6 +1085,149 @@ var typeTable = map[Type]reflect.Type{
 	PeerID:         reflect.TypeOf(peer.ID("")),
 	SectorID:       reflect.TypeOf(uint64(0)),
 	CommitmentsMap: reflect.TypeOf(map[string]types.Commitments{}),
+	Duration:       reflect.TypeOf(time.Duration(0)),
+	BitField:       reflect.TypeOf(&types.BitField{}),
+	ProofPath:      reflect.TypeOf(&types.ProofPath{}),
+	Rational:       reflect.TypeOf(&big.Rat{}),
+	RunLengthInts:  reflect.TypeOf([]uint64{}),
+	LogEntry:       reflect.TypeOf(&types.LogEntry{}),
+	Boolean:        reflect.TypeOf(false),
+	Uint64:         reflect.TypeOf(uint64(0)),
+	Cid:            reflect.TypeOf(cid.Cid{}),
+	Fixed128:       reflect.TypeOf(&big.Int{}),
+}
+
+// cborEncoded reports whether values of type t are serialized as CBOR, so
+// that decoding them decodes nested CBOR items.
+func cborEncoded(t Type) bool {
+	switch t {
+	case UintArray, CommitmentsMap, ProofPath, LogEntry:
+		return true
+	default:
+		return false
+	}
+}
+
+// fixed128Bits is the number of fractional bits of a Fixed128.
+const fixed128Bits = 128
+
+// encodeInteger encodes i as its big-endian magnitude, preceded by a zero
+// byte if i is negative. The magnitude of a non-zero integer never starts
+// with a zero byte, so the encodings of non-negative integers are the same as
+// they were before negative integers were supported.
+func encodeInteger(i *big.Int) []byte {
+	if i.Sign() < 0 {
+		return append([]byte{0}, i.Bytes()...)
+	}
+	return i.Bytes()
+}
+
+// decodeInteger decodes an integer encoded by encodeInteger.
+func decodeInteger(data []byte) (*big.Int, error) {
+	if len(data) == 0 || data[0] != 0 {
+		return new(big.Int).SetBytes(data), nil
+	}
+	if len(data) == 1 || data[1] == 0 {
+		return nil, fmt.Errorf("malformed integer: negative integer with zero or non-minimal magnitude")
+	}
+	return new(big.Int).Neg(new(big.Int).SetBytes(data[1:])), nil
+}
+
+// encodeSignedInt encodes i as a sign byte, 1 if negative and 0 otherwise,
+// followed by its big-endian magnitude.
+func encodeSignedInt(i *big.Int) []byte {
+	sign := byte(0)
+	if i.Sign() < 0 {
+		sign = 1
+	}
+	return append([]byte{sign}, i.Bytes()...)
+}
+
+// decodeSignedInt decodes an integer encoded by encodeSignedInt.
+func decodeSignedInt(data []byte) (*big.Int, error) {
+	if len(data) == 0 || data[0] > 1 {
+		return nil, fmt.Errorf("malformed signed integer")
+	}
+
+	i := new(big.Int).SetBytes(data[1:])
+	if data[0] == 1 {
+		i.Neg(i)
+	}
+	return i, nil
+}
+
+// maxRunLengthInts bounds the length of a decoded RunLengthInts array, so a
+// short encoding can't cause an arbitrarily large allocation.
+const maxRunLengthInts = 1 << 20
+
+// encodeRunLengthInts encodes arr as a sequence of runs, each the first value
+// of the run as an unsigned varint, the difference between consecutive values
+// as a signed varint (wrapping modulo 2^64), and the number of values as an
+// unsigned varint. Runs are taken greedily from the start of arr, each as long
+// as possible, so every array has exactly one encoding: every run but the last
+// has at least two values, a run of one value has a difference of zero, and no
+// run continues the progression of the one before it.
+func encodeRunLengthInts(arr []uint64) []byte {
+	var buf []byte
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for i := 0; i < len(arr); {
+		var delta uint64
+		if i+1 < len(arr) {
+			delta = arr[i+1] - arr[i]
+		}
+		j := i + 1
+		for j < len(arr) && arr[j] == arr[j-1]+delta {
+			j++
+		}
+
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, arr[i])]...)
+		buf = append(buf, tmp[:binary.PutVarint(tmp, int64(delta))]...)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(j-i))]...)
+		i = j
+	}
+	return buf
+}
+
+// decodeRunLengthInts decodes an array encoded by encodeRunLengthInts,
+// rejecting encodings that encodeRunLengthInts wouldn't produce.
+func decodeRunLengthInts(data []byte) ([]uint64, error) {
+	arr := []uint64{}
+	var prevDelta uint64
+	for len(data) > 0 {
+		start, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("malformed run start")
+		}
+		data = data[n:]
+		signedDelta, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("malformed run delta")
+		}
+		data = data[n:]
+		length, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("malformed run length")
+		}
+		data = data[n:]
+
+		delta := uint64(signedDelta)
+		switch {
+		case length == 0:
+			return nil, fmt.Errorf("non-canonical run length encoding: empty run")
+		case length == 1 && (len(data) > 0 || delta != 0):
+			return nil, fmt.Errorf("non-canonical run length encoding: run of one value")
+		case len(arr) > 0 && start == arr[len(arr)-1]+prevDelta:
+			return nil, fmt.Errorf("non-canonical run length encoding: run continues the previous run")
+		case length > uint64(maxRunLengthInts-len(arr)):
+			return nil, fmt.Errorf("run length encoded array exceeds maximum length of %d", maxRunLengthInts)
+		}
+
+		for v, i := start, uint64(0); i < length; v, i = v+delta, i+1 {
+			arr = append(arr, v)
+		}
+		prevDelta = delta
+	}
+	return arr, nil
 }
 
 // TypeMatches returns whether or not 'val' is the go type expected for the given ABI type
@@ -0,0 +1,79 @@
+package abi
+
+import (
+	"fmt"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+)
+
+// cborLinkTag is the CBOR tag that marks a dag-cbor link.
+const cborLinkTag = 42
+
+// DecodeBlockRefs decodes a CBOR array of dag-cbor links, such as a list of
+// block header cids in a chain-sync message, preserving their order. Each
+// element must be a tag 42 link holding a valid cid. It parses the links
+// directly rather than going through the generic value machinery, since the
+// shape is so common.
+func DecodeBlockRefs(data []byte) ([]cid.Cid, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	major, n, rest, err := readCBORHead(data)
+	if err != nil {
+		return nil, err
+	}
+	if major != 4 {
+		return nil, fmt.Errorf("expected an array of links")
+	}
+	// Every link takes more than a byte, which also bounds the allocation.
+	if n > uint64(len(rest)) {
+		return nil, errMalformedCBOR
+	}
+
+	out := make([]cid.Cid, 0, n)
+	for i := uint64(0); i < n; i++ {
+		var c cid.Cid
+		if c, rest, err = readCBORLink(rest); err != nil {
+			return nil, fmt.Errorf("element %d is not a valid link: %s", i, err)
+		}
+		out = append(out, c)
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("unexpected %d bytes after array of links", len(rest))
+	}
+
+	return out, nil
+}
+
+// readCBORLink reads the dag-cbor link at the start of data and returns its
+// cid and the rest of data.
+func readCBORLink(data []byte) (cid.Cid, []byte, error) {
+	major, tag, rest, err := readCBORHead(data)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	if major != 6 || tag != cborLinkTag {
+		return cid.Undef, nil, fmt.Errorf("not tagged as a link")
+	}
+
+	major, n, rest, err := readCBORHead(rest)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	if major != 2 || n > uint64(len(rest)) {
+		return cid.Undef, nil, fmt.Errorf("link does not hold a byte string")
+	}
+
+	// The cid is preceded by the identity multibase prefix.
+	raw := rest[:n]
+	if len(raw) == 0 || raw[0] != 0 {
+		return cid.Undef, nil, fmt.Errorf("link is missing its multibase prefix")
+	}
+	c, err := cid.Cast(raw[1:])
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	return c, rest[n:], nil
+}
@@ -0,0 +1,74 @@
+package abi
+
+import (
+	"testing"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	cbor "gx/ipfs/QmRoARq3nkUb13HSKZGepCZSWe5GrVPwx7xURJGZ7KWv9V/go-ipld-cbor"
+
+	"github.com/filecoin-project/go-filecoin/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeBlockRefs(t *testing.T) {
+	newCid := types.NewCidForTestGetter()
+	headers := []cid.Cid{newCid(), newCid(), newCid()}
+
+	t.Run("decodes links in order", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data, err := cbor.DumpObject(headers)
+		require.NoError(err)
+
+		refs, err := DecodeBlockRefs(data)
+		require.NoError(err)
+		require.Len(refs, len(headers))
+		for i, ref := range refs {
+			assert.True(headers[i].Equals(ref))
+			assert.True(ref.Defined())
+		}
+
+		data, err = cbor.DumpObject([]cid.Cid{})
+		require.NoError(err)
+		refs, err = DecodeBlockRefs(data)
+		require.NoError(err)
+		assert.Empty(refs)
+	})
+
+	t.Run("rejects elements that are not links", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data, err := cbor.DumpObject([]interface{}{headers[0], headers[1].Bytes()})
+		require.NoError(err)
+		_, err = DecodeBlockRefs(data)
+		assert.EqualError(err, "element 1 is not a valid link: not tagged as a link")
+
+		data, err = cbor.DumpObject(headers[0])
+		require.NoError(err)
+		_, err = DecodeBlockRefs(data)
+		assert.Error(err)
+	})
+
+	t.Run("rejects malformed links", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data, err := cbor.DumpObject(headers[:1])
+		require.NoError(err)
+
+		// Truncated, and with trailing bytes.
+		_, err = DecodeBlockRefs(data[:len(data)-1])
+		assert.Error(err)
+		_, err = DecodeBlockRefs(append(data, 0x00))
+		assert.Error(err)
+
+		// A cid with an unknown version.
+		corrupt := append([]byte{}, data...)
+		corrupt[len(corrupt)-len(headers[0].Bytes())] = 0x02
+		_, err = DecodeBlockRefs(corrupt)
+		assert.Error(err)
+	})
+}
@@ -0,0 +1,194 @@
+package abi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+)
+
+// ErrTrailingBytes is returned by Decoder.Next when data follows the last value.
+var ErrTrailingBytes = errors.New("trailing bytes after values")
+
+// Decoder decodes values encoded by EncodeValues from a stream, one at a time,
+// so that the whole encoding never needs to be held in memory. Next reads
+// each value into memory in full before returning it; NextReader instead
+// returns a reader for a Bytes value, so that it can be streamed too.
+type Decoder struct {
+	r     io.Reader
+	types []Type
+	// next is the index of the next value to decode, or -1 before the
+	// array header has been read.
+	next int
+	// value is what is left of the value last returned by NextReader, which
+	// is skipped before the next value is read.
+	value *valueReader
+}
+
+// NewDecoder returns a Decoder that reads values of the given types from r.
+func NewDecoder(r io.Reader, types []Type) *Decoder {
+	return &Decoder{r: r, types: types, next: -1}
+}
+
+// Next returns the next value. Once every value has been decoded it returns
+// io.EOF, or ErrTrailingBytes if r holds more data.
+func (d *Decoder) Next() (*Value, error) {
+	if err := d.start(); err != nil {
+		return nil, err
+	}
+	vr, err := d.readValueHead()
+	if err != nil {
+		return nil, err
+	}
+
+	// Grow the buffer as data arrives rather than trusting the length.
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, vr); err != nil {
+		return nil, errors.Wrapf(err, "unable to read parameter %d", d.next)
+	}
+
+	v, err := Deserialize(buf.Bytes(), d.types[d.next])
+	if err != nil {
+		return nil, err
+	}
+	d.next++
+	return v, nil
+}
+
+// NextReader returns a reader of the next value, which must be of type Bytes,
+// rather than reading it into memory. The reader is valid until the next call
+// to Next or NextReader, which skip whatever of it was not read. Once every
+// value has been decoded it returns io.EOF, or ErrTrailingBytes if r holds
+// more data.
+func (d *Decoder) NextReader() (io.Reader, error) {
+	if err := d.start(); err != nil {
+		return nil, err
+	}
+	if d.types[d.next] != Bytes {
+		return nil, fmt.Errorf("parameter %d is of type %s, not %s", d.next, d.types[d.next], Bytes)
+	}
+	vr, err := d.readValueHead()
+	if err != nil {
+		return nil, err
+	}
+
+	d.value = vr
+	d.next++
+	return vr, nil
+}
+
+// start prepares to read the next value, skipping the rest of the last value
+// returned by NextReader and reading the array header if it hasn't been. It
+// returns io.EOF or ErrTrailingBytes if every value has been decoded.
+func (d *Decoder) start() error {
+	if d.value != nil {
+		if _, err := io.Copy(ioutil.Discard, d.value); err != nil {
+			return errors.Wrapf(err, "unable to read parameter %d", d.next-1)
+		}
+		d.value = nil
+	}
+
+	if d.next < 0 {
+		if err := d.readHeader(); err != nil {
+			return err
+		}
+	}
+
+	if d.next == len(d.types) {
+		var b [1]byte
+		if _, err := io.ReadFull(d.r, b[:]); err == io.EOF {
+			return io.EOF
+		} else if err != nil {
+			return err
+		}
+		return ErrTrailingBytes
+	}
+	return nil
+}
+
+// readValueHead reads the head of the next value's byte string and returns a
+// reader of its contents.
+func (d *Decoder) readValueHead() (*valueReader, error) {
+	major, length, err := d.readItemHeader()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read parameter %d", d.next)
+	}
+
+	switch {
+	case major == 7 && length == 22: // null, which an empty value encodes as
+		return &valueReader{r: d.r}, nil
+	case major == 2 && length > math.MaxInt64:
+		return nil, fmt.Errorf("parameter %d is too long", d.next)
+	case major == 2:
+		return &valueReader{r: d.r, n: int64(length)}, nil
+	default:
+		return nil, fmt.Errorf("parameter %d is not a byte string", d.next)
+	}
+}
+
+// readHeader reads the header of the array of values and checks it holds as
+// many values as there are types. An empty stream holds no values.
+func (d *Decoder) readHeader() error {
+	major, length, err := d.readItemHeader()
+	if err == io.EOF {
+		major, length, err = 4, 0, nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to read values header")
+	}
+	if major != 4 {
+		return fmt.Errorf("values are not an array")
+	}
+	if length != uint64(len(d.types)) {
+		return fmt.Errorf("expected %d parameters, but got %d", len(d.types), length)
+	}
+	d.next = 0
+	return nil
+}
+
+// readItemHeader reads the header of a CBOR item, returning its major type and
+// its argument, such as its length. It returns io.EOF if r is empty.
+func (d *Decoder) readItemHeader() (byte, uint64, error) {
+	var b [9]byte
+	if _, err := io.ReadFull(d.r, b[:1]); err != nil {
+		return 0, 0, err
+	}
+	n, err := cborHeadLength(b[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := io.ReadFull(d.r, b[1:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, err
+	}
+
+	major, arg, _, err := readCBORHead(b[:n])
+	return major, arg, err
+}
+
+// valueReader reads the n bytes of a value from r, returning
+// io.ErrUnexpectedEOF if r ends first.
+type valueReader struct {
+	r io.Reader
+	n int64
+}
+
+func (vr *valueReader) Read(p []byte) (int, error) {
+	if vr.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > vr.n {
+		p = p[:vr.n]
+	}
+	n, err := vr.r.Read(p)
+	vr.n -= int64(n)
+	if err == io.EOF && vr.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
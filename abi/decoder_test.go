@@ -0,0 +1,148 @@
+package abi
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"testing"
+
+	"github.com/filecoin-project/go-filecoin/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecoder(t *testing.T) {
+	blob := bytes.Repeat([]byte("blob"), 100000)
+	vals := []*Value{BigIntValue(big.NewInt(17)), BytesValue(blob), BlockHeightValue(nil), StringValue("beep")}
+	valTypes := []Type{Integer, Bytes, BlockHeight, String}
+
+	t.Run("decodes each value", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data, err := EncodeValues(vals)
+		require.NoError(err)
+		expected, err := DecodeValues(data, valTypes)
+		require.NoError(err)
+
+		d := NewDecoder(bytes.NewReader(data), valTypes)
+		for _, exp := range expected {
+			v, err := d.Next()
+			require.NoError(err)
+			assert.Equal(exp, v)
+		}
+		_, err = d.Next()
+		assert.Equal(io.EOF, err)
+		_, err = d.Next()
+		assert.Equal(io.EOF, err)
+	})
+
+	t.Run("streams bytes values", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data, err := EncodeValues(vals)
+		require.NoError(err)
+
+		d := NewDecoder(bytes.NewReader(data), valTypes)
+		_, err = d.NextReader()
+		assert.EqualError(err, "parameter 0 is of type *big.Int, not []byte")
+		_, err = d.Next()
+		require.NoError(err)
+
+		r, err := d.NextReader()
+		require.NoError(err)
+		streamed, err := ioutil.ReadAll(r)
+		require.NoError(err)
+		assert.Equal(blob, streamed)
+
+		v, err := d.Next()
+		require.NoError(err)
+		assert.Equal(BlockHeight, v.Type)
+		v, err = d.Next()
+		require.NoError(err)
+		assert.Equal(StringValue("beep"), v)
+		_, err = d.NextReader()
+		assert.Equal(io.EOF, err)
+	})
+
+	t.Run("skips what is left of a streamed value", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data, err := EncodeValues(vals)
+		require.NoError(err)
+
+		d := NewDecoder(bytes.NewReader(data), valTypes)
+		_, err = d.Next()
+		require.NoError(err)
+		r, err := d.NextReader()
+		require.NoError(err)
+		_, err = io.ReadFull(r, make([]byte, 10))
+		require.NoError(err)
+
+		_, err = d.Next()
+		require.NoError(err)
+		v, err := d.Next()
+		require.NoError(err)
+		assert.Equal(StringValue("beep"), v)
+	})
+
+	t.Run("streams truncated values as errors", func(t *testing.T) {
+		require := require.New(t)
+
+		data, err := EncodeValues(vals)
+		require.NoError(err)
+
+		d := NewDecoder(bytes.NewReader(data[:1000]), valTypes)
+		_, err = d.Next()
+		require.NoError(err)
+		r, err := d.NextReader()
+		require.NoError(err)
+		_, err = ioutil.ReadAll(r)
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	})
+
+	t.Run("decodes no values", func(t *testing.T) {
+		_, err := NewDecoder(bytes.NewReader(nil), nil).Next()
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("rejects trailing bytes", func(t *testing.T) {
+		require := require.New(t)
+
+		data, err := EncodeValues([]*Value{StringValue("beep")})
+		require.NoError(err)
+
+		d := NewDecoder(bytes.NewReader(append(data, 0)), []Type{String})
+		_, err = d.Next()
+		require.NoError(err)
+		_, err = d.Next()
+		assert.Equal(t, ErrTrailingBytes, err)
+	})
+
+	t.Run("rejects truncated values", func(t *testing.T) {
+		require := require.New(t)
+
+		data, err := EncodeValues(vals)
+		require.NoError(err)
+
+		d := NewDecoder(bytes.NewReader(data[:1000]), valTypes)
+		_, err = d.Next()
+		require.NoError(err)
+		_, err = d.Next()
+		assert.EqualError(t, err, "unable to read parameter 1: unexpected EOF")
+	})
+
+	t.Run("rejects the wrong number of values", func(t *testing.T) {
+		data, err := EncodeValues([]*Value{AttoFILValue(types.NewAttoFILFromFIL(1))})
+		require.NoError(t, err)
+
+		_, err = NewDecoder(bytes.NewReader(data), []Type{AttoFIL, AttoFIL}).Next()
+		assert.EqualError(t, err, "expected 2 parameters, but got 1")
+
+		_, err = NewDecoder(bytes.NewReader(nil), []Type{AttoFIL}).Next()
+		assert.EqualError(t, err, "expected 1 parameters, but got 0")
+	})
+}
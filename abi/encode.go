@@ -1,10 +1,17 @@
 package abi
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
 
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	cbor "gx/ipfs/QmRoARq3nkUb13HSKZGepCZSWe5GrVPwx7xURJGZ7KWv9V/go-ipld-cbor"
 	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+
+	"github.com/filecoin-project/go-filecoin/types"
 )
 
 // EncodeValues encodes a set of abi values to raw bytes. Zero length arrays of
@@ -28,31 +35,439 @@ func EncodeValues(vals []*Value) ([]byte, error) {
 	return cbor.DumpObject(arr)
 }
 
-// DecodeValues decodes an array of abi values from the given buffer, using the
-// provided type information.
-func DecodeValues(data []byte, types []Type) ([]*Value, error) {
+// EncodingVersion is the version of the encoding of values written by
+// EncodeValuesVersioned. Version 0 is the encoding written by EncodeValues.
+const EncodingVersion = 0
+
+// EncodeValuesVersioned encodes values like EncodeValues, preceded by a byte
+// holding EncodingVersion, so that decoders can detect encodings they don't
+// understand. Parameters that are part of consensus still use EncodeValues.
+func EncodeValuesVersioned(vals []*Value) ([]byte, error) {
+	data, err := EncodeValues(vals)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{EncodingVersion}, data...), nil
+}
+
+// DecodeValuesVersioned decodes values encoded by EncodeValuesVersioned. It
+// returns an error if they were encoded with a version other than
+// EncodingVersion.
+func DecodeValuesVersioned(data []byte, types []Type) ([]*Value, error) {
 	if len(data) == 0 {
+		return nil, errors.New("missing encoding version")
+	}
+	if data[0] != EncodingVersion {
+		return nil, fmt.Errorf("unsupported encoding version %d, expected %d", data[0], EncodingVersion)
+	}
+
+	return DecodeValues(data[1:], types)
+}
+
+// EncodeValuesTagged encodes values like EncodeValues, but with each value
+// preceded by a byte holding its Type, so that DecodeValuesTagged can decode
+// them without being told their types. It is intended for debugging tools and
+// generic inspectors; message parameters still use EncodeValues.
+func EncodeValuesTagged(vals []*Value) ([]byte, error) {
+	if len(vals) == 0 {
 		return nil, nil
 	}
 
+	arr := make([][]byte, 0, len(vals))
+	for _, val := range vals {
+		if val.Type > math.MaxUint8 {
+			return nil, fmt.Errorf("type %d does not fit in a tag", val.Type)
+		}
+		data, err := val.Serialize()
+		if err != nil {
+			return nil, err
+		}
+
+		arr = append(arr, append([]byte{byte(val.Type)}, data...))
+	}
+
+	return cbor.DumpObject(arr)
+}
+
+// DecodeValuesTagged decodes values encoded by EncodeValuesTagged.
+func DecodeValuesTagged(data []byte) ([]*Value, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	if err := checkEncoding(data, DefaultMaxDecodedSize); err != nil {
+		return nil, err
+	}
+
 	var arr [][]byte
 	if err := cbor.DecodeInto(data, &arr); err != nil {
 		return nil, err
 	}
 
+	out := make([]*Value, 0, len(arr))
+	for i, tagged := range arr {
+		if len(tagged) == 0 {
+			return nil, fmt.Errorf("value %d has no type tag", i)
+		}
+		v, err := Deserialize(tagged[1:], Type(tagged[0]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to decode value %d", i)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// ErrChecksumMismatch is returned by DecodeValuesChecked when the data doesn't
+// match its checksum, e.g. because it was corrupted or truncated.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumTable is the CRC-32 table used for checksums of encoded values.
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// EncodeValuesChecked encodes values like EncodeValues, followed by a 4 byte
+// big-endian CRC-32C checksum of the encoding, so that corruption can be
+// detected when the data travels over channels that aren't content-addressed.
+// Parameters that are part of consensus still use EncodeValues.
+func EncodeValuesChecked(vals []*Value) ([]byte, error) {
+	data, err := EncodeValues(vals)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := make([]byte, crc32.Size)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(data, checksumTable))
+	return append(data, sum...), nil
+}
+
+// DecodeValuesChecked decodes values encoded by EncodeValuesChecked. It
+// returns ErrChecksumMismatch if the checksum is missing or doesn't match.
+func DecodeValuesChecked(data []byte, types []Type) ([]*Value, error) {
+	if len(data) < crc32.Size {
+		return nil, ErrChecksumMismatch
+	}
+	data, sum := data[:len(data)-crc32.Size], data[len(data)-crc32.Size:]
+	if binary.BigEndian.Uint32(sum) != crc32.Checksum(data, checksumTable) {
+		return nil, ErrChecksumMismatch
+	}
+
+	return DecodeValues(data, types)
+}
+
+// DefaultMaxDecodedSize is the largest length, in bytes, of any value or
+// array of values that DecodeValues accepts.
+const DefaultMaxDecodedSize = 1 << 24
+
+// DecodeValues decodes an array of abi values from the given buffer, using the
+// provided type information. It rejects data declaring a length larger than
+// DefaultMaxDecodedSize.
+func DecodeValues(data []byte, types []Type) ([]*Value, error) {
+	return DecodeValuesWithLimit(data, types, DefaultMaxDecodedSize)
+}
+
+// DecodeValuesWithLimit decodes like DecodeValues, but rejects data declaring
+// a string or array longer than maxBytes before decoding any of it.
+func DecodeValuesWithLimit(data []byte, types []Type, maxBytes int) ([]*Value, error) {
+	var cost uint64
+	vals, _, err := decodeValuesPartial(data, types, maxBytes, &cost)
+	if err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// DecodeValuesPartial decodes like DecodeValues, but if a value fails to
+// deserialize it also returns the values decoded before it and the index of
+// the value that failed. The index is -1 on success or if the failure is not
+// specific to one value. It is intended for diagnostics; use DecodeValues
+// wherever all-or-nothing decoding is required.
+func DecodeValuesPartial(data []byte, types []Type) ([]*Value, int, error) {
+	var cost uint64
+	return decodeValuesPartial(data, types, DefaultMaxDecodedSize, &cost)
+}
+
+// decodeValuesPartial decodes like DecodeValuesPartial, adding the number of
+// CBOR tokens decoded, including those nested inside values that are
+// themselves encoded as CBOR, to cost as it goes.
+func decodeValuesPartial(data []byte, types []Type, maxBytes int, cost *uint64) ([]*Value, int, error) {
+	if len(data) == 0 {
+		// EncodeValues encodes no values as no data.
+		if len(types) > 0 {
+			return nil, -1, fmt.Errorf("expected %d parameters, but got 0", len(types))
+		}
+		return nil, -1, nil
+	}
+
+	if maxBytes < 0 {
+		maxBytes = 0
+	}
+	if err := countEncoding(data, cost, uint64(maxBytes)); err != nil {
+		return nil, -1, err
+	}
+
+	var arr [][]byte
+	if err := cbor.DecodeInto(data, &arr); err != nil {
+		return nil, -1, err
+	}
+
 	if len(arr) != len(types) {
-		return nil, fmt.Errorf("expected %d parameters, but got %d", len(types), len(arr))
+		return nil, -1, fmt.Errorf("expected %d parameters, but got %d", len(types), len(arr))
 	}
 
 	out := make([]*Value, 0, len(types))
 	for i, t := range types {
+		if cborEncoded(t) {
+			if err := countEncoding(arr[i], cost, uint64(maxBytes)); err != nil {
+				return out, i, err
+			}
+		}
 		v, err := Deserialize(arr[i], t)
 		if err != nil {
-			return nil, err
+			return out, i, err
 		}
 		out = append(out, v)
 	}
-	return out, nil
+	return out, -1, nil
+}
+
+// DecodeValuesWithCost decodes like DecodeValues and also returns the cost
+// of decoding, so that it can be billed as gas in proportion to the work done
+// rather than to the length of data. The cost is the number of CBOR tokens
+// (integers, strings, and array and map headers) decoded, including those
+// nested inside values that are themselves encoded as CBOR. If decoding
+// fails, the cost of the work done before it failed is returned with the
+// error, so that it can still be billed.
+func DecodeValuesWithCost(data []byte, types []Type) ([]*Value, uint64, error) {
+	var cost uint64
+	vals, _, err := decodeValuesPartial(data, types, DefaultMaxDecodedSize, &cost)
+	if err != nil {
+		return nil, cost, err
+	}
+	return vals, cost, nil
+}
+
+// ErrIndefiniteLength is returned when decoding CBOR that uses an
+// indefinite-length string, array or map. Only definite-length encodings are
+// accepted so that every value has a single encoding.
+var ErrIndefiniteLength = errors.New("indefinite-length CBOR encodings are not allowed")
+
+// maxCBORNesting is how deeply CBOR arrays, maps and tags may be nested in
+// decoded data. No value's encoding comes close; the limit keeps hostile
+// input from exhausting the stack of the decoder.
+const maxCBORNesting = 64
+
+// ErrNestingTooDeep is returned when decoding CBOR whose arrays, maps and
+// tags are nested more than maxCBORNesting deep.
+var ErrNestingTooDeep = fmt.Errorf("CBOR items nested more than %d deep are not allowed", maxCBORNesting)
+
+// errMalformedCBOR is returned internally when data isn't well-formed CBOR.
+var errMalformedCBOR = errors.New("malformed CBOR")
+
+// lengthLimitError is returned when decoding CBOR declaring a string or array
+// longer than allowed.
+type lengthLimitError struct {
+	length, max uint64
+}
+
+func (e lengthLimitError) Error() string {
+	return fmt.Sprintf("declared length %d exceeds maximum of %d bytes", e.length, e.max)
+}
+
+// checkDefiniteLength returns ErrIndefiniteLength if the CBOR item at the
+// start of data, or any item nested in it, has indefinite length, and
+// ErrNestingTooDeep if items are nested too deeply. Data that is otherwise
+// malformed is left for the decoder to reject.
+func checkDefiniteLength(data []byte) error {
+	return checkEncoding(data, math.MaxUint64)
+}
+
+// checkEncoding checks the CBOR item at the start of data as
+// checkDefiniteLength does, and also returns an error if it or any item nested
+// in it declares a length greater than maxLength.
+func checkEncoding(data []byte, maxLength uint64) error {
+	var tokens uint64
+	return countEncoding(data, &tokens, maxLength)
+}
+
+// countEncoding checks the CBOR item at the start of data as checkEncoding
+// does, adding the number of tokens it walked to tokens.
+func countEncoding(data []byte, tokens *uint64, maxLength uint64) error {
+	_, err := walkCBORItem(data, tokens, maxLength, 0)
+	if _, ok := err.(lengthLimitError); ok || err == ErrIndefiniteLength || err == ErrNestingTooDeep {
+		return err
+	}
+	return nil
+}
+
+// skipCBORItem returns the rest of data following the CBOR item at its start.
+func skipCBORItem(data []byte) ([]byte, error) {
+	var tokens uint64
+	return walkCBORItem(data, &tokens, math.MaxUint64, 0)
+}
+
+// walkCBORItem returns the rest of data following the CBOR item at its start,
+// adding the number of tokens in the item, including nested items, to tokens.
+// It returns a lengthLimitError if any string or array in the item declares a
+// length greater than maxLength, and ErrNestingTooDeep if the item, found at
+// the given depth of nesting, contains items nested past maxCBORNesting.
+func walkCBORItem(data []byte, tokens *uint64, maxLength uint64, depth int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errMalformedCBOR
+	}
+	if depth > maxCBORNesting {
+		return nil, ErrNestingTooDeep
+	}
+	major, arg, data, err := readCBORHead(data)
+	if err != nil {
+		return nil, err
+	}
+	*tokens++
+
+	if major >= 2 && major <= 5 && arg > maxLength {
+		return nil, lengthLimitError{length: arg, max: maxLength}
+	}
+
+	switch major {
+	case 2, 3: // byte and text strings
+		if arg > uint64(len(data)) {
+			return nil, errMalformedCBOR
+		}
+		return data[arg:], nil
+	case 4, 5: // arrays and maps
+		// Every item takes at least a byte, which also bounds the loop.
+		if arg > uint64(len(data)) {
+			return nil, errMalformedCBOR
+		}
+		items := arg
+		if major == 5 {
+			items *= 2
+		}
+		for i := uint64(0); i < items; i++ {
+			var err error
+			if data, err = walkCBORItem(data, tokens, maxLength, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	case 6: // tags
+		return walkCBORItem(data, tokens, maxLength, depth+1)
+	default: // integers and simple values
+		return data, nil
+	}
+}
+
+// readCBORHead reads the head of the definite length CBOR item at the start
+// of data, returning its major type, its argument and the rest of data.
+func readCBORHead(data []byte) (byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, nil, errMalformedCBOR
+	}
+	n, err := cborHeadLength(data[0])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if len(data) < n {
+		return 0, 0, nil, errMalformedCBOR
+	}
+
+	major, info := data[0]>>5, data[0]&0x1f
+	arg := uint64(info)
+	if n > 1 {
+		arg = 0
+		for _, b := range data[1:n] {
+			arg = arg<<8 | uint64(b)
+		}
+	}
+	return major, arg, data[n:], nil
+}
+
+// cborHeadLength returns the length of the head of the definite length CBOR
+// item whose first byte is b.
+func cborHeadLength(b byte) (int, error) {
+	major, info := b>>5, b&0x1f
+	switch {
+	case info < 24:
+		return 1, nil
+	case info <= 27:
+		return 1 + 1<<(info-24), nil
+	case info == 31 && major >= 2 && major <= 5:
+		return 0, ErrIndefiniteLength
+	default:
+		return 0, errMalformedCBOR
+	}
+}
+
+// maxFrameLength bounds the length of a single framed group of values, so a
+// corrupt length prefix can't cause an arbitrarily large allocation.
+const maxFrameLength = 1 << 24
+
+// EncodeValuesFramed encodes a set of abi values as EncodeValues does and
+// writes them to w prefixed with their length as an unsigned varint, so that
+// several groups of values can be written back-to-back to one stream.
+func EncodeValuesFramed(w io.Writer, vals []*Value) error {
+	data, err := EncodeValues(vals)
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, uint64(len(data)))
+	if _, err := w.Write(prefix[:n]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// DecodeValuesFramedNext reads one group of values written by
+// EncodeValuesFramed from r and decodes it using the provided type
+// information. It reads exactly one frame and nothing past it. It returns
+// io.EOF if r is exhausted before the start of a frame.
+func DecodeValuesFramedNext(r io.Reader, types []Type) ([]*Value, error) {
+	length, err := binary.ReadUvarint(byteReader{r})
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read frame length")
+	}
+	if length > maxFrameLength {
+		return nil, fmt.Errorf("frame length %d exceeds maximum of %d", length, maxFrameLength)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(err, "unable to read frame")
+	}
+
+	return DecodeValues(data, types)
+}
+
+// byteReader reads single bytes from an io.Reader without buffering, so no
+// more is consumed from the underlying reader than is needed.
+type byteReader struct {
+	io.Reader
+}
+
+func (br byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(br.Reader, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// AppendLogEntry returns the encoding of a log entry holding payload that
+// links to the entry with cid prev, or starts a new log if prev is
+// cid.Undef. The encoding is CBOR with prev as a link, so it can be Put into
+// an actor's storage and the entries it links to are kept alive with it.
+func AppendLogEntry(prev cid.Cid, payload []byte) ([]byte, error) {
+	le := &types.LogEntry{Prev: prev, Payload: payload}
+	return LogEntryValue(le).Serialize()
 }
 
 // ToEncodedValues converts from a list of go abi-compatible values to abi values and then encodes to raw bytes.
@@ -1,11 +1,23 @@
 package abi
 
 import (
+	"bytes"
+	"io"
+	"math"
 	"math/big"
+	"math/rand"
+	"reflect"
 	"testing"
+	"time"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	cbor "gx/ipfs/QmRoARq3nkUb13HSKZGepCZSWe5GrVPwx7xURJGZ7KWv9V/go-ipld-cbor"
+	"gx/ipfs/QmY5Grm8pJdiSSVsYxx4uNRgweY72EmYwuSDbRnbFok3iY/go-libp2p-peer"
 
 	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // TODO: tests that check the exact serialization of different inputs.
@@ -25,6 +37,9 @@ func TestBasicEncodingRoundTrip(t *testing.T) {
 		"a string":   {"flugzeug"},
 		"mixed":      {big.NewInt(17), []byte("beep"), "mr rogers", addrGetter()},
 		"sector ids": {uint64(1234), uint64(0)},
+		"true":       {true},
+		"false":      {false},
+		"bools":      {true, "beep", false},
 	}
 
 	for tname, tcase := range cases {
@@ -50,6 +65,859 @@ func TestBasicEncodingRoundTrip(t *testing.T) {
 	}
 }
 
+func TestValueConstructorsRoundTrip(t *testing.T) {
+	addrGetter := address.NewForTestGetter()
+	pid, err := peer.IDB58Decode("QmWbMozPyW6Ecagtxq7SXBXXLY5BNdP1GwHB2WoZCKMvcb")
+	require.NoError(t, err)
+	someCid := types.SomeCid()
+
+	cases := map[string]struct {
+		val     *Value
+		expType Type
+	}{
+		"address":         {AddressValue(addrGetter()), Address},
+		"attofil":         {AttoFILValue(types.NewAttoFILFromFIL(42)), AttoFIL},
+		"bytes amount":    {BytesAmountValue(types.NewBytesAmount(1024)), BytesAmount},
+		"channel id":      {ChannelIDValue(types.NewChannelID(7)), ChannelID},
+		"block height":    {BlockHeightValue(types.NewBlockHeight(100)), BlockHeight},
+		"big int":         {BigIntValue(big.NewInt(579)), Integer},
+		"bytes":           {BytesValue([]byte("foo")), Bytes},
+		"string":          {StringValue("flugzeug"), String},
+		"uint array":      {UintArrayValue([]uint64{1, 2, 3}), UintArray},
+		"peer id":         {PeerIDValue(pid), PeerID},
+		"sector id":       {SectorIDValue(1234), SectorID},
+		"commitments map": {CommitmentsMapValue(map[string]types.Commitments{"1": {}}), CommitmentsMap},
+		"duration":        {DurationValue(time.Hour), Duration},
+		"bitfield":        {BitFieldValue(types.NewBitField(1, 2, 3, 100)), BitField},
+		"rational":        {RationalValue(big.NewRat(-3, 7)), Rational},
+		"run length ints": {RunLengthIntsValue([]uint64{1, 2, 3, 3, 3, 9}), RunLengthInts},
+		"boolean":         {BooleanValue(true), Boolean},
+		"uint64":          {Uint64Value(1 << 40), Uint64},
+		"log entry":       {LogEntryValue(&types.LogEntry{Prev: types.SomeCid(), Payload: []byte("payload")}), LogEntry},
+		"proof path":      {ProofPathValue(&types.ProofPath{Cids: []cid.Cid{types.SomeCid()}, Leaf: []byte("leaf")}), ProofPath},
+		"cid":             {CidValue(someCid), Cid},
+		"fixed128":        {Fixed128Value(big.NewInt(-5)), Fixed128},
+	}
+
+	for tname, tcase := range cases {
+		t.Run(tname, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			assert.Equal(tcase.expType, tcase.val.Type)
+			assert.True(TypeMatches(tcase.val.Type, reflect.TypeOf(tcase.val.Val)))
+
+			data, err := EncodeValues([]*Value{tcase.val})
+			require.NoError(err)
+
+			outVals, err := DecodeValues(data, []Type{tcase.expType})
+			require.NoError(err)
+			assert.Equal([]*Value{tcase.val}, outVals)
+		})
+	}
+}
+
+func TestValueEquals(t *testing.T) {
+	addrGetter := address.NewForTestGetter()
+	addr := addrGetter()
+
+	t.Run("equal values with differing representations", func(t *testing.T) {
+		assert := assert.New(t)
+
+		cases := map[string][2]*Value{
+			"big int":      {BigIntValue(big.NewInt(5)), BigIntValue(new(big.Int).Sub(big.NewInt(10), big.NewInt(5)))},
+			"zero big int": {BigIntValue(big.NewInt(0)), BigIntValue(new(big.Int).SetBytes([]byte{}))},
+			"attofil":      {AttoFILValue(types.NewAttoFILFromFIL(1)), AttoFILValue(types.NewAttoFIL(new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)))},
+			"block height": {BlockHeightValue(types.NewBlockHeight(3)), BlockHeightValue(types.NewBlockHeightFromBytes(types.NewBlockHeight(3).Bytes()))},
+			"address":      {AddressValue(addr), AddressValue(addr)},
+			"bytes":        {BytesValue([]byte("foo")), BytesValue(append([]byte{}, "foo"...))},
+			"nil bytes":    {BytesValue(nil), BytesValue([]byte{})},
+			"string":       {StringValue("bar"), StringValue("bar")},
+			"uint array":   {UintArrayValue([]uint64{1, 2}), UintArrayValue([]uint64{1, 2})},
+			"sector id":    {SectorIDValue(9), SectorIDValue(9)},
+		}
+
+		for name, pair := range cases {
+			assert.True(pair[0].Equals(pair[1]), name)
+			assert.True(pair[1].Equals(pair[0]), name)
+		}
+	})
+
+	t.Run("unequal values", func(t *testing.T) {
+		assert := assert.New(t)
+
+		cases := map[string][2]*Value{
+			"big int":        {BigIntValue(big.NewInt(5)), BigIntValue(big.NewInt(6))},
+			"nil big int":    {BigIntValue(nil), BigIntValue(big.NewInt(0))},
+			"address":        {AddressValue(addr), AddressValue(addrGetter())},
+			"bytes":          {BytesValue([]byte("foo")), BytesValue([]byte("bar"))},
+			"string":         {StringValue("foo"), StringValue("bar")},
+			"uint array":     {UintArrayValue([]uint64{1, 2}), UintArrayValue([]uint64{1})},
+			"different type": {SectorIDValue(5), BigIntValue(big.NewInt(5))},
+			"nil value":      {SectorIDValue(5), nil},
+		}
+
+		for name, pair := range cases {
+			assert.False(pair[0].Equals(pair[1]), name)
+		}
+	})
+
+	t.Run("values", func(t *testing.T) {
+		assert := assert.New(t)
+
+		a := Values{BigIntValue(big.NewInt(17)), StringValue("beep"), AddressValue(addr)}
+		b := Values{BigIntValue(new(big.Int).SetBytes([]byte{17})), StringValue("beep"), AddressValue(addr)}
+		assert.True(a.Equals(b))
+		assert.False(a.Equals(b[:2]))
+		assert.False(a.Equals(Values{BigIntValue(big.NewInt(17)), StringValue("boop"), AddressValue(addr)}))
+		assert.True(Values(nil).Equals(Values{}))
+	})
+}
+
+func TestDecodeValuesPartial(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	data, err := ToEncodedValues(big.NewInt(17), "beep", []byte("not an address"), "boop", big.NewInt(42))
+	require.NoError(err)
+
+	paramTypes := []Type{Integer, String, Address, String, Integer}
+
+	vals, idx, err := DecodeValuesPartial(data, paramTypes)
+	assert.Equal(address.ErrInvalidBytes, err)
+	assert.Equal(2, idx)
+	assert.Equal([]*Value{BigIntValue(big.NewInt(17)), StringValue("beep")}, vals)
+
+	// The strict variant discards the partial result.
+	vals, err = DecodeValues(data, paramTypes)
+	assert.Equal(address.ErrInvalidBytes, err)
+	assert.Nil(vals)
+
+	// Mismatched parameter counts aren't attributable to a single value.
+	vals, idx, err = DecodeValuesPartial(data, paramTypes[:2])
+	assert.EqualError(err, "expected 2 parameters, but got 5")
+	assert.Equal(-1, idx)
+	assert.Nil(vals)
+}
+
+func TestDurationEncoding(t *testing.T) {
+	t.Run("round trips", func(t *testing.T) {
+		cases := map[string]time.Duration{
+			"zero":  0,
+			"large": 10 * 365 * 24 * time.Hour,
+		}
+
+		for tname, d := range cases {
+			t.Run(tname, func(t *testing.T) {
+				assert := assert.New(t)
+				require := require.New(t)
+
+				data, err := ToEncodedValues(d)
+				require.NoError(err)
+
+				vals, err := DecodeValues(data, []Type{Duration})
+				require.NoError(err)
+				assert.Equal([]interface{}{d}, FromValues(vals))
+				assert.Equal(d.String(), vals[0].String())
+			})
+		}
+	})
+
+	t.Run("rejects negative durations", func(t *testing.T) {
+		_, err := ToEncodedValues(-time.Second)
+		assert.EqualError(t, err, "unable to encode values: duration must not be negative: -1s")
+	})
+
+	t.Run("rejects fractional seconds", func(t *testing.T) {
+		_, err := ToEncodedValues(1500 * time.Millisecond)
+		assert.EqualError(t, err, "unable to encode values: duration must be a whole number of seconds: 1.5s")
+	})
+}
+
+func TestBitFieldEncoding(t *testing.T) {
+	dense := types.NewBitField()
+	for i := uint64(0); i < 1000; i++ {
+		dense.Set(i)
+	}
+
+	cases := map[string]struct {
+		bf      *types.BitField
+		encoded []byte
+	}{
+		"empty":  {types.NewBitField(), []byte{}},
+		"dense":  {dense, []byte{0, 0xe8, 0x07}},
+		"sparse": {types.NewBitField(2, 7, 1<<32), []byte{2, 1, 4, 1, 0xf8, 0xff, 0xff, 0xff, 0x0f, 1}},
+	}
+
+	for tname, tcase := range cases {
+		t.Run(tname, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			val := BitFieldValue(tcase.bf)
+			encoded, err := val.Serialize()
+			require.NoError(err)
+			assert.Equal(tcase.encoded, encoded)
+
+			data, err := ToEncodedValues(tcase.bf)
+			require.NoError(err)
+
+			vals, err := DecodeValues(data, []Type{BitField})
+			require.NoError(err)
+			assert.True(val.Equals(vals[0]))
+			assert.Equal(tcase.bf.Indices(), vals[0].Val.(*types.BitField).Indices())
+		})
+	}
+}
+
+func TestProofPathEncoding(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	leaf, err := EncodeValues([]*Value{StringValue("key"), AttoFILValue(types.NewAttoFILFromFIL(3))})
+	require.NoError(err)
+
+	var hops []cid.Cid
+	for _, data := range []string{"head", "hamt node", "hamt bucket"} {
+		c, err := cid.V1Builder{Codec: cid.DagCBOR, MhType: types.DefaultHashFunction}.Sum([]byte(data))
+		require.NoError(err)
+		hops = append(hops, c)
+	}
+	path := &types.ProofPath{Cids: hops, Leaf: leaf}
+
+	data, err := ToEncodedValues(path)
+	require.NoError(err)
+
+	again, err := EncodeValues([]*Value{ProofPathValue(path)})
+	require.NoError(err)
+	assert.Equal(data, again)
+
+	vals, err := DecodeValues(data, []Type{ProofPath})
+	require.NoError(err)
+	decoded := vals[0].Val.(*types.ProofPath)
+	assert.True(path.Equal(decoded))
+	assert.Equal(hops, decoded.Cids)
+	assert.Equal(leaf, decoded.Leaf)
+
+	_, err = Deserialize([]byte{0xff}, ProofPath)
+	assert.Error(err)
+}
+
+func TestRationalEncoding(t *testing.T) {
+	t.Run("round trips", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		huge, ok := new(big.Int).SetString("123456789012345678901234567890", 10)
+		require.True(ok)
+
+		for _, r := range []*big.Rat{
+			big.NewRat(0, 1),
+			big.NewRat(1, 3),
+			big.NewRat(-1, 3),
+			big.NewRat(22, 7),
+			big.NewRat(-5, 1),
+			new(big.Rat).SetFrac(huge, big.NewInt(97)),
+			new(big.Rat).SetFrac(new(big.Int).Neg(huge), big.NewInt(1000003)),
+		} {
+			data, err := ToEncodedValues(r)
+			require.NoError(err)
+
+			vals, err := DecodeValues(data, []Type{Rational})
+			require.NoError(err)
+			assert.Equal(0, r.Cmp(vals[0].Val.(*big.Rat)), "%s decoded as %s", r, vals[0])
+		}
+	})
+
+	t.Run("is deterministic", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		a, err := RationalValue(big.NewRat(2, 4)).Serialize()
+		require.NoError(err)
+		b, err := RationalValue(big.NewRat(1, 2)).Serialize()
+		require.NoError(err)
+		assert.Equal(a, b)
+		assert.Equal([]byte{2, 0, 1, 0, 2}, a)
+	})
+
+	t.Run("rejects zero denominators", func(t *testing.T) {
+		_, err := Deserialize([]byte{2, 0, 1, 0}, Rational)
+		assert.EqualError(t, err, "rational must have a non-zero denominator")
+	})
+
+	t.Run("rejects malformed data", func(t *testing.T) {
+		for _, data := range [][]byte{{}, {5, 0, 1}, {2, 2, 1, 0, 1}, {1, 0}} {
+			_, err := Deserialize(data, Rational)
+			assert.Error(t, err, "%x", data)
+		}
+
+		_, err := RationalValue(nil).Serialize()
+		assert.Error(t, err)
+	})
+
+	t.Run("rejects non-canonical data", func(t *testing.T) {
+		cases := map[string][]byte{
+			"not in lowest terms":           {2, 0, 2, 0, 4},
+			"sign on the denominator":       {2, 0, 6, 1, 4},
+			"numerator with leading zero":   {3, 0, 0, 1, 0, 2},
+			"denominator with leading zero": {2, 0, 1, 0, 0, 2},
+			"negative zero":                 {1, 1, 0, 1},
+			"non-minimal length prefix":     {0x82, 0x00, 0, 1, 0, 2},
+		}
+		for tname, data := range cases {
+			_, err := Deserialize(data, Rational)
+			assert.EqualError(t, err, "malformed rational: not in canonical form", tname)
+		}
+
+		// The canonical encodings of the same values are accepted.
+		for _, data := range [][]byte{{2, 0, 1, 0, 2}, {2, 1, 3, 0, 2}, {1, 0, 0, 1}} {
+			_, err := Deserialize(data, Rational)
+			assert.NoError(t, err, "%x", data)
+		}
+	})
+}
+
+func TestRunLengthIntsEncoding(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	var same, increasing, random []uint64
+	for i := 0; i < 1000; i++ {
+		same = append(same, 7)
+		increasing = append(increasing, uint64(1000+3*i))
+		random = append(random, rng.Uint64())
+	}
+
+	cases := map[string]struct {
+		arr      []uint64
+		compress bool
+	}{
+		"all same":   {same, true},
+		"increasing": {increasing, true},
+		"random":     {random, false},
+		"empty":      {[]uint64{}, false},
+		"single":     {[]uint64{5}, false},
+		"decreasing": {[]uint64{5, 4, 3, 2, 1, 0, 0}, false},
+		"wrapping":   {[]uint64{math.MaxUint64 - 1, math.MaxUint64, 0, 1}, false},
+	}
+	for name, tcase := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			data, err := RunLengthIntsValue(tcase.arr).Serialize()
+			require.NoError(err)
+
+			val, err := Deserialize(data, RunLengthInts)
+			require.NoError(err)
+			assert.Equal(tcase.arr, val.Val)
+
+			if tcase.compress {
+				plain, err := UintArrayValue(tcase.arr).Serialize()
+				require.NoError(err)
+				assert.True(len(data) < len(plain)/10, "encoded %d values in %d bytes", len(tcase.arr), len(data))
+			}
+		})
+	}
+
+	t.Run("rejects non-canonical encodings", func(t *testing.T) {
+		assert := assert.New(t)
+
+		for _, data := range [][]byte{
+			{1, 2, 0},          // empty run
+			{1, 2, 1},          // single value with a non-zero delta
+			{1, 0, 1, 2, 0, 1}, // single value that isn't last
+			{1, 4, 2, 5, 4, 2}, // 1, 3 continued by 5, 7
+			{0x80},             // truncated
+		} {
+			_, err := Deserialize(data, RunLengthInts)
+			assert.Error(err, "%v", data)
+		}
+	})
+
+	t.Run("rejects huge arrays", func(t *testing.T) {
+		data := RunLengthIntsValue(nil)
+		enc, err := data.Serialize()
+		require.NoError(t, err)
+		assert.Empty(t, enc)
+
+		_, err = Deserialize([]byte{0, 0, 0xff, 0xff, 0xff, 0xff, 0x0f}, RunLengthInts)
+		assert.EqualError(t, err, "run length encoded array exceeds maximum length of 1048576")
+	})
+}
+
+func TestBooleanEncoding(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	data, err := BooleanValue(true).Serialize()
+	require.NoError(err)
+	assert.Equal([]byte{1}, data)
+	data, err = BooleanValue(false).Serialize()
+	require.NoError(err)
+	assert.Equal([]byte{0}, data)
+
+	for _, data := range [][]byte{nil, {2}, {0xff}, {0, 0}} {
+		_, err := Deserialize(data, Boolean)
+		assert.Error(err, "%x", data)
+	}
+	_, err = Deserialize([]byte{2}, Boolean)
+	assert.EqualError(err, "malformed boolean: expected a single 0x00 or 0x01 byte, got 02")
+}
+
+func TestUint64Encoding(t *testing.T) {
+	t.Run("round trips", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		vals := []*Value{Uint64Value(0), Uint64Value(300), Uint64Value(math.MaxUint64)}
+		data, err := EncodeValues(vals)
+		require.NoError(err)
+
+		decoded, err := DecodeValues(data, []Type{Uint64, Uint64, Uint64})
+		require.NoError(err)
+		assert.Equal(vals, decoded)
+		assert.Equal([]interface{}{uint64(0), uint64(300), uint64(math.MaxUint64)}, FromValues(decoded))
+	})
+
+	t.Run("decodes uint64s from ToValues", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data, err := ToEncodedValues(uint64(math.MaxUint64))
+		require.NoError(err)
+
+		decoded, err := DecodeValues(data, []Type{Uint64})
+		require.NoError(err)
+		assert.Equal(uint64(math.MaxUint64), decoded[0].Val)
+	})
+
+	t.Run("rejects malformed encodings", func(t *testing.T) {
+		assert := assert.New(t)
+
+		overflow := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02}
+		_, err := Deserialize(overflow, Uint64)
+		assert.EqualError(err, "unsupported uint64 encoding: overflows 64 bits")
+
+		for _, data := range [][]byte{nil, {0x80}, {0x01, 0x01}, {0x80, 0x00}} {
+			_, err := Deserialize(data, Uint64)
+			assert.Error(err, "%x", data)
+		}
+	})
+}
+
+func TestAppendLogEntry(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	first, err := AppendLogEntry(cid.Undef, []byte("first"))
+	require.NoError(err)
+	firstNode, err := cbor.Decode(first, types.DefaultHashFunction, -1)
+	require.NoError(err)
+	assert.Empty(firstNode.Links())
+
+	firstCid := firstNode.Cid()
+	second, err := AppendLogEntry(firstCid, []byte("second"))
+	require.NoError(err)
+	secondNode, err := cbor.Decode(second, types.DefaultHashFunction, -1)
+	require.NoError(err)
+
+	// The second entry links to the first, so storage keeps the chain alive.
+	require.Len(secondNode.Links(), 1)
+	assert.Equal(firstCid, secondNode.Links()[0].Cid)
+
+	val, err := Deserialize(second, LogEntry)
+	require.NoError(err)
+	entry := val.Val.(*types.LogEntry)
+	assert.Equal(firstCid, entry.Prev)
+	assert.Equal([]byte("second"), entry.Payload)
+
+	val, err = Deserialize(first, LogEntry)
+	require.NoError(err)
+	entry = val.Val.(*types.LogEntry)
+	assert.False(entry.Prev.Defined())
+	assert.Equal([]byte("first"), entry.Payload)
+}
+
+func TestIndefiniteLengthEncodings(t *testing.T) {
+	t.Run("rejects indefinite-length values", func(t *testing.T) {
+		cases := map[string]struct {
+			data  []byte
+			types []Type
+		}{
+			// [_ h'01']
+			"values array": {[]byte{0x9f, 0x41, 0x01, 0xff}, []Type{Bytes}},
+			// [(_ h'01')]
+			"bytes": {[]byte{0x81, 0x5f, 0x41, 0x01, 0xff}, []Type{Bytes}},
+			// [(_ h'66', h'6f6f')]
+			"string": {[]byte{0x81, 0x5f, 0x41, 'f', 0x42, 'o', 'o', 0xff}, []Type{String}},
+		}
+
+		for tname, tcase := range cases {
+			t.Run(tname, func(t *testing.T) {
+				_, err := DecodeValues(tcase.data, tcase.types)
+				assert.Equal(t, ErrIndefiniteLength, err)
+			})
+		}
+	})
+
+	t.Run("rejects indefinite-length CBOR in values", func(t *testing.T) {
+		cases := map[string]struct {
+			data []byte
+			typ  Type
+		}{
+			// [_ 1, 2]
+			"uint array": {[]byte{0x9f, 0x01, 0x02, 0xff}, UintArray},
+			// {(_ "1"): {}}
+			"commitments map key": {[]byte{0xa1, 0x7f, 0x61, '1', 0xff, 0xa0}, CommitmentsMap},
+			// {_ "1": {}}
+			"commitments map": {[]byte{0xbf, 0x61, '1', 0xa0, 0xff}, CommitmentsMap},
+		}
+
+		for tname, tcase := range cases {
+			t.Run(tname, func(t *testing.T) {
+				_, err := Deserialize(tcase.data, tcase.typ)
+				assert.Equal(t, ErrIndefiniteLength, err)
+
+				data, err := cbor.DumpObject([][]byte{tcase.data})
+				require.NoError(t, err)
+				_, err = DecodeValues(data, []Type{tcase.typ})
+				assert.Equal(t, ErrIndefiniteLength, err)
+			})
+		}
+	})
+
+	t.Run("accepts definite-length equivalents", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		vals, err := DecodeValues([]byte{0x81, 0x43, 'f', 'o', 'o'}, []Type{String})
+		require.NoError(err)
+		assert.Equal("foo", vals[0].Val)
+
+		val, err := Deserialize([]byte{0x82, 0x01, 0x02}, UintArray)
+		require.NoError(err)
+		assert.Equal([]uint64{1, 2}, val.Val)
+	})
+
+	t.Run("leaves malformed data to the decoder", func(t *testing.T) {
+		_, err := DecodeValues([]byte{0x82, 0x41}, []Type{Bytes, Bytes})
+		assert.Error(t, err)
+		assert.NotEqual(t, ErrIndefiniteLength, err)
+	})
+}
+
+func TestDeeplyNestedEncodings(t *testing.T) {
+	// nested returns depth arrays, each holding the next, around an empty one.
+	nested := func(depth int) []byte {
+		return append(bytes.Repeat([]byte{0x81}, depth), 0x80)
+	}
+
+	t.Run("rejects deeply nested values", func(t *testing.T) {
+		assert := assert.New(t)
+
+		// Far deeper than the stack would allow if it were walked recursively.
+		deep := nested(DefaultMaxDecodedSize / 2)
+		_, err := Deserialize(deep, UintArray)
+		assert.Equal(ErrNestingTooDeep, err)
+		_, err = DecodeValues(deep, []Type{UintArray})
+		assert.Equal(ErrNestingTooDeep, err)
+		_, _, err = DecodeValuesWithCost(deep, []Type{UintArray})
+		assert.Equal(ErrNestingTooDeep, err)
+
+		// Tags nest too.
+		tagged := append(bytes.Repeat([]byte{0xc0}, maxCBORNesting+1), 0x80)
+		_, err = Deserialize(tagged, LogEntry)
+		assert.Equal(ErrNestingTooDeep, err)
+	})
+
+	t.Run("accepts nesting up to the limit", func(t *testing.T) {
+		assert := assert.New(t)
+
+		assert.NoError(checkDefiniteLength(nested(maxCBORNesting)))
+		assert.Equal(ErrNestingTooDeep, checkDefiniteLength(nested(maxCBORNesting+1)))
+	})
+}
+
+func TestVersionedEncoding(t *testing.T) {
+	t.Run("round trips", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		vals := []*Value{StringValue("foo"), SectorIDValue(42)}
+		data, err := EncodeValuesVersioned(vals)
+		require.NoError(err)
+
+		// Version 0 is the unversioned encoding with a leading zero byte.
+		unversioned, err := EncodeValues(vals)
+		require.NoError(err)
+		assert.Equal(append([]byte{0}, unversioned...), data)
+
+		decoded, err := DecodeValuesVersioned(data, []Type{String, SectorID})
+		require.NoError(err)
+		assert.Equal(vals, decoded)
+	})
+
+	t.Run("round trips no values", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data, err := EncodeValuesVersioned(nil)
+		require.NoError(err)
+		assert.Equal([]byte{EncodingVersion}, data)
+
+		decoded, err := DecodeValuesVersioned(data, nil)
+		require.NoError(err)
+		assert.Empty(decoded)
+	})
+
+	t.Run("rejects other versions", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data, err := EncodeValuesVersioned([]*Value{StringValue("foo")})
+		require.NoError(err)
+		data[0] = EncodingVersion + 1
+
+		_, err = DecodeValuesVersioned(data, []Type{String})
+		assert.EqualError(err, "unsupported encoding version 1, expected 0")
+
+		_, err = DecodeValuesVersioned(nil, []Type{String})
+		assert.Error(err)
+	})
+}
+
+func TestTaggedEncoding(t *testing.T) {
+	t.Run("round trips without types", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		vals, err := ToValues([]interface{}{big.NewInt(17), "beep", address.NewForTestGetter()(), uint64(3), true, []byte{}})
+		require.NoError(err)
+
+		data, err := EncodeValuesTagged(vals)
+		require.NoError(err)
+
+		decoded, err := DecodeValuesTagged(data)
+		require.NoError(err)
+		assert.Equal(vals, decoded)
+
+		data, err = EncodeValuesTagged(nil)
+		require.NoError(err)
+		decoded, err = DecodeValuesTagged(data)
+		require.NoError(err)
+		assert.Empty(decoded)
+	})
+
+	t.Run("rejects bad tags", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data, err := cbor.DumpObject([][]byte{{byte(String), 'x'}, {}})
+		require.NoError(err)
+		_, err = DecodeValuesTagged(data)
+		assert.EqualError(err, "value 1 has no type tag")
+
+		data, err = cbor.DumpObject([][]byte{{0xfe, 'x'}})
+		require.NoError(err)
+		_, err = DecodeValuesTagged(data)
+		assert.EqualError(err, "unable to decode value 0: unrecognized Type: 254")
+
+		_, err = EncodeValuesTagged([]*Value{{Type: Type(256), Val: "x"}})
+		assert.Error(err)
+	})
+}
+
+func TestDecodeValuesCountMismatch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	data, err := ToEncodedValues("beep", "boop")
+	require.NoError(err)
+
+	_, err = DecodeValues(data, []Type{String})
+	assert.EqualError(err, "expected 1 parameters, but got 2")
+
+	_, err = DecodeValues(data, []Type{String, String, String})
+	assert.EqualError(err, "expected 3 parameters, but got 2")
+
+	// No values are encoded as no data.
+	_, err = DecodeValues(nil, []Type{String})
+	assert.EqualError(err, "expected 1 parameters, but got 0")
+
+	vals, err := DecodeValues(nil, nil)
+	assert.NoError(err)
+	assert.Empty(vals)
+
+	empty, err := EncodeValues(nil)
+	require.NoError(err)
+	_, err = DecodeValues(empty, []Type{String})
+	assert.Error(err)
+}
+
+func TestDecodeValuesWithLimit(t *testing.T) {
+	t.Run("rejects an oversized length prefix", func(t *testing.T) {
+		assert := assert.New(t)
+
+		// An array of one byte string claiming to be 4GiB long.
+		data := []byte{0x81, 0x5a, 0xff, 0xff, 0xff, 0xff, 'x'}
+		_, err := DecodeValuesWithLimit(data, []Type{Bytes}, 1024)
+		assert.EqualError(err, "declared length 4294967295 exceeds maximum of 1024 bytes")
+
+		_, err = DecodeValues(data, []Type{Bytes})
+		assert.EqualError(err, "declared length 4294967295 exceeds maximum of 16777216 bytes")
+	})
+
+	t.Run("enforces the limit on actual values", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data, err := EncodeValues([]*Value{BytesValue(make([]byte, 100))})
+		require.NoError(err)
+
+		vals, err := DecodeValuesWithLimit(data, []Type{Bytes}, 100)
+		require.NoError(err)
+		assert.Len(vals[0].Val, 100)
+
+		_, err = DecodeValuesWithLimit(data, []Type{Bytes}, 99)
+		assert.EqualError(err, "declared length 100 exceeds maximum of 99 bytes")
+	})
+}
+
+func TestCheckedEncoding(t *testing.T) {
+	t.Run("round trips", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		vals := []*Value{StringValue("foo"), SectorIDValue(42)}
+		data, err := EncodeValuesChecked(vals)
+		require.NoError(err)
+
+		unchecked, err := EncodeValues(vals)
+		require.NoError(err)
+		assert.Equal(unchecked, data[:len(unchecked)])
+		assert.Len(data, len(unchecked)+4)
+
+		decoded, err := DecodeValuesChecked(data, []Type{String, SectorID})
+		require.NoError(err)
+		assert.Equal(vals, decoded)
+
+		data, err = EncodeValuesChecked(nil)
+		require.NoError(err)
+		decoded, err = DecodeValuesChecked(data, nil)
+		require.NoError(err)
+		assert.Empty(decoded)
+	})
+
+	t.Run("detects corruption", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data, err := EncodeValuesChecked([]*Value{StringValue("foo")})
+		require.NoError(err)
+
+		for i := range data {
+			corrupted := append([]byte{}, data...)
+			corrupted[i] ^= 0x01
+			_, err := DecodeValuesChecked(corrupted, []Type{String})
+			assert.Equal(ErrChecksumMismatch, err)
+		}
+
+		_, err = DecodeValuesChecked(data[:len(data)-1], []Type{String})
+		assert.Equal(ErrChecksumMismatch, err)
+		_, err = DecodeValuesChecked(nil, nil)
+		assert.Equal(ErrChecksumMismatch, err)
+	})
+}
+
+func TestDecodeValuesWithCost(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var arr []uint64
+	for i := uint64(1); i <= 20; i++ {
+		arr = append(arr, i)
+	}
+	nested, err := EncodeValues([]*Value{UintArrayValue(arr)})
+	require.NoError(err)
+	flat, err := EncodeValues([]*Value{BytesValue(make([]byte, 21))})
+	require.NoError(err)
+	require.Equal(len(flat), len(nested))
+
+	vals, nestedCost, err := DecodeValuesWithCost(nested, []Type{UintArray})
+	require.NoError(err)
+	assert.Equal(arr, vals[0].Val)
+
+	_, flatCost, err := DecodeValuesWithCost(flat, []Type{Bytes})
+	require.NoError(err)
+
+	// The outer array and a byte string, plus the uint array and its items.
+	assert.Equal(uint64(2), flatCost)
+	assert.Equal(uint64(23), nestedCost)
+
+	_, cost, err := DecodeValuesWithCost(nil, nil)
+	require.NoError(err)
+	assert.Equal(uint64(0), cost)
+
+	// Log entries are CBOR too: the outer array and a byte string, plus the
+	// entry's map, its key and its payload.
+	entry, err := EncodeValues([]*Value{LogEntryValue(&types.LogEntry{Payload: []byte("payload")})})
+	require.NoError(err)
+	_, cost, err = DecodeValuesWithCost(entry, []Type{LogEntry})
+	require.NoError(err)
+	assert.Equal(uint64(5), cost)
+
+	// The work done before decoding fails is still returned.
+	_, cost, err = DecodeValuesWithCost(nested, []Type{UintArray, Bytes})
+	assert.Error(err)
+	assert.Equal(uint64(2), cost)
+
+	bad, err := EncodeValues([]*Value{UintArrayValue(arr), StringValue("not an address")})
+	require.NoError(err)
+	_, cost, err = DecodeValuesWithCost(bad, []Type{UintArray, Address})
+	assert.Error(err)
+	assert.Equal(uint64(24), cost)
+}
+
+func TestFramedEncoding(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	addrGetter := address.NewForTestGetter()
+
+	first, err := ToValues([]interface{}{big.NewInt(17), "beep"})
+	require.NoError(err)
+	second, err := ToValues([]interface{}{addrGetter(), []byte("boop"), uint64(3)})
+	require.NoError(err)
+
+	var buf bytes.Buffer
+	require.NoError(EncodeValuesFramed(&buf, first))
+	require.NoError(EncodeValuesFramed(&buf, nil))
+	require.NoError(EncodeValuesFramed(&buf, second))
+
+	vals, err := DecodeValuesFramedNext(&buf, []Type{Integer, String})
+	require.NoError(err)
+	assert.Equal(first, vals)
+
+	vals, err = DecodeValuesFramedNext(&buf, nil)
+	require.NoError(err)
+	assert.Nil(vals)
+
+	vals, err = DecodeValuesFramedNext(&buf, []Type{Address, Bytes, SectorID})
+	require.NoError(err)
+	assert.Equal(second, vals)
+
+	_, err = DecodeValuesFramedNext(&buf, nil)
+	assert.Equal(io.EOF, err)
+
+	t.Run("truncated frame", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(EncodeValuesFramed(&buf, first))
+		truncated := bytes.NewReader(buf.Bytes()[:buf.Len()-1])
+
+		_, err := DecodeValuesFramedNext(truncated, []Type{Integer, String})
+		assert.EqualError(err, "unable to read frame: unexpected EOF")
+	})
+}
+
 type fooTestStruct struct {
 	Bar string
 	Baz uint64
@@ -86,3 +954,228 @@ func TestToValuesFailures(t *testing.T) {
 		})
 	}
 }
+
+func TestCidEncoding(t *testing.T) {
+	t.Run("round trips through ToValues and FromValues", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		c := types.SomeCid()
+		data, err := ToEncodedValues(c)
+		require.NoError(err)
+
+		decoded, err := DecodeValues(data, []Type{Cid})
+		require.NoError(err)
+		require.Len(decoded, 1)
+		assert.True(decoded[0].Equals(CidValue(c)))
+		assert.Equal([]interface{}{c}, FromValues(decoded))
+	})
+
+	t.Run("rejects invalid cids", func(t *testing.T) {
+		assert := assert.New(t)
+
+		c := types.SomeCid()
+		for _, data := range [][]byte{nil, {0x01, 0x71}, c.Bytes()[:len(c.Bytes())-1], append(c.Bytes(), 0x00)} {
+			_, err := Deserialize(data, Cid)
+			assert.Error(err, "%x", data)
+		}
+
+		_, err := CidValue(cid.Undef).Serialize()
+		assert.Error(err)
+	})
+}
+
+func TestFixed128Encoding(t *testing.T) {
+	one := new(big.Int).Lsh(big.NewInt(1), 128)
+	oneAndAHalf := new(big.Int).Lsh(big.NewInt(3), 127)
+	minusAQuarter := new(big.Int).Neg(new(big.Int).Lsh(big.NewInt(1), 126))
+
+	t.Run("round trips", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		vals := []*Value{
+			Fixed128Value(big.NewInt(0)),
+			Fixed128Value(one),
+			Fixed128Value(oneAndAHalf),
+			Fixed128Value(minusAQuarter),
+			Fixed128Value(new(big.Int).Neg(new(big.Int).Lsh(one, 64))),
+		}
+		data, err := EncodeValues(vals)
+		require.NoError(err)
+
+		decoded, err := DecodeValues(data, []Type{Fixed128, Fixed128, Fixed128, Fixed128, Fixed128})
+		require.NoError(err)
+		assert.True(Values(vals).Equals(decoded))
+	})
+
+	t.Run("encodes stably", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data, err := Fixed128Value(oneAndAHalf).Serialize()
+		require.NoError(err)
+		assert.Equal(append([]byte{0x00, 0x01, 0x80}, make([]byte, 15)...), data)
+
+		data, err = Fixed128Value(minusAQuarter).Serialize()
+		require.NoError(err)
+		assert.Equal(append([]byte{0x01, 0x40}, make([]byte, 15)...), data)
+
+		data, err = Fixed128Value(big.NewInt(0)).Serialize()
+		require.NoError(err)
+		assert.Equal([]byte{0x00}, data)
+	})
+
+	t.Run("rejects non-canonical encodings", func(t *testing.T) {
+		assert := assert.New(t)
+
+		for _, data := range [][]byte{nil, {0x02}, {0x01}, {0x00, 0x00, 0x01}} {
+			_, err := Deserialize(data, Fixed128)
+			assert.Error(err, "%x", data)
+		}
+	})
+
+	t.Run("renders approximate decimals", func(t *testing.T) {
+		assert := assert.New(t)
+
+		assert.Equal("1.5", Fixed128Value(oneAndAHalf).String())
+		assert.Equal("-0.25", Fixed128Value(minusAQuarter).String())
+		assert.Equal("0", Fixed128Value(big.NewInt(0)).String())
+		assert.Equal("0.33333333333333333333", Fixed128Value(new(big.Int).Div(one, big.NewInt(3))).String())
+	})
+}
+
+func TestFormatValues(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	addr := address.NewForTestGetter()()
+	vals, err := ToValues([]interface{}{big.NewInt(-1234567890123), addr, []byte{0xde, 0xad, 0xbe, 0xef}, "say \"hi\"", true})
+	require.NoError(err)
+
+	assert.Equal(`-1234567890123, `+addr.String()+`, deadbeef, "say \"hi\"", true`, FormatValues(vals))
+	assert.Equal(`""`, StringValue("").String())
+	assert.Equal("", FormatValues(nil))
+}
+
+func TestIntegerEncoding(t *testing.T) {
+	large, ok := new(big.Int).SetString("-123456789012345678901234567890123456789", 10)
+	require.True(t, ok)
+
+	t.Run("round trips negative integers", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		ints := []*big.Int{big.NewInt(-1), large, big.NewInt(-256), big.NewInt(-2), big.NewInt(0), big.NewInt(1), big.NewInt(255)}
+		var vals []*Value
+		var ts []Type
+		for _, i := range ints {
+			vals = append(vals, BigIntValue(i))
+			ts = append(ts, Integer)
+		}
+
+		data, err := EncodeValues(vals)
+		require.NoError(err)
+		decoded, err := DecodeValues(data, ts)
+		require.NoError(err)
+		for i, val := range decoded {
+			assert.Equal(0, ints[i].Cmp(val.Val.(*big.Int)), "expected %s, got %s", ints[i], val.Val)
+		}
+	})
+
+	t.Run("encodes around zero", func(t *testing.T) {
+		assert := assert.New(t)
+
+		for n, expected := range map[int64][]byte{
+			-256: {0x00, 0x01, 0x00},
+			-1:   {0x00, 0x01},
+			0:    {},
+			1:    {0x01},
+			579:  {0x02, 0x43},
+		} {
+			data, err := BigIntValue(big.NewInt(n)).Serialize()
+			assert.NoError(err)
+			assert.Equal(expected, data, "%d", n)
+		}
+	})
+
+	t.Run("rejects malformed negative integers", func(t *testing.T) {
+		assert := assert.New(t)
+
+		for _, data := range [][]byte{{0x00}, {0x00, 0x00, 0x01}} {
+			_, err := Deserialize(data, Integer)
+			assert.Error(err, "%x", data)
+		}
+	})
+}
+
+func TestValueCopy(t *testing.T) {
+	t.Run("copies equal every value", func(t *testing.T) {
+		assert := assert.New(t)
+
+		c := types.SomeCid()
+		vals := []*Value{
+			AddressValue(address.NewForTestGetter()()),
+			AttoFILValue(types.NewAttoFILFromFIL(3)),
+			BytesAmountValue(types.NewBytesAmount(4)),
+			ChannelIDValue(types.NewChannelID(5)),
+			BlockHeightValue(types.NewBlockHeight(6)),
+			BigIntValue(big.NewInt(-7)),
+			BytesValue([]byte("eight")),
+			StringValue("nine"),
+			UintArrayValue([]uint64{10}),
+			SectorIDValue(11),
+			CommitmentsMapValue(map[string]types.Commitments{"12": {}}),
+			DurationValue(13 * time.Second),
+			BitFieldValue(types.NewBitField(14)),
+			ProofPathValue(&types.ProofPath{Cids: []cid.Cid{c}, Leaf: []byte("15")}),
+			RationalValue(big.NewRat(16, 17)),
+			RunLengthIntsValue([]uint64{18, 19}),
+			LogEntryValue(&types.LogEntry{Prev: c, Payload: []byte("20")}),
+			BooleanValue(true),
+			Uint64Value(21),
+			CidValue(c),
+			Fixed128Value(big.NewInt(22)),
+			BytesValue(nil),
+		}
+		for _, val := range vals {
+			assert.True(val.Copy().Equals(val), "%s", val.Type)
+		}
+		assert.Nil((*Value)(nil).Copy())
+	})
+
+	t.Run("mutating a copy leaves the original unchanged", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b := BytesValue([]byte("foo"))
+		b.Copy().Val.([]byte)[0] = 'g'
+		assert.Equal([]byte("foo"), b.Val)
+
+		i := BigIntValue(big.NewInt(5))
+		i.Copy().Val.(*big.Int).SetInt64(6)
+		assert.Equal(int64(5), i.Val.(*big.Int).Int64())
+
+		arr := UintArrayValue([]uint64{1, 2})
+		arr.Copy().Val.([]uint64)[0] = 3
+		assert.Equal([]uint64{1, 2}, arr.Val)
+
+		m := CommitmentsMapValue(map[string]types.Commitments{"1": {}})
+		delete(m.Copy().Val.(map[string]types.Commitments), "1")
+		assert.Len(m.Val, 1)
+
+		pp := ProofPathValue(&types.ProofPath{Cids: []cid.Cid{types.SomeCid()}, Leaf: []byte("leaf")})
+		ppCopy := pp.Copy().Val.(*types.ProofPath)
+		ppCopy.Leaf[0] = 'b'
+		ppCopy.Cids[0] = cid.Undef
+		assert.Equal([]byte("leaf"), pp.Val.(*types.ProofPath).Leaf)
+		assert.True(pp.Val.(*types.ProofPath).Cids[0].Defined())
+
+		le := LogEntryValue(&types.LogEntry{Payload: []byte("payload")})
+		le.Copy().Val.(*types.LogEntry).Payload[0] = 'q'
+		assert.Equal([]byte("payload"), le.Val.(*types.LogEntry).Payload)
+
+		r := RationalValue(big.NewRat(1, 2))
+		r.Copy().Val.(*big.Rat).SetInt64(3)
+		assert.Equal(0, r.Val.(*big.Rat).Cmp(big.NewRat(1, 2)))
+	})
+}
@@ -0,0 +1,49 @@
+package abi
+
+import (
+	"fmt"
+	"sync"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+)
+
+// ParamsRegistry maps actor methods, identified by the actor's code cid and
+// the method name, to the types of their parameters, so parameters can be
+// decoded without access to the actor.
+type ParamsRegistry struct {
+	lk      sync.RWMutex
+	schemas map[methodKey][]Type
+}
+
+type methodKey struct {
+	code   cid.Cid
+	method string
+}
+
+// NewParamsRegistry returns an empty ParamsRegistry.
+func NewParamsRegistry() *ParamsRegistry {
+	return &ParamsRegistry{
+		schemas: make(map[methodKey][]Type),
+	}
+}
+
+// Register records the parameter types of the given method of actors with
+// the given code, replacing any previously registered.
+func (r *ParamsRegistry) Register(code cid.Cid, method string, params []Type) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.schemas[methodKey{code: code, method: method}] = params
+}
+
+// DecodeParams decodes data as the parameters of the given method of actors
+// with the given code. It returns an error if the method isn't registered.
+func (r *ParamsRegistry) DecodeParams(code cid.Cid, method string, data []byte) ([]*Value, error) {
+	r.lk.RLock()
+	params, ok := r.schemas[methodKey{code: code, method: method}]
+	r.lk.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no parameters registered for method %q of actor code %s", method, code)
+	}
+
+	return DecodeValues(data, params)
+}
@@ -0,0 +1,55 @@
+package abi
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParamsRegistry(t *testing.T) {
+	registry := NewParamsRegistry()
+	registry.Register(types.PaymentBrokerActorCodeCid, "createChannel", []Type{Address, BlockHeight})
+	registry.Register(types.StorageMarketActorCodeCid, "createMiner", []Type{BytesAmount, Bytes, PeerID})
+	registry.Register(types.StorageMarketActorCodeCid, "getProofsMode", nil)
+
+	t.Run("decodes registered methods", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		addr := address.NewForTestGetter()()
+		data, err := ToEncodedValues(addr, types.NewBlockHeight(10))
+		require.NoError(err)
+
+		vals, err := registry.DecodeParams(types.PaymentBrokerActorCodeCid, "createChannel", data)
+		require.NoError(err)
+		require.Len(vals, 2)
+		assert.Equal(addr, vals[0].Val)
+		assert.True(BlockHeightValue(types.NewBlockHeight(10)).Equals(vals[1]))
+
+		vals, err = registry.DecodeParams(types.StorageMarketActorCodeCid, "getProofsMode", nil)
+		require.NoError(err)
+		assert.Empty(vals)
+	})
+
+	t.Run("rejects parameters not matching the schema", func(t *testing.T) {
+		data, err := ToEncodedValues(types.NewBlockHeight(10))
+		require.NoError(t, err)
+
+		_, err = registry.DecodeParams(types.PaymentBrokerActorCodeCid, "createChannel", data)
+		assert.Error(t, err)
+	})
+
+	t.Run("rejects unknown methods", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, err := registry.DecodeParams(types.PaymentBrokerActorCodeCid, "createMiner", nil)
+		assert.Error(err)
+		assert.Contains(err.Error(), `no parameters registered for method "createMiner"`)
+
+		_, err = registry.DecodeParams(types.AccountActorCodeCid, "createChannel", nil)
+		assert.Error(err)
+	})
+}
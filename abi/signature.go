@@ -0,0 +1,65 @@
+package abi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// typesByName maps the names used in signatures to the Types they denote.
+var typesByName = map[string]Type{
+	"Address":        Address,
+	"AttoFIL":        AttoFIL,
+	"BytesAmount":    BytesAmount,
+	"ChannelID":      ChannelID,
+	"BlockHeight":    BlockHeight,
+	"Integer":        Integer,
+	"BigInt":         Integer,
+	"Bytes":          Bytes,
+	"String":         String,
+	"UintArray":      UintArray,
+	"PeerID":         PeerID,
+	"SectorID":       SectorID,
+	"CommitmentsMap": CommitmentsMap,
+	"Duration":       Duration,
+	"BitField":       BitField,
+	"ProofPath":      ProofPath,
+	"Rational":       Rational,
+	"RunLengthInts":  RunLengthInts,
+	"LogEntry":       LogEntry,
+	"Boolean":        Boolean,
+	"Uint64":         Uint64,
+	"Cid":            Cid,
+	"Fixed128":       Fixed128,
+}
+
+// ParseSignature parses a method signature such as
+// "transfer(Address,BigInt)" into the method's name and the Types of its
+// parameters, as passed to DecodeValues. Types are named as the Type
+// constants are, with BigInt accepted as another name for Integer.
+func ParseSignature(sig string) (string, []Type, error) {
+	open := strings.IndexByte(sig, '(')
+	if open < 0 || !strings.HasSuffix(sig, ")") {
+		return "", nil, fmt.Errorf("malformed signature %q: expected method(types)", sig)
+	}
+
+	method := strings.TrimSpace(sig[:open])
+	if method == "" {
+		return "", nil, fmt.Errorf("malformed signature %q: missing method name", sig)
+	}
+
+	list := strings.TrimSpace(sig[open+1 : len(sig)-1])
+	if list == "" {
+		return method, nil, nil
+	}
+
+	var params []Type
+	for i, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		t, ok := typesByName[name]
+		if !ok {
+			return "", nil, fmt.Errorf("malformed signature %q: unknown type %q for parameter %d", sig, name, i)
+		}
+		params = append(params, t)
+	}
+	return method, params, nil
+}
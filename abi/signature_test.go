@@ -0,0 +1,54 @@
+package abi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSignature(t *testing.T) {
+	t.Run("parses parameter types", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		method, params, err := ParseSignature("transfer(Address,BigInt)")
+		require.NoError(err)
+		assert.Equal("transfer", method)
+		assert.Equal([]Type{Address, Integer}, params)
+
+		method, params, err = ParseSignature("getOwner( SectorID )")
+		require.NoError(err)
+		assert.Equal("getOwner", method)
+		assert.Equal([]Type{SectorID}, params)
+
+		method, params, err = ParseSignature("ping()")
+		require.NoError(err)
+		assert.Equal("ping", method)
+		assert.Empty(params)
+	})
+
+	t.Run("names every type", func(t *testing.T) {
+		assert := assert.New(t)
+
+		named := map[Type]bool{}
+		for _, t := range typesByName {
+			named[t] = true
+		}
+		for t := range typeTable {
+			assert.True(named[t], "%s has no name", t)
+		}
+	})
+
+	t.Run("rejects malformed signatures", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, _, err := ParseSignature("transfer(Address,Money)")
+		assert.EqualError(err, `malformed signature "transfer(Address,Money)": unknown type "Money" for parameter 1`)
+
+		for _, sig := range []string{"", "transfer", "transfer(Address", "(Address)", "transfer(Address,)"} {
+			_, _, err := ParseSignature(sig)
+			assert.Error(err, sig)
+		}
+	})
+}
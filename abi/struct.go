@@ -0,0 +1,74 @@
+package abi
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ToValuesFromStruct converts the exported fields of the struct v, or of the
+// struct v points to, to abi values in the order they are declared, as
+// ToValues would convert them. Unexported fields are skipped. It lets a
+// method's parameters be defined once as a struct.
+func ToValuesFromStruct(v interface{}) ([]*Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expected a struct or pointer to a struct, got %T", v)
+	}
+
+	var out []*Value
+	for _, i := range exportedFields(rv.Type()) {
+		vals, err := ToValues([]interface{}{rv.Field(i).Interface()})
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", rv.Type().Field(i).Name, err)
+		}
+		out = append(out, vals...)
+	}
+	return out, nil
+}
+
+// DecodeValuesToStruct decodes values encoded from a struct's fields, e.g. by
+// ToValuesFromStruct and EncodeValues, into the exported fields of the
+// struct target points to. Each field is decoded as the Type ToValues would
+// convert it to.
+func DecodeValuesToStruct(data []byte, target interface{}) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("expected a non-nil pointer to a struct, got %T", target)
+	}
+	rv = rv.Elem()
+
+	fields := exportedFields(rv.Type())
+	types := make([]Type, 0, len(fields))
+	for _, i := range fields {
+		field := rv.Type().Field(i)
+		vals, err := ToValues([]interface{}{reflect.Zero(field.Type).Interface()})
+		if err != nil {
+			return fmt.Errorf("field %s: %s", field.Name, err)
+		}
+		types = append(types, vals[0].Type)
+	}
+
+	vals, err := DecodeValues(data, types)
+	if err != nil {
+		return err
+	}
+	for j, i := range fields {
+		rv.Field(i).Set(reflect.ValueOf(vals[j].Val))
+	}
+	return nil
+}
+
+// exportedFields returns the indices of the exported fields of the struct
+// type t, in declaration order.
+func exportedFields(t reflect.Type) []int {
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			fields = append(fields, i)
+		}
+	}
+	return fields
+}
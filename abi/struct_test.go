@@ -0,0 +1,86 @@
+package abi
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type paramsTestStruct struct {
+	To      address.Address
+	Value   *types.AttoFIL
+	Sectors []uint64
+	hidden  string
+	Label   string
+	Ready   bool
+}
+
+func TestStructEncoding(t *testing.T) {
+	t.Run("round trips", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		params := &paramsTestStruct{
+			To:      address.NewForTestGetter()(),
+			Value:   types.NewAttoFILFromFIL(3),
+			Sectors: []uint64{1, 2},
+			hidden:  "not encoded",
+			Label:   "beep",
+			Ready:   true,
+		}
+		vals, err := ToValuesFromStruct(params)
+		require.NoError(err)
+
+		// Fields in declaration order, skipping the unexported one.
+		expected, err := ToValues([]interface{}{params.To, params.Value, params.Sectors, params.Label, params.Ready})
+		require.NoError(err)
+		assert.Equal(expected, vals)
+
+		data, err := EncodeValues(vals)
+		require.NoError(err)
+
+		var decoded paramsTestStruct
+		require.NoError(DecodeValuesToStruct(data, &decoded))
+		params.hidden = ""
+		assert.Equal(params, &decoded)
+
+		// A struct value works as well as a pointer.
+		byValue, err := ToValuesFromStruct(*params)
+		require.NoError(err)
+		assert.Equal(vals, byValue)
+	})
+
+	t.Run("names unsupported fields", func(t *testing.T) {
+		assert := assert.New(t)
+
+		type badParams struct {
+			Amount *big.Int
+			Count  int
+		}
+		_, err := ToValuesFromStruct(badParams{Amount: big.NewInt(1), Count: 3})
+		assert.EqualError(err, "field Count: unsupported type: int")
+
+		data, err := ToEncodedValues(big.NewInt(1), "x")
+		require.NoError(t, err)
+		assert.EqualError(DecodeValuesToStruct(data, &badParams{}), "field Count: unsupported type: int")
+	})
+
+	t.Run("rejects non-structs", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, err := ToValuesFromStruct("beep")
+		assert.Error(err)
+		assert.Error(DecodeValuesToStruct(nil, paramsTestStruct{}))
+		assert.Error(DecodeValuesToStruct(nil, (*paramsTestStruct)(nil)))
+	})
+
+	t.Run("rejects mismatched data", func(t *testing.T) {
+		data, err := ToEncodedValues("just one")
+		require.NoError(t, err)
+		assert.Error(t, DecodeValuesToStruct(data, &paramsTestStruct{}))
+	})
+}
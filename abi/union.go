@@ -0,0 +1,65 @@
+package abi
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// UnionVariant is one of the variants of a UnionType.
+type UnionVariant struct {
+	Name string
+	Type Type
+}
+
+// UnionType describes a tagged union: a value that is one of several named
+// variants, each with its own Type. A union is encoded as the index of its
+// variant, as an unsigned varint, followed by the variant's value; pass the
+// encoding as a Bytes value to use a union as a parameter.
+type UnionType struct {
+	Variants []UnionVariant
+}
+
+// Encode encodes val as the named variant. val must have the variant's type.
+func (ut UnionType) Encode(variant string, val *Value) ([]byte, error) {
+	tag := -1
+	for i, v := range ut.Variants {
+		if v.Name == variant {
+			tag = i
+			break
+		}
+	}
+	if tag < 0 {
+		return nil, fmt.Errorf("unknown union variant %q", variant)
+	}
+	if val == nil || val.Type != ut.Variants[tag].Type {
+		return nil, fmt.Errorf("union variant %q must hold a %s", variant, ut.Variants[tag].Type)
+	}
+
+	data, err := val.Serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(data))
+	buf = buf[:binary.PutUvarint(buf, uint64(tag))]
+	return append(buf, data...), nil
+}
+
+// Decode decodes a union encoded by Encode, returning the name of its variant
+// and its value.
+func (ut UnionType) Decode(data []byte) (string, *Value, error) {
+	tag, n := binary.Uvarint(data)
+	if n <= 0 {
+		return "", nil, fmt.Errorf("malformed union tag")
+	}
+	if tag >= uint64(len(ut.Variants)) {
+		return "", nil, fmt.Errorf("unknown union tag %d", tag)
+	}
+
+	variant := ut.Variants[tag]
+	val, err := Deserialize(data[n:], variant.Type)
+	if err != nil {
+		return "", nil, err
+	}
+	return variant.Name, val, nil
+}
@@ -0,0 +1,68 @@
+package abi
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnionEncoding(t *testing.T) {
+	signature := UnionType{Variants: []UnionVariant{
+		{Name: "onchain", Type: Address},
+		{Name: "offchain", Type: Bytes},
+		{Name: "none", Type: SectorID},
+	}}
+
+	t.Run("round trips each variant", func(t *testing.T) {
+		cases := map[string]*Value{
+			"onchain":  AddressValue(address.NewForTestGetter()()),
+			"offchain": BytesValue([]byte("signature")),
+			"none":     SectorIDValue(0),
+		}
+
+		for variant, val := range cases {
+			t.Run(variant, func(t *testing.T) {
+				assert := assert.New(t)
+				require := require.New(t)
+
+				data, err := signature.Encode(variant, val)
+				require.NoError(err)
+
+				decodedVariant, decoded, err := signature.Decode(data)
+				require.NoError(err)
+				assert.Equal(variant, decodedVariant)
+				assert.True(val.Equals(decoded))
+
+				// Unions are passed as bytes.
+				params, err := EncodeValues([]*Value{BytesValue(data)})
+				require.NoError(err)
+				vals, err := DecodeValues(params, []Type{Bytes})
+				require.NoError(err)
+				_, decoded, err = signature.Decode(vals[0].Val.([]byte))
+				require.NoError(err)
+				assert.True(val.Equals(decoded))
+			})
+		}
+	})
+
+	t.Run("rejects unknown tags", func(t *testing.T) {
+		_, _, err := signature.Decode([]byte{3, 1})
+		assert.EqualError(t, err, "unknown union tag 3")
+
+		_, _, err = signature.Decode([]byte{})
+		assert.Error(t, err)
+	})
+
+	t.Run("rejects unknown variants and mistyped values", func(t *testing.T) {
+		_, err := signature.Encode("multisig", BytesValue(nil))
+		assert.Error(t, err)
+
+		_, err = signature.Encode("onchain", BytesValue([]byte("signature")))
+		assert.Error(t, err)
+
+		_, err = signature.Encode("onchain", nil)
+		assert.Error(t, err)
+	})
+}
@@ -3,10 +3,13 @@ package actor
 
 import (
 	"fmt"
+	"math/big"
+
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	cbor "gx/ipfs/QmRoARq3nkUb13HSKZGepCZSWe5GrVPwx7xURJGZ7KWv9V/go-ipld-cbor"
 	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
 
+	"github.com/filecoin-project/go-filecoin/abi"
 	"github.com/filecoin-project/go-filecoin/types"
 )
 
@@ -82,3 +85,56 @@ func (a *Actor) Marshal() ([]byte, error) {
 func (a *Actor) Format(f fmt.State, c rune) {
 	f.Write([]byte(fmt.Sprintf("<%s (%p); balance: %v; nonce: %d>", types.ActorCodeTypeName(a.Code), a, a.Balance, a.Nonce))) // nolint: errcheck
 }
+
+// actorMetadataTypes are the abi types of an actor's encoded metadata: its
+// code cid, nonce and balance.
+var actorMetadataTypes = []abi.Type{abi.Bytes, abi.Integer, abi.AttoFIL}
+
+// EncodeActor encodes the actor's metadata (code, nonce and balance) as an
+// abi tuple. The head, and so the actor's storage, is not included; it is
+// exported separately. A nil balance is encoded as zero.
+func EncodeActor(a *Actor) ([]byte, error) {
+	var code []byte
+	if a.Code.Defined() {
+		code = a.Code.Bytes()
+	}
+	balance := a.Balance
+	if balance == nil {
+		balance = types.ZeroAttoFIL
+	}
+
+	return abi.EncodeValues([]*abi.Value{
+		abi.BytesValue(code),
+		abi.BigIntValue(new(big.Int).SetUint64(uint64(a.Nonce))),
+		abi.AttoFILValue(balance),
+	})
+}
+
+// DecodeActor decodes an actor's metadata as encoded by EncodeActor. The
+// returned actor has an undefined head.
+func DecodeActor(data []byte) (*Actor, error) {
+	vals, err := abi.DecodeValues(data, actorMetadataTypes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode actor metadata")
+	}
+
+	code := cid.Undef
+	if codeBytes := vals[0].Val.([]byte); len(codeBytes) > 0 {
+		code, err = cid.Cast(codeBytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid actor code cid")
+		}
+	}
+
+	nonce := vals[1].Val.(*big.Int)
+	if !nonce.IsUint64() {
+		return nil, errors.New("actor nonce out of range")
+	}
+
+	return &Actor{
+		Code:    code,
+		Head:    cid.Undef,
+		Nonce:   types.Uint64(nonce.Uint64()),
+		Balance: vals[2].Val.(*types.AttoFIL),
+	}, nil
+}
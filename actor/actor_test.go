@@ -273,3 +273,48 @@ func TestMakeTypedExportFail(t *testing.T) {
 		})
 	}
 }
+
+func TestEncodeDecodeActor(t *testing.T) {
+	t.Run("round trips metadata", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		a := NewActor(types.AccountActorCodeCid, types.NewAttoFILFromFIL(42))
+		a.Head = requireCid(t, "head")
+		a.Nonce = 7
+
+		data, err := EncodeActor(a)
+		require.NoError(err)
+		decoded, err := DecodeActor(data)
+		require.NoError(err)
+
+		assert.True(a.Code.Equals(decoded.Code))
+		assert.Equal(a.Nonce, decoded.Nonce)
+		assert.True(a.Balance.Equal(decoded.Balance))
+		assert.False(decoded.Head.Defined())
+
+		// Encoding is deterministic.
+		again, err := EncodeActor(decoded)
+		require.NoError(err)
+		assert.Equal(data, again)
+	})
+
+	t.Run("empty actor", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		data, err := EncodeActor(&Actor{})
+		require.NoError(err)
+		decoded, err := DecodeActor(data)
+		require.NoError(err)
+
+		assert.False(decoded.Code.Defined())
+		assert.Equal(types.Uint64(0), decoded.Nonce)
+		assert.True(types.ZeroAttoFIL.Equal(decoded.Balance))
+	})
+
+	t.Run("rejects malformed data", func(t *testing.T) {
+		_, err := DecodeActor([]byte{1, 2, 3})
+		assert.Error(t, err)
+	})
+}
@@ -556,7 +556,7 @@ func requireGenesis(ctx context.Context, t *testing.T, targetAddresses ...addres
 	require := require.New(t)
 
 	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
-	vms := vm.NewStorageMap(bs)
+	vms := vm.NewStorageMap(bs, vm.StorageMapOptions{})
 
 	cst := hamt.NewCborStore()
 	blk, err := consensus.InitGenesis(cst, bs)
@@ -78,7 +78,7 @@ func TestLoadLookup(t *testing.T) {
 
 	ds := datastore.NewMapDatastore()
 	bs := blockstore.NewBlockstore(ds)
-	vms := vm.NewStorageMap(bs)
+	vms := vm.NewStorageMap(bs, vm.StorageMapOptions{})
 	storage := vms.NewStorage(address.TestAddress, &Actor{})
 	ctx := context.TODO()
 
@@ -101,7 +101,7 @@ func TestLoadLookup(t *testing.T) {
 
 	t.Run("Fetch chunk by cid", func(t *testing.T) {
 		bs = blockstore.NewBlockstore(ds)
-		vms = vm.NewStorageMap(bs)
+		vms = vm.NewStorageMap(bs, vm.StorageMapOptions{})
 		storage = vms.NewStorage(address.TestAddress, &Actor{})
 
 		lookup, err = LoadLookup(ctx, storage, c)
@@ -115,7 +115,7 @@ func TestLoadLookup(t *testing.T) {
 
 	t.Run("Get errs for missing key", func(t *testing.T) {
 		bs = blockstore.NewBlockstore(ds)
-		vms = vm.NewStorageMap(bs)
+		vms = vm.NewStorageMap(bs, vm.StorageMapOptions{})
 		storage = vms.NewStorage(address.TestAddress, &Actor{})
 
 		lookup, err = LoadLookup(ctx, storage, c)
@@ -133,7 +133,7 @@ func TestLoadLookupWithInvalidCid(t *testing.T) {
 
 	ds := datastore.NewMapDatastore()
 	bs := blockstore.NewBlockstore(ds)
-	vms := vm.NewStorageMap(bs)
+	vms := vm.NewStorageMap(bs, vm.StorageMapOptions{})
 	storage := vms.NewStorage(address.TestAddress, &Actor{})
 	ctx := context.TODO()
 
@@ -150,7 +150,7 @@ func TestSetKeyValue(t *testing.T) {
 
 	ds := datastore.NewMapDatastore()
 	bs := blockstore.NewBlockstore(ds)
-	vms := vm.NewStorageMap(bs)
+	vms := vm.NewStorageMap(bs, vm.StorageMapOptions{})
 	storage := vms.NewStorage(address.TestAddress, &Actor{})
 	ctx := context.TODO()
 
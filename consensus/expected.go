@@ -250,7 +250,7 @@ func (c *Expected) RunStateTransition(ctx context.Context, ts types.TipSet, ance
 		}
 	}
 
-	vms := vm.NewStorageMap(c.bstore)
+	vms := vm.NewStorageMap(c.bstore, vm.StorageMapOptions{})
 	st, err := c.runMessages(ctx, pSt, vms, ts, ancestors)
 	if err != nil {
 		return nil, err
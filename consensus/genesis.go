@@ -82,7 +82,7 @@ func MakeGenesisFunc(opts ...GenOption) func(cst *hamt.CborIpldStore, bs blockst
 	return func(cst *hamt.CborIpldStore, bs blockstore.Blockstore) (*types.Block, error) {
 		ctx := context.Background()
 		st := state.NewEmptyStateTreeWithActors(cst, builtin.Actors)
-		storageMap := vm.NewStorageMap(bs)
+		storageMap := vm.NewStorageMap(bs, vm.StorageMapOptions{})
 
 		genCfg := NewEmptyConfig()
 		for _, opt := range opts {
@@ -40,7 +40,7 @@ var _ PowerTableView = &MarketView{}
 // TODO: uint64 has enough bits to express about 1 exabyte of total storage.
 // This should be increased for v1.
 func (v *MarketView) Total(ctx context.Context, st state.Tree, bstore blockstore.Blockstore) (uint64, error) {
-	vms := vm.NewStorageMap(bstore)
+	vms := vm.NewStorageMap(bstore, vm.StorageMapOptions{})
 	rets, ec, err := CallQueryMethod(ctx, st, vms, address.StorageMarketAddress, "getTotalStorage", []byte{}, address.Address{}, nil)
 	if err != nil {
 		return 0, err
@@ -62,7 +62,7 @@ func (v *MarketView) Total(ctx context.Context, st state.Tree, bstore blockstore
 // TODO: uint64 has enough bits to express about 1 exabyte.  This
 // should probably be increased for v1.
 func (v *MarketView) Miner(ctx context.Context, st state.Tree, bstore blockstore.Blockstore, mAddr address.Address) (uint64, error) {
-	vms := vm.NewStorageMap(bstore)
+	vms := vm.NewStorageMap(bstore, vm.StorageMapOptions{})
 	rets, ec, err := CallQueryMethod(ctx, st, vms, mAddr, "getPower", []byte{}, address.Address{}, nil)
 	if err != nil {
 		return 0, err
@@ -604,7 +604,7 @@ func TestNestedSendBalance(t *testing.T) {
 	ctx := context.Background()
 	cst := hamt.NewCborStore()
 	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
-	vms := vm.NewStorageMap(bs)
+	vms := vm.NewStorageMap(bs, vm.StorageMapOptions{})
 
 	// Install the fake actor so we can execute it.
 	fakeActorCodeCid := types.NewCidForTestGetter()()
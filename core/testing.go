@@ -131,7 +131,7 @@ func CreateStorages(ctx context.Context, t *testing.T) (state.Tree, vm.StorageMa
 	st, err := state.LoadStateTree(ctx, cst, blk.StateRoot, builtin.Actors)
 	require.NoError(t, err)
 
-	vms := vm.NewStorageMap(bs)
+	vms := vm.NewStorageMap(bs, vm.StorageMapOptions{})
 
 	return st, vms
 }
@@ -2,16 +2,20 @@ package filnet
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
+	ma "gx/ipfs/QmNTCey11oxhb1AxDnQBRHtdhap6Ctud872NjAYPYYXPuc/go-multiaddr"
 	inet "gx/ipfs/QmNgLg1NTw37iWbYPKcyK85YJ9Whs1MkPtJwhfqbNYAyKg/go-libp2p-net"
 	pstore "gx/ipfs/QmPiemjiKBC9VA7vZF82m4x1oygtg2c2YVqag8PX7dN1BD/go-libp2p-peerstore"
 	routing "gx/ipfs/QmTiRqrF5zkdZyrdsL5qndG1UbeWi8k8N2pYxCtXWrahR2/go-libp2p-routing"
 	peer "gx/ipfs/QmY5Grm8pJdiSSVsYxx4uNRgweY72EmYwuSDbRnbFok3iY/go-libp2p-peer"
 	host "gx/ipfs/QmaoXrM4Z41PD48JY36YqQGKQpLGjyLA2cKcLsES7YddAq/go-libp2p-host"
 	logging "gx/ipfs/QmcuXC5cxs79ro2cUuHs4HQ2bkDLJUYokwL8aivcX6HW3C/go-log"
+	"gx/ipfs/QmdbxjQWogRCHRaxhhGnYdT1oQJzL9GdqSKzCdqWr85AP2/pubsub"
 )
 
 var log = logging.Logger("bootstrap")
@@ -24,14 +28,114 @@ var log = logging.Logger("bootstrap")
 type Bootstrapper struct {
 	// Config
 	// MinPeerThreshold is the number of connections it attempts to maintain.
+	// Once the Bootstrapper is started, change it with SetMinPeerThreshold.
 	MinPeerThreshold int
+	// PeerClass, if set, assigns each peer a class, such as "validator".
+	PeerClass func(peer.ID) string
+	// ClassThresholds is the number of connections it attempts to maintain
+	// to peers of each class assigned by PeerClass, in addition to keeping
+	// MinPeerThreshold connections overall. Connections made to meet a
+	// class's threshold count toward MinPeerThreshold.
+	ClassThresholds map[string]int
+	// ChainHeadCheck, if set, reports whether a connected peer is on a chain
+	// compatible with this node's, e.g. as determined by the sync subsystem.
+	// Only peers for which it returns true count toward MinPeerThreshold, so
+	// a node connected only to peers on a fork keeps dialing. Peers it
+	// rejects are not disconnected.
+	ChainHeadCheck func(peer.ID) bool
+	// ObserverMode, if true, makes the Bootstrapper discover peers without
+	// holding connections to them, e.g. for a crawler or explorer node. Each
+	// peer it connects to, and whose Handshake succeeds, is recorded in
+	// ObservedPeers and then disconnected. No peer counts toward
+	// MinPeerThreshold, so every round dials.
+	ObserverMode bool
 	// Peers to connect to if we fall below the threshold.
 	bootstrapPeers []pstore.PeerInfo
+	// Groups of bootstrap peers, each of which it keeps at least one connection to.
+	peerGroups [][]pstore.PeerInfo
 	// Period is the interval at which it periodically checks to see
 	// if the threshold is maintained.
 	Period time.Duration
+	// PeriodJitter is the fraction of Period by which each interval between
+	// checks is randomly lengthened or shortened, e.g. 0.2 for intervals
+	// within 20% of Period, so that nodes started together don't dial the
+	// bootstrap peers in waves. Zero, the default, makes every interval
+	// exactly Period.
+	PeriodJitter float64
 	// ConnectionTimeout is how long to wait before timing out a connection attempt.
 	ConnectionTimeout time.Duration
+	// ConnectTimeout is how long to wait for the connection to a single
+	// peer, after which it is abandoned and its dial slot freed for another
+	// peer. Zero means a connection is only bounded by ConnectionTimeout.
+	ConnectTimeout time.Duration
+	// DialBackoff is how long after a failed dial a peer is skipped before
+	// it is dialed again. It doubles with each consecutive failed dial of
+	// the peer, up to MaxDialBackoff, and is reset by a successful one. It
+	// defaults to Period. Zero disables backoff, so failed peers are dialed
+	// again the next round.
+	DialBackoff time.Duration
+	// MaxDialBackoff caps DialBackoff.
+	MaxDialBackoff time.Duration
+	// MaxConcurrentDials is the most connection attempts a round makes at
+	// once. Zero means no limit.
+	MaxConcurrentDials int
+	// Handshake, if set, is called after connecting to a peer to validate it,
+	// e.g. by waiting for identify and checking the peer's version. A peer
+	// whose handshake fails or takes longer than HandshakeTimeout is
+	// disconnected. The handshake is not subject to ConnectionTimeout.
+	Handshake func(context.Context, peer.ID) error
+	// HandshakeTimeout is how long to wait for Handshake to complete.
+	HandshakeTimeout time.Duration
+	// RecentlyLostWindow is how long a bootstrap peer that disconnected is
+	// dialed ahead of the others. Zero disables this prioritization.
+	RecentlyLostWindow time.Duration
+	// LivenessCheck, if set, is called for every connected peer at the start
+	// of each round, e.g. to ping it. A peer whose check fails
+	// LivenessFailureThreshold rounds in a row is disconnected, and the round
+	// then tops up connections as if it had never been connected.
+	LivenessCheck func(context.Context, peer.ID) error
+	// LivenessFailureThreshold is the number of consecutive failed liveness
+	// checks after which a peer is disconnected.
+	LivenessFailureThreshold int
+	// MaxPeerStats caps the number of peers other than bootstrap peers for
+	// which per-peer state, such as when they were lost and their failed
+	// liveness checks, is kept. Past the cap the least recently updated peers
+	// are forgotten. Zero means no cap.
+	MaxPeerStats int
+	// PeerProvider, if set, is called at the start of a round to fetch the
+	// bootstrap peers, replacing those the Bootstrapper was created with.
+	// If it fails the most recently fetched peers, or initially the ones
+	// the Bootstrapper was created with, continue to be used.
+	PeerProvider func(context.Context) ([]pstore.PeerInfo, error)
+	// PeerProviderTTL is how long peers fetched from PeerProvider are used
+	// before fetching them again. Zero means they are fetched every round.
+	PeerProviderTTL time.Duration
+	// Resolver resolves an address of a bootstrap peer, such as a /dns4
+	// address, to the addresses to dial. The bootstrap peers' addresses are
+	// resolved on Start, whenever PeerProvider replaces them, and every
+	// ResolveInterval, so a hostname pointing at new machines is picked up
+	// without restarting. It defaults to resolving /dns4 and /dns6 addresses
+	// with the system's resolver; nil dials the addresses as they are.
+	Resolver func(context.Context, ma.Multiaddr) ([]ma.Multiaddr, error)
+	// ResolveInterval is how long resolved addresses are used before they
+	// are resolved again. Zero means they are only resolved once.
+	ResolveInterval time.Duration
+	// VerifyConnectedness, if true, counts only those peers reported by the
+	// dialer that the host's network also reports as connected. Use it with
+	// dialers whose peer lists include half-open or limited connections.
+	VerifyConnectedness bool
+	// WarmUpPeriod is how long after Start the threshold not being met is
+	// reported by Status as warming up rather than as a problem, since the
+	// first dials are still in flight.
+	WarmUpPeriod time.Duration
+	// PeerStorePath, if set, is the file the connected peers are written to
+	// when the Bootstrapper is stopped. They are read back on the next Start
+	// and dialed, after recently lost peers, ahead of the bootstrap peers,
+	// so a restarted node rejoins the network through peers it knew.
+	PeerStorePath string
+	// Tracer, if set, receives a span for each bootstrap round and a child
+	// span for each dial, tagged with the peer and the dial's outcome.
+	Tracer Tracer
 
 	// Dependencies
 	h host.Host
@@ -40,67 +144,573 @@ type Bootstrapper struct {
 	// Does the work. Usually Bootstrapper.bootstrap. Argument is a slice of
 	// currently-connected peers (so it won't attempt to reconnect).
 	Bootstrap func([]peer.ID)
+	// OnThresholdReached, if set, is called the first time the number of
+	// connected peers meets MinPeerThreshold after a bootstrap round. It is
+	// called at most once, with the number of connected peers at that moment.
+	OnThresholdReached func(peerCount int)
+	// EventBus, if set, receives RoundStarted, PeerConnected, PeerFailed,
+	// ThresholdReached and ThresholdLost events on BootstrapEventsTopic.
+	// Publishing blocks while a subscriber's channel is full; use Events for
+	// a channel that never blocks publishing.
+	EventBus *pubsub.PubSub
 
 	// Bookkeeping
 	ticker         *time.Ticker
 	ctx            context.Context
 	cancel         context.CancelFunc
 	dhtBootStarted bool
+	thresholdOnce  sync.Once
+	// ready is closed the first time MinPeerThreshold is met.
+	ready chan struct{}
+	// thresholdMet is whether MinPeerThreshold was met after the last round.
+	thresholdMet bool
+	// now returns the current time. It is replaced in tests.
+	now func() time.Time
+
+	// lk protects MinPeerThreshold, bootstrapPeers and the fields below,
+	// which may be read from other goroutines.
+	lk sync.Mutex
+	// lastPeers are the peers connected at the start of the previous round.
+	lastPeers []peer.ID
+	// lostPeers maps recently disconnected peers to when they were found missing.
+	lostPeers map[peer.ID]time.Time
+	// lastRound is when the most recent bootstrap round started.
+	lastRound time.Time
+	// lastRoundDuration is how long the most recent bootstrap round took.
+	lastRoundDuration time.Duration
+	// livenessFailures counts consecutive failed liveness checks per peer.
+	livenessFailures map[peer.ID]int
+	// peerStatsUpdated orders peers with per-peer state by when it was last
+	// updated, according to peerStatsClock.
+	peerStatsUpdated map[peer.ID]uint64
+	peerStatsClock   uint64
+	// peersFetched is when bootstrapPeers were last fetched from PeerProvider.
+	peersFetched time.Time
+	// started is when Start was called.
+	started time.Time
+	// goodPeers are peers known to be useful, most recently added first.
+	goodPeers []peer.ID
+	// persistedPeers are the peers read from PeerStorePath on Start.
+	persistedPeers []pstore.PeerInfo
+	// resolvedAddrs maps bootstrap peers to the addresses Resolver last
+	// resolved their addresses to.
+	resolvedAddrs map[peer.ID][]ma.Multiaddr
+	// peersResolved is when the bootstrap peers' addresses were last resolved.
+	peersResolved time.Time
+	// dialing are the peers being dialed right now.
+	dialing map[peer.ID]bool
+	// dialFailures maps peers whose last dial failed to that failure.
+	dialFailures map[peer.ID]dialFailure
+	// timeToFirstPeer is how long after Start a round first found a
+	// connected peer, if one has.
+	timeToFirstPeer time.Duration
+	sawFirstPeer    bool
+	// observedPeers are the peers recorded in ObserverMode.
+	observedPeers map[peer.ID]ObservedPeer
+	// events is the channel returned by Events, once it has been called.
+	events chan BootstrapEvent
+}
+
+// ObservedPeer is a peer recorded by a Bootstrapper in ObserverMode.
+type ObservedPeer struct {
+	Info pstore.PeerInfo
+	// ObservedAt is when the peer was last connected to.
+	ObservedAt time.Time
+}
+
+// dialFailure records a failed dial.
+type dialFailure struct {
+	at  time.Time
+	err error
+	// consecutive is the number of dials of the peer in a row that failed.
+	consecutive int
+}
+
+// maxGoodPeers is the number of peers added with AddGoodPeer that are remembered.
+const maxGoodPeers = 16
+
+// waitForPeersInterval is how often WaitForPeers checks the connected peers.
+const waitForPeersInterval = 100 * time.Millisecond
+
+// BootstrapperStatus summarizes whether a Bootstrapper is keeping the host
+// connected to enough peers.
+type BootstrapperStatus int
+
+const (
+	// BootstrapperStopped means the Bootstrapper hasn't been started or has
+	// been stopped.
+	BootstrapperStopped = BootstrapperStatus(iota)
+	// BootstrapperWarmingUp means the threshold isn't met, but the
+	// Bootstrapper was started less than WarmUpPeriod ago.
+	BootstrapperWarmingUp
+	// BootstrapperThresholdMet means at least MinPeerThreshold peers are connected.
+	BootstrapperThresholdMet
+	// BootstrapperThresholdNotMet means fewer than MinPeerThreshold peers are
+	// connected after warming up.
+	BootstrapperThresholdNotMet
+)
+
+func (s BootstrapperStatus) String() string {
+	switch s {
+	case BootstrapperStopped:
+		return "stopped"
+	case BootstrapperWarmingUp:
+		return "warming up"
+	case BootstrapperThresholdMet:
+		return "threshold met"
+	case BootstrapperThresholdNotMet:
+		return "threshold not met"
+	default:
+		return "<unknown status>"
+	}
+}
+
+// BootstrapperDump is a snapshot of a Bootstrapper's state, for diagnostics.
+type BootstrapperDump struct {
+	MinPeerThreshold   int
+	Period             time.Duration
+	ConnectionTimeout  time.Duration
+	RecentlyLostWindow time.Duration
+
+	BootstrapPeers []string
+	ConnectedPeers []string
+	// RecentlyLostPeers maps peers to when they were found disconnected.
+	RecentlyLostPeers map[string]time.Time
+	// LivenessFailures maps peers to their consecutive failed liveness checks.
+	LivenessFailures map[string]int
+
+	LastRound         time.Time
+	LastRoundDuration time.Duration
+
+	// ThresholdReached is true once MinPeerThreshold has ever been met.
+	ThresholdReached bool
+	// ThresholdMet is true if MinPeerThreshold is met right now.
+	ThresholdMet bool
 }
 
 // NewBootstrapper returns a new Bootstrapper that will attempt to keep connected
-// to the filecoin network by connecting to the given bootstrap peers.
+// to the filecoin network by connecting to the given bootstrap peers. Peers
+// listed more than once are dialed using their first entry, and the host itself
+// is never dialed.
 func NewBootstrapper(bootstrapPeers []pstore.PeerInfo, h host.Host, d inet.Dialer, r routing.IpfsRouting, minPeer int, period time.Duration) *Bootstrapper {
 	b := &Bootstrapper{
-		MinPeerThreshold:  minPeer,
-		bootstrapPeers:    bootstrapPeers,
-		Period:            period,
-		ConnectionTimeout: 20 * time.Second,
+		MinPeerThreshold:         minPeer,
+		bootstrapPeers:           uniquePeers(bootstrapPeers, h.ID()),
+		Period:                   period,
+		ConnectionTimeout:        20 * time.Second,
+		DialBackoff:              period,
+		MaxDialBackoff:           10 * time.Minute,
+		Resolver:                 resolveDNSAddr,
+		ResolveInterval:          10 * time.Minute,
+		MaxConcurrentDials:       8,
+		HandshakeTimeout:         10 * time.Second,
+		LivenessFailureThreshold: 3,
 
 		h: h,
 		d: d,
 		r: r,
+
+		ready:            make(chan struct{}),
+		lostPeers:        make(map[peer.ID]time.Time),
+		livenessFailures: make(map[peer.ID]int),
+		peerStatsUpdated: make(map[peer.ID]uint64),
+		dialing:          make(map[peer.ID]bool),
+		dialFailures:     make(map[peer.ID]dialFailure),
+		observedPeers:    make(map[peer.ID]ObservedPeer),
+		now:              time.Now,
 	}
 	b.Bootstrap = b.bootstrap
 	return b
 }
 
+// NewGroupedBootstrapper returns a new Bootstrapper like NewBootstrapper, but
+// with bootstrap peers partitioned into groups (e.g. by region or operator).
+// Each round it connects to at least one peer from every group that has no
+// connected peers before topping up toward the threshold from any group.
+func NewGroupedBootstrapper(peerGroups [][]pstore.PeerInfo, h host.Host, d inet.Dialer, r routing.IpfsRouting, minPeer int, period time.Duration) *Bootstrapper {
+	var bootstrapPeers []pstore.PeerInfo
+	for _, group := range peerGroups {
+		bootstrapPeers = append(bootstrapPeers, group...)
+	}
+
+	b := NewBootstrapper(bootstrapPeers, h, d, r, minPeer, period)
+	b.peerGroups = peerGroups
+	return b
+}
+
 // Start starts the Bootstrapper bootstrapping. Cancel `ctx` or call Stop() to stop it.
 func (b *Bootstrapper) Start(ctx context.Context) {
 	b.ctx, b.cancel = context.WithCancel(ctx)
-	b.ticker = time.NewTicker(b.Period)
+
+	b.lk.Lock()
+	b.started = b.now()
+	b.lk.Unlock()
+	b.loadPeers()
+
+	// Without jitter a ticker keeps rounds Period apart; with it a timer is
+	// reset to a new interval after each round.
+	var timer *time.Timer
+	var ticks <-chan time.Time
+	if b.PeriodJitter > 0 {
+		timer = time.NewTimer(b.nextPeriod())
+		ticks = timer.C
+	} else {
+		b.ticker = time.NewTicker(b.Period)
+		ticks = b.ticker.C
+	}
 
 	go func() {
-		defer b.ticker.Stop()
+		b.resolveBootstrapPeers(b.ctx)
+
+		if timer != nil {
+			defer timer.Stop()
+		} else {
+			defer b.ticker.Stop()
+		}
 
 		for {
 			select {
 			case <-b.ctx.Done():
 				return
-			case <-b.ticker.C:
-				b.Bootstrap(b.d.Peers())
+			case <-ticks:
+				b.round()
+				if timer != nil {
+					timer.Reset(b.nextPeriod())
+				}
 			}
 		}
 	}()
 }
 
-// Stop stops the Bootstrapper.
+// nextPeriod returns Period randomly lengthened or shortened by up to
+// PeriodJitter of it.
+func (b *Bootstrapper) nextPeriod() time.Duration {
+	jitter := (2*rand.Float64() - 1) * b.PeriodJitter
+	return b.Period + time.Duration(jitter*float64(b.Period))
+}
+
+// round runs a single bootstrap round and records its timing.
+func (b *Bootstrapper) round() {
+	start := b.now()
+	currentPeers := b.checkLiveness(b.connectedPeers())
+	b.publish(RoundStarted{ConnectedPeers: len(currentPeers)})
+	b.Bootstrap(currentPeers)
+
+	b.lk.Lock()
+	b.lastRound = start
+	b.lastRoundDuration = b.now().Sub(start)
+	if len(currentPeers) > 0 && !b.sawFirstPeer {
+		b.sawFirstPeer = true
+		b.timeToFirstPeer = start.Sub(b.started)
+		log.Infof("found first peer %s after starting", b.timeToFirstPeer)
+	}
+	b.lk.Unlock()
+
+	b.checkThreshold()
+}
+
+// Stop stops the Bootstrapper, first writing the connected peers to
+// PeerStorePath if it is set.
 func (b *Bootstrapper) Stop() {
 	if b.cancel != nil {
+		b.savePeers()
 		b.cancel()
 	}
 }
 
-// bootstrap does the actual work. If the number of connected peers
-// has fallen below b.MinPeerThreshold it will attempt to connect to
-// a random subset of its bootstrap peers.
+// Status returns the Bootstrapper's current status.
+func (b *Bootstrapper) Status() BootstrapperStatus {
+	b.lk.Lock()
+	started := b.started
+	b.lk.Unlock()
+	if started.IsZero() || b.ctx.Err() != nil {
+		return BootstrapperStopped
+	}
+
+	if len(b.countedPeers(b.connectedPeers())) >= b.minPeerThreshold() {
+		return BootstrapperThresholdMet
+	}
+	if b.now().Sub(started) < b.WarmUpPeriod {
+		return BootstrapperWarmingUp
+	}
+	return BootstrapperThresholdNotMet
+}
+
+// TimeToFirstPeer returns how long after Start the first round to find a
+// connected peer began, and false if no round has found one yet. It is
+// measured once, so later losing and regaining peers doesn't change it.
+func (b *Bootstrapper) TimeToFirstPeer() (time.Duration, bool) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return b.timeToFirstPeer, b.sawFirstPeer
+}
+
+// DebugDump returns a snapshot of the Bootstrapper's configuration, its view
+// of connected and recently lost peers, and the outcome of its last round.
+func (b *Bootstrapper) DebugDump() BootstrapperDump {
+	connected := b.connectedPeers()
+	threshold := b.minPeerThreshold()
+
+	dump := BootstrapperDump{
+		MinPeerThreshold:   threshold,
+		Period:             b.Period,
+		ConnectionTimeout:  b.ConnectionTimeout,
+		RecentlyLostWindow: b.RecentlyLostWindow,
+		ConnectedPeers:     make([]string, 0, len(connected)),
+		RecentlyLostPeers:  make(map[string]time.Time),
+		LivenessFailures:   make(map[string]int),
+		ThresholdMet:       len(b.countedPeers(connected)) >= threshold,
+	}
+	for _, p := range connected {
+		dump.ConnectedPeers = append(dump.ConnectedPeers, p.Pretty())
+	}
+
+	select {
+	case <-b.ready:
+		dump.ThresholdReached = true
+	default:
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	dump.BootstrapPeers = make([]string, 0, len(b.bootstrapPeers))
+	for _, pinfo := range b.bootstrapPeers {
+		dump.BootstrapPeers = append(dump.BootstrapPeers, pinfo.ID.Pretty())
+	}
+	for p, lostAt := range b.lostPeers {
+		dump.RecentlyLostPeers[p.Pretty()] = lostAt
+	}
+	for p, failures := range b.livenessFailures {
+		dump.LivenessFailures[p.Pretty()] = failures
+	}
+	dump.LastRound = b.lastRound
+	dump.LastRoundDuration = b.lastRoundDuration
+
+	return dump
+}
+
+// SetMinPeerThreshold sets MinPeerThreshold to n, e.g. when the node takes
+// on a role that needs more peers. It is safe to call while the Bootstrapper
+// is running and takes effect from the next round.
+func (b *Bootstrapper) SetMinPeerThreshold(n int) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.MinPeerThreshold = n
+}
+
+// minPeerThreshold returns MinPeerThreshold.
+func (b *Bootstrapper) minPeerThreshold() int {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return b.MinPeerThreshold
+}
+
+// AddGoodPeer marks p as a peer that has proven useful, such as one the chain
+// was synced from. Good peers are dialed before any other candidates, most
+// recently added first, whether or not they are bootstrap peers. Only the
+// most recent few good peers are remembered.
+func (b *Bootstrapper) AddGoodPeer(p peer.ID) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	goodPeers := []peer.ID{p}
+	for _, gp := range b.goodPeers {
+		if gp != p && len(goodPeers) < maxGoodPeers {
+			goodPeers = append(goodPeers, gp)
+		}
+	}
+	b.goodPeers = goodPeers
+}
+
+// WhyNotConnected explains, for diagnostics, why the host is or isn't
+// connected to p as far as the Bootstrapper is concerned: whether p is
+// connected, being dialed, not something the Bootstrapper dials, failed the
+// last time it was dialed and may be backed off, or hasn't been needed.
+func (b *Bootstrapper) WhyNotConnected(p peer.ID) string {
+	if hasPID(b.connectedPeers(), p) {
+		return "connected"
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	switch {
+	case b.dialing[p]:
+		return "currently dialing"
+	case !hasPeerInfo(b.bootstrapPeers, p) && !hasPID(b.goodPeers, p) && !hasPeerInfo(b.persistedPeers, p):
+		return "not a bootstrap peer or good peer, so never dialed"
+	}
+	if failure, ok := b.dialFailures[p]; ok {
+		if until := b.backoffUntil(failure); b.now().Before(until) {
+			return fmt.Sprintf("last dial at %s failed: %s; backing off until %s after %d failed dials", failure.at.Format(time.RFC3339), failure.err, until.Format(time.RFC3339), failure.consecutive)
+		}
+		return fmt.Sprintf("last dial at %s failed: %s; dialed again when fewer than %d peers are connected", failure.at.Format(time.RFC3339), failure.err, b.MinPeerThreshold)
+	}
+	return fmt.Sprintf("not dialed while at least %d peers are connected", b.MinPeerThreshold)
+}
+
+// ObservedPeers returns the peers recorded in ObserverMode, ordered by ID.
+func (b *Bootstrapper) ObservedPeers() []ObservedPeer {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	observed := make([]ObservedPeer, 0, len(b.observedPeers))
+	for _, op := range b.observedPeers {
+		observed = append(observed, op)
+	}
+	sort.Slice(observed, func(i, j int) bool { return observed[i].Info.ID < observed[j].Info.ID })
+	return observed
+}
+
+// IsBootstrapPeer returns whether pid is one of the configured bootstrap peers.
+func (b *Bootstrapper) IsBootstrapPeer(pid peer.ID) bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	return hasPeerInfo(b.bootstrapPeers, pid)
+}
+
+// BlockUntilConnected blocks until the host has been connected to at least
+// MinPeerThreshold peers, returning nil, or until ctx is done, returning
+// ctx.Err(). The threshold is checked after each bootstrap round, so the
+// Bootstrapper must have been started for this to return nil.
+func (b *Bootstrapper) BlockUntilConnected(ctx context.Context) error {
+	select {
+	case <-b.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitForPeers blocks until at least n peers are connected, as reported by
+// the dialer and checked against VerifyConnectedness like in bootstrap rounds,
+// returning nil, or until ctx is done, returning ctx.Err(). Unlike
+// BlockUntilConnected it doesn't depend on rounds running, and it returns
+// again whenever enough peers are connected.
+func (b *Bootstrapper) WaitForPeers(ctx context.Context, n int) error {
+	ticker := time.NewTicker(waitForPeersInterval)
+	defer ticker.Stop()
+	for len(b.connectedPeers()) < n {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// connectedPeers returns the peers the dialer reports as connected, excluding
+// those the host doesn't consider connected if VerifyConnectedness is set.
+func (b *Bootstrapper) connectedPeers() []peer.ID {
+	peers := b.d.Peers()
+	if !b.VerifyConnectedness {
+		return peers
+	}
+
+	connected := make([]peer.ID, 0, len(peers))
+	for _, p := range peers {
+		if b.h.Network().Connectedness(p) == inet.Connected {
+			connected = append(connected, p)
+		}
+	}
+	return connected
+}
+
+// countedPeers returns those of peers that count toward MinPeerThreshold:
+// none in ObserverMode, otherwise the ones ChainHeadCheck accepts, or all of
+// them if it isn't set.
+func (b *Bootstrapper) countedPeers(peers []peer.ID) []peer.ID {
+	if b.ObserverMode {
+		return nil
+	}
+	if b.ChainHeadCheck == nil {
+		return peers
+	}
+
+	counted := make([]peer.ID, 0, len(peers))
+	for _, p := range peers {
+		if b.ChainHeadCheck(p) {
+			counted = append(counted, p)
+		}
+	}
+	return counted
+}
+
+// checkThreshold signals readiness and calls OnThresholdReached the first time
+// the host is connected to at least MinPeerThreshold peers, and publishes
+// events whenever the threshold becomes met or stops being met.
+func (b *Bootstrapper) checkThreshold() {
+	if !b.publishing() {
+		select {
+		case <-b.ready:
+			return
+		default:
+		}
+	}
+
+	peerCount := len(b.countedPeers(b.connectedPeers()))
+	met := peerCount >= b.minPeerThreshold()
+	if met != b.thresholdMet {
+		b.thresholdMet = met
+		if met {
+			b.publish(ThresholdReached{PeerCount: peerCount})
+		} else {
+			b.publish(ThresholdLost{PeerCount: peerCount})
+		}
+	}
+	if !met {
+		return
+	}
+	b.thresholdOnce.Do(func() {
+		close(b.ready)
+		if b.OnThresholdReached != nil {
+			b.OnThresholdReached(peerCount)
+		}
+	})
+}
+
+// bootstrap does the actual work. If any peer group has no connected peers
+// it will attempt to connect to a peer from that group, and if the number of
+// connected peers has fallen below b.MinPeerThreshold it will attempt to
+// connect to a random subset of its bootstrap peers.
 func (b *Bootstrapper) bootstrap(currentPeers []peer.ID) {
-	peersNeeded := b.MinPeerThreshold - len(currentPeers)
-	if peersNeeded < 1 {
+	roundCtx, span := b.tracer().StartSpan(b.ctx, "Bootstrapper.bootstrap")
+	defer span.Finish(nil)
+	span.SetTag("connected_peers", len(currentPeers))
+
+	b.refreshBootstrapPeers(roundCtx)
+	b.resolveBootstrapPeers(roundCtx)
+	b.trackLostPeers(currentPeers)
+
+	candidates := b.candidates()
+	toDial := b.uncoveredGroupPeers(candidates, currentPeers)
+	toDial = append(toDial, b.underfilledClassPeers(candidates, currentPeers, toDial)...)
+
+	threshold := b.minPeerThreshold()
+	peersNeeded := threshold - len(b.countedPeers(currentPeers))
+	if peersNeeded < 1 && len(toDial) == 0 {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(b.ctx, b.ConnectionTimeout)
+	peersNeeded -= len(toDial)
+	for _, pinfo := range candidates {
+		if peersNeeded < 1 {
+			break
+		}
+		// Don't try to connect to an already connected or already chosen peer.
+		if hasPID(currentPeers, pinfo.ID) || hasPeerInfo(toDial, pinfo.ID) {
+			continue
+		}
+		toDial = append(toDial, pinfo)
+		peersNeeded--
+	}
+	if peersNeeded > 0 {
+		log.Warningf("not enough bootstrap nodes to maintain %d connections (current connections: %d)", threshold, len(currentPeers))
+	}
+	span.SetTag("dials", len(toDial))
+
+	ctx, cancel := context.WithTimeout(roundCtx, b.ConnectionTimeout)
 	var wg sync.WaitGroup
 	defer func() {
 		wg.Wait()
@@ -116,27 +726,433 @@ func (b *Bootstrapper) bootstrap(currentPeers []peer.ID) {
 		cancel()
 	}()
 
-	peersAttempted := 0
-	for _, i := range rand.Perm(len(b.bootstrapPeers)) {
-		pinfo := b.bootstrapPeers[i]
-		// Don't try to connect to an already connected peer.
-		if hasPID(currentPeers, pinfo.ID) {
+	// dialSlots limits the dials in flight to MaxConcurrentDials.
+	var dialSlots chan struct{}
+	if b.MaxConcurrentDials > 0 {
+		dialSlots = make(chan struct{}, b.MaxConcurrentDials)
+	}
+	for _, pinfo := range toDial {
+		pinfo := pinfo
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if dialSlots != nil {
+				dialSlots <- struct{}{}
+			}
+			dialCtx, span := b.tracer().StartSpan(ctx, "Bootstrapper.dial")
+			span.SetTag("peer", pinfo.ID.Pretty())
+			b.lk.Lock()
+			b.dialing[pinfo.ID] = true
+			b.lk.Unlock()
+			err := b.connect(dialCtx, b.withResolvedAddrs(pinfo))
+			if dialSlots != nil {
+				<-dialSlots
+			}
+			if err != nil {
+				span.SetTag("outcome", "failed")
+				log.Errorf("got error trying to connect to bootstrap node %+v: %s", pinfo, err.Error())
+				b.publish(PeerFailed{Peer: pinfo.ID, Err: err})
+			} else if err = b.handshake(roundCtx, pinfo.ID); err != nil {
+				span.SetTag("outcome", "handshake failed")
+				log.Errorf("got error during handshake with bootstrap node %+v: %s", pinfo, err.Error())
+				b.publish(PeerFailed{Peer: pinfo.ID, Err: err})
+			} else if b.ObserverMode {
+				span.SetTag("outcome", "observed")
+				b.publish(PeerConnected{Peer: pinfo.ID})
+				b.observe(pinfo)
+			} else {
+				span.SetTag("outcome", "connected")
+				b.publish(PeerConnected{Peer: pinfo.ID})
+			}
+			b.recordDial(pinfo.ID, err)
+			span.Finish(err)
+		}()
+	}
+}
+
+// recordDial records the outcome of a finished dial of p.
+func (b *Bootstrapper) recordDial(p peer.ID, err error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	delete(b.dialing, p)
+	if err == nil {
+		delete(b.dialFailures, p)
+	} else {
+		consecutive := b.dialFailures[p].consecutive + 1
+		b.dialFailures[p] = dialFailure{at: b.now(), err: err, consecutive: consecutive}
+		b.touchPeerStats(p)
+	}
+	b.evictPeerStats()
+}
+
+// backoffUntil returns when a peer whose last dial failed as failure may be
+// dialed again.
+func (b *Bootstrapper) backoffUntil(failure dialFailure) time.Time {
+	if b.DialBackoff <= 0 {
+		return failure.at
+	}
+
+	backoff := b.DialBackoff
+	for i := 1; i < failure.consecutive && backoff < b.MaxDialBackoff; i++ {
+		backoff *= 2
+	}
+	if b.MaxDialBackoff > 0 && backoff > b.MaxDialBackoff {
+		backoff = b.MaxDialBackoff
+	}
+	return failure.at.Add(backoff)
+}
+
+// backingOff returns whether p's last dial failed too recently for it to be
+// dialed again. b.lk must be held.
+func (b *Bootstrapper) backingOff(p peer.ID, now time.Time) bool {
+	failure, ok := b.dialFailures[p]
+	return ok && now.Before(b.backoffUntil(failure))
+}
+
+// observe records the newly connected peer pinfo in ObserverMode and
+// disconnects from it.
+func (b *Bootstrapper) observe(pinfo pstore.PeerInfo) {
+	b.lk.Lock()
+	b.observedPeers[pinfo.ID] = ObservedPeer{Info: pinfo, ObservedAt: b.now()}
+	b.lk.Unlock()
+
+	if err := b.d.ClosePeer(pinfo.ID); err != nil {
+		log.Errorf("got error trying to disconnect from observed peer %s: %s", pinfo.ID.Pretty(), err.Error())
+	}
+}
+
+// connect connects the host to pinfo, giving up after ConnectTimeout if set.
+func (b *Bootstrapper) connect(ctx context.Context, pinfo pstore.PeerInfo) error {
+	if b.ConnectTimeout <= 0 {
+		return b.h.Connect(ctx, pinfo)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.ConnectTimeout)
+	defer cancel()
+	return b.h.Connect(ctx, pinfo)
+}
+
+// handshake runs Handshake, if set, against the newly connected peer p, and
+// disconnects p if it fails or doesn't complete within HandshakeTimeout.
+func (b *Bootstrapper) handshake(ctx context.Context, p peer.ID) error {
+	if b.Handshake == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.HandshakeTimeout)
+	defer cancel()
+	err := b.Handshake(ctx, p)
+	if err == nil {
+		return nil
+	}
+
+	if closeErr := b.d.ClosePeer(p); closeErr != nil {
+		log.Errorf("got error trying to disconnect from peer %s: %s", p.Pretty(), closeErr.Error())
+	}
+	return err
+}
+
+// tracer returns the configured Tracer, or one that does nothing.
+func (b *Bootstrapper) tracer() Tracer {
+	if b.Tracer == nil {
+		return noopTracer{}
+	}
+	return b.Tracer
+}
+
+// refreshBootstrapPeers replaces the bootstrap peers with those returned by
+// PeerProvider, if it is set and the peers were last fetched more than
+// PeerProviderTTL ago.
+func (b *Bootstrapper) refreshBootstrapPeers(ctx context.Context) {
+	if b.PeerProvider == nil {
+		return
+	}
+
+	b.lk.Lock()
+	fresh := !b.peersFetched.IsZero() && b.now().Sub(b.peersFetched) < b.PeerProviderTTL
+	b.lk.Unlock()
+	if fresh {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.ConnectionTimeout)
+	defer cancel()
+	bootstrapPeers, err := b.PeerProvider(ctx)
+	if err != nil {
+		log.Warningf("got error trying to fetch bootstrap peers, using previous peers: %s", err.Error())
+		return
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.bootstrapPeers = uniquePeers(bootstrapPeers, b.h.ID())
+	b.peersFetched = b.now()
+	// Resolve the new peers' addresses.
+	b.peersResolved = time.Time{}
+}
+
+// uncoveredGroupPeers returns, for each peer group with no connected peers,
+// the first of the candidates that belongs to that group.
+func (b *Bootstrapper) uncoveredGroupPeers(candidates []pstore.PeerInfo, currentPeers []peer.ID) []pstore.PeerInfo {
+	var toDial []pstore.PeerInfo
+	for _, group := range b.peerGroups {
+		covered := false
+		for _, pinfo := range group {
+			if hasPID(currentPeers, pinfo.ID) || hasPeerInfo(toDial, pinfo.ID) {
+				covered = true
+				break
+			}
+		}
+		if covered {
 			continue
 		}
 
+		for _, pinfo := range candidates {
+			if hasPeerInfo(group, pinfo.ID) {
+				toDial = append(toDial, pinfo)
+				break
+			}
+		}
+	}
+	return toDial
+}
+
+// underfilledClassPeers returns, for each class in ClassThresholds with fewer
+// connected or already chosen peers than its threshold, enough of the
+// candidates of that class to make up the difference, if there are enough.
+func (b *Bootstrapper) underfilledClassPeers(candidates []pstore.PeerInfo, currentPeers []peer.ID, chosen []pstore.PeerInfo) []pstore.PeerInfo {
+	if b.PeerClass == nil || len(b.ClassThresholds) == 0 {
+		return nil
+	}
+
+	peersNeeded := make(map[string]int, len(b.ClassThresholds))
+	for class, threshold := range b.ClassThresholds {
+		peersNeeded[class] = threshold
+	}
+	for _, p := range currentPeers {
+		peersNeeded[b.PeerClass(p)]--
+	}
+	for _, pinfo := range chosen {
+		peersNeeded[b.PeerClass(pinfo.ID)]--
+	}
+
+	var toDial []pstore.PeerInfo
+	for _, pinfo := range candidates {
+		if hasPID(currentPeers, pinfo.ID) || hasPeerInfo(chosen, pinfo.ID) || hasPeerInfo(toDial, pinfo.ID) {
+			continue
+		}
+		class := b.PeerClass(pinfo.ID)
+		if peersNeeded[class] > 0 {
+			toDial = append(toDial, pinfo)
+			peersNeeded[class]--
+		}
+	}
+	for class, needed := range peersNeeded {
+		if needed > 0 {
+			log.Warningf("not enough %q bootstrap nodes to maintain %d connections to them", class, b.ClassThresholds[class])
+		}
+	}
+	return toDial
+}
+
+// checkLiveness runs LivenessCheck against each of the current peers,
+// disconnecting those that have failed too many times in a row. It returns
+// the peers that remain connected. The checks run concurrently, at most
+// MaxConcurrentDials at once, and without holding b.lk.
+func (b *Bootstrapper) checkLiveness(currentPeers []peer.ID) []peer.ID {
+	if b.LivenessCheck == nil {
+		return currentPeers
+	}
+
+	errs := make([]error, len(currentPeers))
+	var wg sync.WaitGroup
+	var checkSlots chan struct{}
+	if b.MaxConcurrentDials > 0 {
+		checkSlots = make(chan struct{}, b.MaxConcurrentDials)
+	}
+	for i, p := range currentPeers {
+		i, p := i, p
 		wg.Add(1)
 		go func() {
-			if err := b.h.Connect(ctx, pinfo); err != nil {
-				log.Errorf("got error trying to connect to bootstrap node %+v: %s", pinfo, err.Error())
+			defer wg.Done()
+			if checkSlots != nil {
+				checkSlots <- struct{}{}
+				defer func() { <-checkSlots }()
 			}
-			wg.Done()
+			ctx, cancel := context.WithTimeout(b.ctx, b.ConnectionTimeout)
+			defer cancel()
+			errs[i] = b.LivenessCheck(ctx, p)
 		}()
-		peersAttempted++
-		if peersAttempted == peersNeeded {
-			return
+	}
+	wg.Wait()
+
+	b.lk.Lock()
+	live := make([]peer.ID, 0, len(currentPeers))
+	var dead []peer.ID
+	for i, p := range currentPeers {
+		err := errs[i]
+		if err == nil {
+			delete(b.livenessFailures, p)
+			live = append(live, p)
+			continue
+		}
+
+		b.livenessFailures[p]++
+		b.touchPeerStats(p)
+		if b.livenessFailures[p] < b.LivenessFailureThreshold {
+			live = append(live, p)
+			continue
+		}
+
+		log.Warningf("disconnecting from peer %s after %d failed liveness checks: %s", p.Pretty(), b.livenessFailures[p], err.Error())
+		delete(b.livenessFailures, p)
+		dead = append(dead, p)
+		// A peer dropped for failing liveness shouldn't be prioritized for
+		// reconnection as if it had been lost.
+		for i, lp := range b.lastPeers {
+			if lp == p {
+				b.lastPeers = append(b.lastPeers[:i:i], b.lastPeers[i+1:]...)
+				break
+			}
+		}
+	}
+
+	// Forget failures of peers that have since disconnected.
+	for p := range b.livenessFailures {
+		if !hasPID(currentPeers, p) {
+			delete(b.livenessFailures, p)
+		}
+	}
+	b.evictPeerStats()
+	b.lk.Unlock()
+
+	for _, p := range dead {
+		if err := b.d.ClosePeer(p); err != nil {
+			log.Errorf("got error trying to disconnect from peer %s: %s", p.Pretty(), err.Error())
+		}
+	}
+
+	return live
+}
+
+// trackLostPeers records when peers that were connected during the previous
+// round were found to be disconnected, and forgets lost peers that have
+// reconnected or have been gone longer than RecentlyLostWindow.
+func (b *Bootstrapper) trackLostPeers(currentPeers []peer.ID) {
+	if b.RecentlyLostWindow <= 0 {
+		return
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	now := b.now()
+	for _, p := range b.lastPeers {
+		if !hasPID(currentPeers, p) {
+			b.lostPeers[p] = now
+			b.touchPeerStats(p)
+		}
+	}
+	for p, lostAt := range b.lostPeers {
+		if hasPID(currentPeers, p) || now.Sub(lostAt) > b.RecentlyLostWindow {
+			delete(b.lostPeers, p)
+		}
+	}
+	b.lastPeers = currentPeers
+	b.evictPeerStats()
+}
+
+// touchPeerStats marks p's per-peer state as just updated. b.lk must be held.
+func (b *Bootstrapper) touchPeerStats(p peer.ID) {
+	b.peerStatsClock++
+	b.peerStatsUpdated[p] = b.peerStatsClock
+}
+
+// evictPeerStats forgets the per-peer state of the least recently updated
+// peers other than bootstrap peers until at most MaxPeerStats remain.
+// b.lk must be held.
+func (b *Bootstrapper) evictPeerStats() {
+	var evictable []peer.ID
+	for p := range b.peerStatsUpdated {
+		_, lost := b.lostPeers[p]
+		_, failing := b.livenessFailures[p]
+		_, dialFailed := b.dialFailures[p]
+		if !lost && !failing && !dialFailed {
+			delete(b.peerStatsUpdated, p)
+			continue
+		}
+		if !hasPeerInfo(b.bootstrapPeers, p) {
+			evictable = append(evictable, p)
 		}
 	}
-	log.Warningf("not enough bootstrap nodes to maintain %d connections (current connections: %d)", b.MinPeerThreshold, len(currentPeers))
+	if b.MaxPeerStats <= 0 || len(evictable) <= b.MaxPeerStats {
+		return
+	}
+
+	sort.Slice(evictable, func(i, j int) bool {
+		return b.peerStatsUpdated[evictable[i]] < b.peerStatsUpdated[evictable[j]]
+	})
+	for _, p := range evictable[:len(evictable)-b.MaxPeerStats] {
+		delete(b.lostPeers, p)
+		delete(b.livenessFailures, p)
+		delete(b.dialFailures, p)
+		delete(b.peerStatsUpdated, p)
+	}
+}
+
+// candidates returns the peers in the order they should be dialed: good peers
+// first, then recently lost bootstrap peers, then peers read from
+// PeerStorePath, followed by the rest of the bootstrap peers, each in random
+// order. Peers being backed off are left out.
+func (b *Bootstrapper) candidates() []pstore.PeerInfo {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	now := b.now()
+	var good, lost, persisted, rest []pstore.PeerInfo
+	for _, p := range b.goodPeers {
+		if b.backingOff(p, now) {
+			continue
+		}
+		pinfo, ok := findPeerInfo(b.bootstrapPeers, p)
+		if !ok {
+			pinfo, _ = findPeerInfo(b.persistedPeers, p)
+		}
+		good = append(good, pinfo)
+	}
+	for _, i := range rand.Perm(len(b.bootstrapPeers)) {
+		pinfo := b.bootstrapPeers[i]
+		if hasPID(b.goodPeers, pinfo.ID) || b.backingOff(pinfo.ID, now) {
+			continue
+		}
+		if _, ok := b.lostPeers[pinfo.ID]; ok {
+			lost = append(lost, pinfo)
+		} else {
+			rest = append(rest, pinfo)
+		}
+	}
+	for _, i := range rand.Perm(len(b.persistedPeers)) {
+		pinfo := b.persistedPeers[i]
+		if hasPID(b.goodPeers, pinfo.ID) || hasPeerInfo(b.bootstrapPeers, pinfo.ID) || b.backingOff(pinfo.ID, now) {
+			continue
+		}
+		persisted = append(persisted, pinfo)
+	}
+	return append(append(append(good, lost...), persisted...), rest...)
+}
+
+// uniquePeers returns pinfos without self and with only the first of the
+// entries for each peer.
+func uniquePeers(pinfos []pstore.PeerInfo, self peer.ID) []pstore.PeerInfo {
+	unique := make([]pstore.PeerInfo, 0, len(pinfos))
+	for _, pinfo := range pinfos {
+		if pinfo.ID != self && !hasPeerInfo(unique, pinfo.ID) {
+			unique = append(unique, pinfo)
+		}
+	}
+	return unique
 }
 
 func hasPID(pids []peer.ID, pid peer.ID) bool {
@@ -147,3 +1163,18 @@ func hasPID(pids []peer.ID, pid peer.ID) bool {
 	}
 	return false
 }
+
+func hasPeerInfo(pinfos []pstore.PeerInfo, pid peer.ID) bool {
+	_, ok := findPeerInfo(pinfos, pid)
+	return ok
+}
+
+// findPeerInfo returns the entry for pid in pinfos, if there is one.
+func findPeerInfo(pinfos []pstore.PeerInfo, pid peer.ID) (pstore.PeerInfo, bool) {
+	for _, pinfo := range pinfos {
+		if pinfo.ID == pid {
+			return pinfo, true
+		}
+	}
+	return pstore.PeerInfo{ID: pid}, false
+}
@@ -0,0 +1,99 @@
+package filnet
+
+import (
+	peer "gx/ipfs/QmY5Grm8pJdiSSVsYxx4uNRgweY72EmYwuSDbRnbFok3iY/go-libp2p-peer"
+)
+
+// BootstrapEventsTopic is the topic a Bootstrapper publishes its events to
+// on its EventBus.
+const BootstrapEventsTopic = "bootstrap"
+
+// eventsBufferSize is the number of events the channel returned by
+// Bootstrapper.Events holds before further events are dropped.
+const eventsBufferSize = 64
+
+// BootstrapEvent is an event published by a Bootstrapper: one of
+// RoundStarted, PeerConnected, PeerFailed, ThresholdReached and ThresholdLost.
+type BootstrapEvent interface {
+	bootstrapEvent()
+}
+
+func (RoundStarted) bootstrapEvent()     {}
+func (PeerConnected) bootstrapEvent()    {}
+func (PeerFailed) bootstrapEvent()       {}
+func (ThresholdReached) bootstrapEvent() {}
+func (ThresholdLost) bootstrapEvent()    {}
+
+// RoundStarted is published when a bootstrap round starts.
+type RoundStarted struct {
+	// ConnectedPeers is the number of peers connected at the start of the round.
+	ConnectedPeers int
+}
+
+// PeerConnected is published when the Bootstrapper connects to a peer.
+type PeerConnected struct {
+	Peer peer.ID
+}
+
+// PeerFailed is published when the Bootstrapper fails to connect to a peer.
+type PeerFailed struct {
+	Peer peer.ID
+	Err  error
+}
+
+// ThresholdReached is published when the number of connected peers meets
+// MinPeerThreshold after a round in which it had not been met.
+type ThresholdReached struct {
+	PeerCount int
+}
+
+// ThresholdLost is published when the number of connected peers falls below
+// MinPeerThreshold after a round in which it had been met.
+type ThresholdLost struct {
+	PeerCount int
+}
+
+// Events returns a channel that receives the Bootstrapper's events from the
+// first call on. It is the same channel on every call. Sending to it never
+// blocks: events are dropped while its buffer is full, so a slow consumer
+// misses events rather than stalling bootstrapping.
+func (b *Bootstrapper) Events() <-chan BootstrapEvent {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if b.events == nil {
+		b.events = make(chan BootstrapEvent, eventsBufferSize)
+	}
+	return b.events
+}
+
+// publish publishes event to the EventBus, if there is one, and sends it to
+// the channel returned by Events, if it has been called and has room.
+func (b *Bootstrapper) publish(event BootstrapEvent) {
+	if b.EventBus != nil {
+		b.EventBus.Pub(event, BootstrapEventsTopic)
+	}
+
+	b.lk.Lock()
+	events := b.events
+	b.lk.Unlock()
+	if events == nil {
+		return
+	}
+	select {
+	case events <- event:
+	default:
+		log.Debugf("dropping bootstrap event %#v: events channel full", event)
+	}
+}
+
+// publishing returns whether events are published anywhere.
+func (b *Bootstrapper) publishing() bool {
+	if b.EventBus != nil {
+		return true
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return b.events != nil
+}
@@ -0,0 +1,66 @@
+package filnet
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	pstore "gx/ipfs/QmPiemjiKBC9VA7vZF82m4x1oygtg2c2YVqag8PX7dN1BD/go-libp2p-peerstore"
+)
+
+// savePeers writes the connected peers whose addresses the host knows to
+// PeerStorePath, if set, so the next Start can dial them. The file is
+// replaced atomically, so a crash while writing leaves the previous peers.
+func (b *Bootstrapper) savePeers() {
+	if b.PeerStorePath == "" {
+		return
+	}
+
+	var pinfos []pstore.PeerInfo
+	for _, p := range b.connectedPeers() {
+		pinfo := b.h.Peerstore().PeerInfo(p)
+		if len(pinfo.Addrs) > 0 {
+			pinfos = append(pinfos, pinfo)
+		}
+	}
+
+	data, err := json.Marshal(pinfos)
+	if err != nil {
+		log.Warningf("got error trying to encode peers to persist: %s", err.Error())
+		return
+	}
+	tmp := b.PeerStorePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Warningf("got error trying to persist peers to %s: %s", b.PeerStorePath, err.Error())
+		return
+	}
+	if err := os.Rename(tmp, b.PeerStorePath); err != nil {
+		log.Warningf("got error trying to persist peers to %s: %s", b.PeerStorePath, err.Error())
+	}
+}
+
+// loadPeers reads the peers written to PeerStorePath by savePeers, if any,
+// so they are dialed along with the bootstrap peers.
+func (b *Bootstrapper) loadPeers() {
+	if b.PeerStorePath == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(b.PeerStorePath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Warningf("got error trying to read persisted peers from %s: %s", b.PeerStorePath, err.Error())
+		return
+	}
+	var pinfos []pstore.PeerInfo
+	if err := json.Unmarshal(data, &pinfos); err != nil {
+		log.Warningf("got error trying to decode persisted peers from %s: %s", b.PeerStorePath, err.Error())
+		return
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.persistedPeers = uniquePeers(pinfos, b.h.ID())
+}
@@ -0,0 +1,123 @@
+package filnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	ma "gx/ipfs/QmNTCey11oxhb1AxDnQBRHtdhap6Ctud872NjAYPYYXPuc/go-multiaddr"
+	pstore "gx/ipfs/QmPiemjiKBC9VA7vZF82m4x1oygtg2c2YVqag8PX7dN1BD/go-libp2p-peerstore"
+	peer "gx/ipfs/QmY5Grm8pJdiSSVsYxx4uNRgweY72EmYwuSDbRnbFok3iY/go-libp2p-peer"
+)
+
+// resolveBootstrapPeers resolves the addresses of the bootstrap peers with
+// Resolver, unless they were resolved less than ResolveInterval ago. A peer
+// whose addresses fail to resolve keeps those it was last resolved to, or if
+// it hasn't been resolved yet its unresolved ones, so it can still be dialed.
+func (b *Bootstrapper) resolveBootstrapPeers(ctx context.Context) {
+	if b.Resolver == nil {
+		return
+	}
+
+	b.lk.Lock()
+	fresh := !b.peersResolved.IsZero() && (b.ResolveInterval <= 0 || b.now().Sub(b.peersResolved) < b.ResolveInterval)
+	bootstrapPeers := b.bootstrapPeers
+	previous := b.resolvedAddrs
+	b.lk.Unlock()
+	if fresh {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.ConnectionTimeout)
+	defer cancel()
+	resolved := make(map[peer.ID][]ma.Multiaddr, len(bootstrapPeers))
+	for _, pinfo := range bootstrapPeers {
+		if len(pinfo.Addrs) == 0 {
+			continue
+		}
+		addrs, err := b.resolveAddrs(ctx, pinfo.Addrs)
+		if err != nil {
+			log.Warningf("got error trying to resolve addresses of bootstrap peer %s: %s", pinfo.ID.Pretty(), err.Error())
+			if prev, ok := previous[pinfo.ID]; ok {
+				addrs = prev
+			} else {
+				addrs = pinfo.Addrs
+			}
+		}
+		resolved[pinfo.ID] = addrs
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.resolvedAddrs = resolved
+	b.peersResolved = b.now()
+}
+
+// resolveAddrs resolves each of addrs with Resolver.
+func (b *Bootstrapper) resolveAddrs(ctx context.Context, addrs []ma.Multiaddr) ([]ma.Multiaddr, error) {
+	var resolved []ma.Multiaddr
+	for _, addr := range addrs {
+		as, err := b.Resolver(ctx, addr)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve %s: %s", addr, err)
+		}
+		resolved = append(resolved, as...)
+	}
+	return resolved, nil
+}
+
+// withResolvedAddrs returns pinfo with the addresses its addresses were last
+// resolved to, if they have been.
+func (b *Bootstrapper) withResolvedAddrs(pinfo pstore.PeerInfo) pstore.PeerInfo {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if addrs, ok := b.resolvedAddrs[pinfo.ID]; ok {
+		pinfo.Addrs = addrs
+	}
+	return pinfo
+}
+
+// resolveDNSAddr is the default Resolver. It resolves an address starting
+// with a /dns4 or /dns6 component to an address for each of the host's IPv4
+// or IPv6 addresses, and returns any other address as it is.
+func resolveDNSAddr(ctx context.Context, addr ma.Multiaddr) ([]ma.Multiaddr, error) {
+	parts := ma.Split(addr)
+	if len(parts) == 0 {
+		return []ma.Multiaddr{addr}, nil
+	}
+	proto := parts[0].Protocols()[0]
+	var ipProto string
+	switch proto.Name {
+	case "dns4":
+		ipProto = "ip4"
+	case "dns6":
+		ipProto = "ip6"
+	default:
+		return []ma.Multiaddr{addr}, nil
+	}
+
+	hostname, err := parts[0].ValueForProtocol(proto.Code)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	var resolved []ma.Multiaddr
+	for _, ip := range ips {
+		if (ip.IP.To4() != nil) != (ipProto == "ip4") {
+			continue
+		}
+		ipAddr, err := ma.NewMultiaddr(fmt.Sprintf("/%s/%s", ipProto, ip.IP))
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, ma.Join(append([]ma.Multiaddr{ipAddr}, parts[1:]...)...))
+	}
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("no %s addresses for %s", ipProto, hostname)
+	}
+	return resolved, nil
+}
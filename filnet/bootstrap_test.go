@@ -2,17 +2,29 @@ package filnet
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
+	ma "gx/ipfs/QmNTCey11oxhb1AxDnQBRHtdhap6Ctud872NjAYPYYXPuc/go-multiaddr"
+	inet "gx/ipfs/QmNgLg1NTw37iWbYPKcyK85YJ9Whs1MkPtJwhfqbNYAyKg/go-libp2p-net"
 	pstore "gx/ipfs/QmPiemjiKBC9VA7vZF82m4x1oygtg2c2YVqag8PX7dN1BD/go-libp2p-peerstore"
+	"gx/ipfs/QmPiemjiKBC9VA7vZF82m4x1oygtg2c2YVqag8PX7dN1BD/go-libp2p-peerstore/pstoremem"
 	offroute "gx/ipfs/QmVZ6cQXHoTQja4oo9GhhHZi7dThi4x98mRKgGtKnTy37u/go-ipfs-routing/offline"
 	peer "gx/ipfs/QmY5Grm8pJdiSSVsYxx4uNRgweY72EmYwuSDbRnbFok3iY/go-libp2p-peer"
+	"gx/ipfs/QmdbxjQWogRCHRaxhhGnYdT1oQJzL9GdqSKzCdqWr85AP2/pubsub"
 
 	"github.com/filecoin-project/go-filecoin/repo"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func nopConnect(context.Context, pstore.PeerInfo) error   { return nil }
@@ -63,6 +75,1213 @@ func TestBootstrapperStartAndStop(t *testing.T) {
 	assert.Equal(3, callCount)
 }
 
+func TestBootstrapperOnThresholdReached(t *testing.T) {
+	assert := assert.New(t)
+	fakeHost := &fakeHost{ConnectImpl: nopConnect}
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	// protects peers, calls and calledWith
+	var lk sync.Mutex
+	var peers []peer.ID
+	fakeDialer := &fakeDialer{PeersImpl: func() []peer.ID {
+		lk.Lock()
+		defer lk.Unlock()
+		return peers
+	}}
+
+	b := NewBootstrapper([]pstore.PeerInfo{}, fakeHost, fakeDialer, fakeRouter, 3, 10*time.Millisecond)
+
+	// Each round connects one more peer, so the threshold is first reached
+	// after the third round and exceeded on every round after that.
+	b.Bootstrap = func([]peer.ID) {
+		lk.Lock()
+		defer lk.Unlock()
+		peers = append(peers, requireRandPeerID(t))
+	}
+
+	calls := 0
+	calledWith := 0
+	b.OnThresholdReached = func(peerCount int) {
+		lk.Lock()
+		defer lk.Unlock()
+		calls++
+		calledWith = peerCount
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.Start(ctx)
+	time.Sleep(200 * time.Millisecond)
+	b.Stop()
+
+	lk.Lock()
+	defer lk.Unlock()
+	assert.True(len(peers) > 3)
+	assert.Equal(1, calls)
+	assert.Equal(3, calledWith)
+}
+
+func TestBootstrapperBlockUntilConnected(t *testing.T) {
+	fakeHost := &fakeHost{ConnectImpl: nopConnect}
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	t.Run("Returns once the threshold is met", func(t *testing.T) {
+		assert := assert.New(t)
+
+		// protects peers
+		var lk sync.Mutex
+		var peers []peer.ID
+		fakeDialer := &fakeDialer{PeersImpl: func() []peer.ID {
+			lk.Lock()
+			defer lk.Unlock()
+			return peers
+		}}
+
+		b := NewBootstrapper([]pstore.PeerInfo{}, fakeHost, fakeDialer, fakeRouter, 2, 10*time.Millisecond)
+		b.Bootstrap = func([]peer.ID) {}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		b.Start(ctx)
+
+		done := make(chan error)
+		go func() {
+			waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+			defer waitCancel()
+			done <- b.BlockUntilConnected(waitCtx)
+		}()
+
+		// Still blocked while below the threshold.
+		select {
+		case <-done:
+			t.Fatal("BlockUntilConnected returned before threshold was met")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		lk.Lock()
+		peers = []peer.ID{requireRandPeerID(t), requireRandPeerID(t)}
+		lk.Unlock()
+
+		assert.NoError(<-done)
+	})
+
+	t.Run("Returns the context error on timeout", func(t *testing.T) {
+		assert := assert.New(t)
+		fakeDialer := &fakeDialer{PeersImpl: nopPeers}
+
+		b := NewBootstrapper([]pstore.PeerInfo{}, fakeHost, fakeDialer, fakeRouter, 1, 10*time.Millisecond)
+		b.Bootstrap = func([]peer.ID) {}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		b.Start(ctx)
+
+		waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer waitCancel()
+		assert.Equal(context.DeadlineExceeded, b.BlockUntilConnected(waitCtx))
+	})
+}
+
+func TestBootstrapperDebugDump(t *testing.T) {
+	assert := assert.New(t)
+	fakeHost := &fakeHost{ConnectImpl: nopConnect}
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	connectedPeer := requireRandPeerID(t)
+	lostPeer := requireRandPeerID(t)
+	bootstrapPeers := []pstore.PeerInfo{{ID: connectedPeer}, {ID: lostPeer}}
+
+	var lk sync.Mutex
+	peers := []peer.ID{connectedPeer, lostPeer}
+	fakeDialer := &fakeDialer{PeersImpl: func() []peer.ID {
+		lk.Lock()
+		defer lk.Unlock()
+		return peers
+	}}
+
+	b := NewBootstrapper(bootstrapPeers, fakeHost, fakeDialer, fakeRouter, 2, time.Minute)
+	b.RecentlyLostWindow = time.Minute
+	b.ctx = context.Background()
+	b.Bootstrap = func(currentPeers []peer.ID) {
+		b.trackLostPeers(currentPeers)
+	}
+
+	b.round()
+	lk.Lock()
+	peers = []peer.ID{connectedPeer}
+	lk.Unlock()
+	beforeSecondRound := time.Now()
+	b.round()
+
+	dump := b.DebugDump()
+	assert.Equal(2, dump.MinPeerThreshold)
+	assert.Equal(time.Minute, dump.Period)
+	assert.Equal(time.Minute, dump.RecentlyLostWindow)
+	assert.ElementsMatch([]string{connectedPeer.Pretty(), lostPeer.Pretty()}, dump.BootstrapPeers)
+	assert.Equal([]string{connectedPeer.Pretty()}, dump.ConnectedPeers)
+	assert.Len(dump.RecentlyLostPeers, 1)
+	assert.Contains(dump.RecentlyLostPeers, lostPeer.Pretty())
+	assert.False(dump.LastRound.Before(beforeSecondRound))
+	assert.True(dump.ThresholdReached)
+	assert.False(dump.ThresholdMet)
+
+	_, err := json.Marshal(dump)
+	assert.NoError(err)
+}
+
+func TestBootstrapperLiveness(t *testing.T) {
+	assert := assert.New(t)
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	deadPeer := requireRandPeerID(t)
+	livePeer := requireRandPeerID(t)
+	replacementPeer := requireRandPeerID(t)
+
+	// protects peers, closed and dialed
+	var lk sync.Mutex
+	peers := []peer.ID{deadPeer, livePeer}
+	var closed, dialed []peer.ID
+
+	fakeHost := &fakeHost{ConnectImpl: func(_ context.Context, pi pstore.PeerInfo) error {
+		lk.Lock()
+		defer lk.Unlock()
+		dialed = append(dialed, pi.ID)
+		return nil
+	}}
+	fakeDialer := &fakeDialer{
+		PeersImpl: func() []peer.ID {
+			lk.Lock()
+			defer lk.Unlock()
+			return append([]peer.ID{}, peers...)
+		},
+		ClosePeerImpl: func(p peer.ID) error {
+			lk.Lock()
+			defer lk.Unlock()
+			closed = append(closed, p)
+			return nil
+		},
+	}
+
+	b := NewBootstrapper([]pstore.PeerInfo{{ID: replacementPeer}}, fakeHost, fakeDialer, fakeRouter, 2, time.Minute)
+	b.ctx = context.Background()
+	b.LivenessFailureThreshold = 2
+	b.LivenessCheck = func(_ context.Context, p peer.ID) error {
+		if p == deadPeer {
+			return errors.New("no pong")
+		}
+		return nil
+	}
+
+	// The first failure only counts against the peer.
+	b.round()
+	lk.Lock()
+	assert.Empty(closed)
+	assert.Empty(dialed)
+	lk.Unlock()
+	assert.Equal(1, b.DebugDump().LivenessFailures[deadPeer.Pretty()])
+
+	// The second disconnects it and dials a replacement.
+	b.round()
+	lk.Lock()
+	assert.Equal([]peer.ID{deadPeer}, closed)
+	assert.Equal([]peer.ID{replacementPeer}, dialed)
+	lk.Unlock()
+	assert.Empty(b.DebugDump().LivenessFailures)
+}
+
+func TestBootstrapperSlowLivenessChecks(t *testing.T) {
+	assert := assert.New(t)
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	peers := []peer.ID{requireRandPeerID(t), requireRandPeerID(t), requireRandPeerID(t)}
+	b := NewBootstrapper([]pstore.PeerInfo{}, &fakeHost{ConnectImpl: panicConnect}, &fakeDialer{PeersImpl: nopPeers}, fakeRouter, 0, time.Minute)
+	b.ctx = context.Background()
+
+	started := make(chan struct{}, len(peers))
+	release := make(chan struct{})
+	b.LivenessCheck = func(context.Context, peer.ID) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+
+	done := make(chan []peer.ID)
+	go func() { done <- b.checkLiveness(peers) }()
+
+	// The checks run concurrently, and the Bootstrapper stays usable
+	// while they're in flight.
+	for range peers {
+		<-started
+	}
+	b.SetMinPeerThreshold(2)
+	assert.Equal(2, b.DebugDump().MinPeerThreshold)
+
+	close(release)
+	assert.Equal(peers, <-done)
+}
+
+func TestBootstrapperMaxPeerStats(t *testing.T) {
+	fakeHost := &fakeHost{ConnectImpl: panicConnect}
+	fakeDialer := &fakeDialer{PeersImpl: panicPeers}
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	bootstrapPeer := requireRandPeerID(t)
+	peers := []peer.ID{bootstrapPeer}
+	for i := 0; i < 5; i++ {
+		peers = append(peers, requireRandPeerID(t))
+	}
+
+	newBootstrapper := func() *Bootstrapper {
+		b := NewBootstrapper([]pstore.PeerInfo{{ID: bootstrapPeer}}, fakeHost, fakeDialer, fakeRouter, 0, time.Minute)
+		b.ctx = context.Background()
+		b.MaxPeerStats = 2
+		return b
+	}
+
+	t.Run("Bounds liveness failures", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b := newBootstrapper()
+		b.LivenessFailureThreshold = 100
+		b.LivenessCheck = func(context.Context, peer.ID) error { return errors.New("no pong") }
+		b.checkLiveness(peers)
+
+		// The bootstrap peer and the two most recently checked peers remain.
+		assert.Len(b.livenessFailures, 3)
+		assert.Contains(b.livenessFailures, bootstrapPeer)
+		assert.Contains(b.livenessFailures, peers[4])
+		assert.Contains(b.livenessFailures, peers[5])
+		assert.Len(b.peerStatsUpdated, 3)
+	})
+
+	t.Run("Bounds lost peers", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b := newBootstrapper()
+		b.RecentlyLostWindow = time.Minute
+		b.trackLostPeers(peers[3:])
+		b.trackLostPeers(peers[:3])
+		b.trackLostPeers([]peer.ID{})
+
+		// peers[3:] were lost first, so of the others only peers[1] and
+		// peers[2] are kept, along with the bootstrap peer.
+		assert.Len(b.lostPeers, 3)
+		assert.Contains(b.lostPeers, bootstrapPeer)
+		assert.Contains(b.lostPeers, peers[1])
+		assert.Contains(b.lostPeers, peers[2])
+	})
+
+	t.Run("Unbounded by default", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b := newBootstrapper()
+		b.MaxPeerStats = 0
+		b.LivenessFailureThreshold = 100
+		b.LivenessCheck = func(context.Context, peer.ID) error { return errors.New("no pong") }
+		b.checkLiveness(peers)
+
+		assert.Len(b.livenessFailures, len(peers))
+	})
+}
+
+// TestBootstrapperChaos drives bootstrap rounds with randomized connection
+// churn, thresholds and dial failures, checking invariants of every round.
+// Failures report the seed so they can be reproduced.
+func TestBootstrapperChaos(t *testing.T) {
+	const numBootstrapPeers = 8
+	const rounds = 200
+
+	for seed := int64(0); seed < 10; seed++ {
+		seed := seed
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			require := require.New(t)
+			rng := rand.New(rand.NewSource(seed))
+
+			var bootstrapPeers []pstore.PeerInfo
+			var allPeers []peer.ID
+			for i := 0; i < numBootstrapPeers; i++ {
+				p := requireRandPeerID(t)
+				bootstrapPeers = append(bootstrapPeers, pstore.PeerInfo{ID: p})
+				allPeers = append(allPeers, p)
+			}
+			// Peers that aren't bootstrap peers but may be connected anyway.
+			for i := 0; i < 4; i++ {
+				allPeers = append(allPeers, requireRandPeerID(t))
+			}
+
+			// lk protects the fields below, which dials update concurrently.
+			var lk sync.Mutex
+			connected := make(map[peer.ID]bool)
+			var dialed []peer.ID
+			var inFlight, maxInFlight int
+			failDials := false
+
+			connect := func(_ context.Context, pi pstore.PeerInfo) error {
+				lk.Lock()
+				dialed = append(dialed, pi.ID)
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				fail := failDials
+				lk.Unlock()
+
+				// Hold the dial slot a while, so that dials overlap.
+				time.Sleep(500 * time.Microsecond)
+				defer func() {
+					lk.Lock()
+					inFlight--
+					lk.Unlock()
+				}()
+				if fail {
+					return errors.New("dial failed")
+				}
+				lk.Lock()
+				connected[pi.ID] = true
+				lk.Unlock()
+				return nil
+			}
+
+			fakeHost := &fakeHost{ConnectImpl: connect}
+			fakeDialer := &fakeDialer{PeersImpl: panicPeers}
+			fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+			b := NewBootstrapper(bootstrapPeers, fakeHost, fakeDialer, fakeRouter, 0, time.Minute)
+			b.RecentlyLostWindow = time.Minute
+			b.ctx = context.Background()
+			// sawCap is whether any round had as many dials in flight as allowed.
+			sawCap := false
+
+			for round := 0; round < rounds; round++ {
+				lk.Lock()
+				// Randomly drop and gain connections.
+				for _, p := range allPeers {
+					switch rng.Intn(6) {
+					case 0:
+						delete(connected, p)
+					case 1:
+						connected[p] = true
+					}
+				}
+				var currentPeers []peer.ID
+				for _, p := range allPeers {
+					if connected[p] {
+						currentPeers = append(currentPeers, p)
+					}
+				}
+				failDials = rng.Intn(3) == 0
+				dialed = nil
+				maxInFlight = 0
+				lk.Unlock()
+
+				b.MinPeerThreshold = rng.Intn(len(allPeers) + 1)
+				b.MaxConcurrentDials = 1 + rng.Intn(3)
+				b.bootstrap(currentPeers)
+
+				lk.Lock()
+				peersNeeded := b.MinPeerThreshold - len(currentPeers)
+				if peersNeeded < 0 {
+					peersNeeded = 0
+				}
+				require.True(len(dialed) <= peersNeeded, "round %d: dialed %d peers but only needed %d", round, len(dialed), peersNeeded)
+				require.True(maxInFlight <= b.MaxConcurrentDials, "round %d: %d concurrent dials but at most %d allowed", round, maxInFlight, b.MaxConcurrentDials)
+				sawCap = sawCap || (maxInFlight == b.MaxConcurrentDials && len(dialed) > b.MaxConcurrentDials)
+				for i, p := range dialed {
+					require.False(hasPID(currentPeers, p), "round %d: dialed already connected peer %s", round, p.Pretty())
+					require.True(b.IsBootstrapPeer(p), "round %d: dialed non-bootstrap peer %s", round, p.Pretty())
+					require.False(hasPID(dialed[:i], p), "round %d: dialed peer %s twice", round, p.Pretty())
+				}
+				lk.Unlock()
+			}
+			require.True(sawCap, "no round had dials waiting for a slot")
+		})
+	}
+}
+
+func TestBootstrapperPeerProvider(t *testing.T) {
+	fakeDialer := &fakeDialer{PeersImpl: panicPeers}
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	staticPeer := requireRandPeerID(t)
+	firstPeer := requireRandPeerID(t)
+	secondPeer := requireRandPeerID(t)
+
+	// protects dialed
+	var lk sync.Mutex
+	var dialed []peer.ID
+	fakeHost := &fakeHost{ConnectImpl: func(_ context.Context, pi pstore.PeerInfo) error {
+		lk.Lock()
+		defer lk.Unlock()
+		dialed = append(dialed, pi.ID)
+		return nil
+	}}
+	// round runs a round with no connected peers, returning the peers dialed.
+	round := func(b *Bootstrapper) []peer.ID {
+		lk.Lock()
+		dialed = nil
+		lk.Unlock()
+
+		b.bootstrap([]peer.ID{})
+
+		lk.Lock()
+		defer lk.Unlock()
+		return dialed
+	}
+
+	t.Run("Uses the latest successfully fetched peers", func(t *testing.T) {
+		assert := assert.New(t)
+
+		responses := []struct {
+			peers []pstore.PeerInfo
+			err   error
+		}{
+			{nil, errors.New("config service unavailable")},
+			{[]pstore.PeerInfo{{ID: firstPeer}}, nil},
+			{nil, errors.New("config service unavailable")},
+			{[]pstore.PeerInfo{{ID: secondPeer}}, nil},
+		}
+		fetches := 0
+
+		b := NewBootstrapper([]pstore.PeerInfo{{ID: staticPeer}}, fakeHost, fakeDialer, fakeRouter, 1, time.Minute)
+		b.ctx = context.Background()
+		b.PeerProvider = func(context.Context) ([]pstore.PeerInfo, error) {
+			resp := responses[fetches]
+			fetches++
+			return resp.peers, resp.err
+		}
+
+		assert.Equal([]peer.ID{staticPeer}, round(b))
+		assert.Equal([]peer.ID{firstPeer}, round(b))
+		assert.Equal([]peer.ID{firstPeer}, round(b))
+		assert.Equal([]peer.ID{secondPeer}, round(b))
+		assert.Equal(4, fetches)
+		assert.True(b.IsBootstrapPeer(secondPeer))
+		assert.False(b.IsBootstrapPeer(staticPeer))
+	})
+
+	t.Run("Caches fetched peers for the TTL", func(t *testing.T) {
+		assert := assert.New(t)
+
+		fetches := 0
+		b := NewBootstrapper([]pstore.PeerInfo{{ID: staticPeer}}, fakeHost, fakeDialer, fakeRouter, 1, time.Minute)
+		b.ctx = context.Background()
+		b.PeerProviderTTL = 20 * time.Millisecond
+		b.PeerProvider = func(context.Context) ([]pstore.PeerInfo, error) {
+			fetches++
+			if fetches == 1 {
+				return []pstore.PeerInfo{{ID: firstPeer}}, nil
+			}
+			return []pstore.PeerInfo{{ID: secondPeer}}, nil
+		}
+
+		assert.Equal([]peer.ID{firstPeer}, round(b))
+		assert.Equal([]peer.ID{firstPeer}, round(b))
+		assert.Equal(1, fetches)
+
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal([]peer.ID{secondPeer}, round(b))
+		assert.Equal(2, fetches)
+	})
+}
+
+func TestBootstrapperVerifyConnectedness(t *testing.T) {
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	connectedPeer := requireRandPeerID(t)
+	halfOpenPeer := requireRandPeerID(t)
+	fakeDialer := &fakeDialer{PeersImpl: func() []peer.ID { return []peer.ID{connectedPeer, halfOpenPeer} }}
+	fakeHost := &fakeHost{
+		ConnectImpl: nopConnect,
+		NetworkImpl: &fakeNetwork{ConnectednessImpl: func(p peer.ID) inet.Connectedness {
+			if p == connectedPeer {
+				return inet.Connected
+			}
+			return inet.CanConnect
+		}},
+	}
+
+	t.Run("Counts only peers the host considers connected", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b := NewBootstrapper([]pstore.PeerInfo{}, fakeHost, fakeDialer, fakeRouter, 2, time.Minute)
+		b.VerifyConnectedness = true
+		var currentPeers []peer.ID
+		b.Bootstrap = func(peers []peer.ID) { currentPeers = peers }
+
+		b.round()
+		assert.Equal([]peer.ID{connectedPeer}, currentPeers)
+
+		dump := b.DebugDump()
+		assert.Equal([]string{connectedPeer.Pretty()}, dump.ConnectedPeers)
+		assert.False(dump.ThresholdMet)
+		assert.False(dump.ThresholdReached)
+	})
+
+	t.Run("Trusts the dialer by default", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b := NewBootstrapper([]pstore.PeerInfo{}, fakeHost, fakeDialer, fakeRouter, 2, time.Minute)
+		var currentPeers []peer.ID
+		b.Bootstrap = func(peers []peer.ID) { currentPeers = peers }
+
+		b.round()
+		assert.Equal([]peer.ID{connectedPeer, halfOpenPeer}, currentPeers)
+		assert.True(b.DebugDump().ThresholdReached)
+	})
+}
+
+func TestBootstrapperChainHeadCheck(t *testing.T) {
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	syncedPeer := requireRandPeerID(t)
+	forkedPeer := requireRandPeerID(t)
+	fakeDialer := &fakeDialer{PeersImpl: func() []peer.ID { return []peer.ID{syncedPeer, forkedPeer} }}
+	onOurChain := func(p peer.ID) bool { return p != forkedPeer }
+
+	t.Run("Doesn't count peers on another chain toward the threshold", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b := NewBootstrapper([]pstore.PeerInfo{}, &fakeHost{ConnectImpl: nopConnect}, fakeDialer, fakeRouter, 2, time.Minute)
+		b.ChainHeadCheck = onOurChain
+		b.Bootstrap = func([]peer.ID) {}
+
+		b.round()
+		dump := b.DebugDump()
+		assert.Len(dump.ConnectedPeers, 2)
+		assert.False(dump.ThresholdMet)
+		assert.False(dump.ThresholdReached)
+
+		b.ChainHeadCheck = nil
+		b.round()
+		assert.True(b.DebugDump().ThresholdReached)
+	})
+
+	t.Run("Dials to replace peers on another chain", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var lk sync.Mutex
+		var dialed []peer.ID
+		fakeHost := &fakeHost{ConnectImpl: func(_ context.Context, pinfo pstore.PeerInfo) error {
+			lk.Lock()
+			defer lk.Unlock()
+			dialed = append(dialed, pinfo.ID)
+			return nil
+		}}
+		bootstrapPeer := requireRandPeerID(t)
+
+		b := NewBootstrapper([]pstore.PeerInfo{{ID: syncedPeer}, {ID: forkedPeer}, {ID: bootstrapPeer}}, fakeHost, fakeDialer, fakeRouter, 2, time.Minute)
+		b.ChainHeadCheck = onOurChain
+		b.ctx = context.Background()
+		b.bootstrap([]peer.ID{syncedPeer, forkedPeer})
+
+		lk.Lock()
+		defer lk.Unlock()
+		assert.Equal([]peer.ID{bootstrapPeer}, dialed)
+	})
+}
+
+func TestBootstrapperEventBus(t *testing.T) {
+	assert := assert.New(t)
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	bootstrapPeer := requireRandPeerID(t)
+	dialErr := errors.New("unreachable")
+
+	// protects peers and failDials
+	var lk sync.Mutex
+	var peers []peer.ID
+	failDials := false
+
+	fakeHost := &fakeHost{ConnectImpl: func(_ context.Context, pi pstore.PeerInfo) error {
+		lk.Lock()
+		defer lk.Unlock()
+		if failDials {
+			return dialErr
+		}
+		peers = append(peers, pi.ID)
+		return nil
+	}}
+	fakeDialer := &fakeDialer{PeersImpl: func() []peer.ID {
+		lk.Lock()
+		defer lk.Unlock()
+		return append([]peer.ID{}, peers...)
+	}}
+
+	bus := pubsub.New(16)
+	defer bus.Shutdown()
+	events := bus.Sub(BootstrapEventsTopic)
+
+	b := NewBootstrapper([]pstore.PeerInfo{{ID: bootstrapPeer}}, fakeHost, fakeDialer, fakeRouter, 1, time.Minute)
+	b.ctx = context.Background()
+	b.EventBus = bus
+
+	// The first round connects to the bootstrap peer, meeting the threshold.
+	b.round()
+	assert.Equal(RoundStarted{ConnectedPeers: 0}, <-events)
+	assert.Equal(PeerConnected{Peer: bootstrapPeer}, <-events)
+	assert.Equal(ThresholdReached{PeerCount: 1}, <-events)
+
+	// Nothing changes in the second, so only the round is published.
+	b.round()
+	assert.Equal(RoundStarted{ConnectedPeers: 1}, <-events)
+
+	// The peer drops and can't be reconnected to.
+	lk.Lock()
+	peers = nil
+	failDials = true
+	lk.Unlock()
+	b.round()
+	assert.Equal(RoundStarted{ConnectedPeers: 0}, <-events)
+	assert.Equal(PeerFailed{Peer: bootstrapPeer, Err: dialErr}, <-events)
+	assert.Equal(ThresholdLost{PeerCount: 0}, <-events)
+
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %#v", event)
+	default:
+	}
+}
+
+func TestBootstrapperEvents(t *testing.T) {
+	t.Run("delivers events", func(t *testing.T) {
+		assert := assert.New(t)
+		fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+		bootstrapPeer := requireRandPeerID(t)
+		b := NewBootstrapper([]pstore.PeerInfo{{ID: bootstrapPeer}}, &fakeHost{ConnectImpl: nopConnect}, &fakeDialer{PeersImpl: nopPeers}, fakeRouter, 1, time.Minute)
+		b.ctx = context.Background()
+		events := b.Events()
+		assert.Equal(events, b.Events())
+
+		b.round()
+		assert.Equal(RoundStarted{ConnectedPeers: 0}, <-events)
+		assert.Equal(PeerConnected{Peer: bootstrapPeer}, <-events)
+	})
+
+	t.Run("drops events rather than blocking", func(t *testing.T) {
+		assert := assert.New(t)
+		fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+		var bootstrapPeers []pstore.PeerInfo
+		for i := 0; i < 2*eventsBufferSize; i++ {
+			bootstrapPeers = append(bootstrapPeers, pstore.PeerInfo{ID: requireRandPeerID(t)})
+		}
+		b := NewBootstrapper(bootstrapPeers, &fakeHost{ConnectImpl: nopConnect}, &fakeDialer{PeersImpl: nopPeers}, fakeRouter, len(bootstrapPeers), time.Minute)
+		b.ctx = context.Background()
+		events := b.Events()
+
+		b.round()
+		assert.Len(events, eventsBufferSize)
+	})
+}
+
+func TestBootstrapperStatus(t *testing.T) {
+	assert := assert.New(t)
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	// protects peers
+	var lk sync.Mutex
+	var peers []peer.ID
+	setPeers := func(ps ...peer.ID) {
+		lk.Lock()
+		defer lk.Unlock()
+		peers = ps
+	}
+	fakeDialer := &fakeDialer{PeersImpl: func() []peer.ID {
+		lk.Lock()
+		defer lk.Unlock()
+		return peers
+	}}
+
+	b := NewBootstrapper([]pstore.PeerInfo{}, &fakeHost{ConnectImpl: nopConnect}, fakeDialer, fakeRouter, 1, time.Hour)
+	b.WarmUpPeriod = 50 * time.Millisecond
+	assert.Equal(BootstrapperStopped, b.Status())
+
+	b.Start(context.Background())
+	assert.Equal(BootstrapperWarmingUp, b.Status())
+
+	setPeers(requireRandPeerID(t))
+	assert.Equal(BootstrapperThresholdMet, b.Status())
+
+	setPeers()
+	assert.Equal(BootstrapperWarmingUp, b.Status())
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(BootstrapperThresholdNotMet, b.Status())
+	assert.Equal("threshold not met", b.Status().String())
+
+	b.Stop()
+	assert.Equal(BootstrapperStopped, b.Status())
+}
+
+func TestBootstrapperHandshakeTimeout(t *testing.T) {
+	assert := assert.New(t)
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	// protects closed
+	var lk sync.Mutex
+	var closed []peer.ID
+	fakeDialer := &fakeDialer{
+		PeersImpl: panicPeers,
+		ClosePeerImpl: func(p peer.ID) error {
+			lk.Lock()
+			defer lk.Unlock()
+			closed = append(closed, p)
+			return nil
+		},
+	}
+
+	slowPeer := requireRandPeerID(t)
+	goodPeer := requireRandPeerID(t)
+	b := NewBootstrapper([]pstore.PeerInfo{{ID: slowPeer}, {ID: goodPeer}}, &fakeHost{ConnectImpl: nopConnect}, fakeDialer, fakeRouter, 2, time.Minute)
+	b.ctx = context.Background()
+	b.ConnectionTimeout = time.Hour
+	b.HandshakeTimeout = 20 * time.Millisecond
+
+	var handshakeErr error
+	b.Handshake = func(ctx context.Context, p peer.ID) error {
+		if p == goodPeer {
+			return nil
+		}
+		// Never completes.
+		<-ctx.Done()
+		lk.Lock()
+		defer lk.Unlock()
+		handshakeErr = ctx.Err()
+		return ctx.Err()
+	}
+
+	start := time.Now()
+	b.bootstrap([]peer.ID{})
+	assert.True(time.Since(start) < time.Second)
+
+	lk.Lock()
+	defer lk.Unlock()
+	assert.Equal(context.DeadlineExceeded, handshakeErr)
+	assert.Equal([]peer.ID{slowPeer}, closed)
+}
+
+func TestBootstrapperObserverMode(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	// protects probed and closed
+	var lk sync.Mutex
+	probed := map[peer.ID]bool{}
+	closed := map[peer.ID]bool{}
+	fakeDialer := &fakeDialer{
+		PeersImpl: func() []peer.ID { return []peer.ID{requireRandPeerID(t)} },
+		ClosePeerImpl: func(p peer.ID) error {
+			lk.Lock()
+			defer lk.Unlock()
+			closed[p] = true
+			return nil
+		},
+	}
+
+	peers := []pstore.PeerInfo{{ID: requireRandPeerID(t)}, {ID: requireRandPeerID(t)}}
+	b := NewBootstrapper(peers, &fakeHost{ConnectImpl: nopConnect}, fakeDialer, fakeRouter, 2, time.Minute)
+	b.ctx = context.Background()
+	b.ObserverMode = true
+	b.Handshake = func(_ context.Context, p peer.ID) error {
+		lk.Lock()
+		defer lk.Unlock()
+		probed[p] = true
+		return nil
+	}
+
+	// The connected peer the dialer reports doesn't count, so the round
+	// dials both bootstrap peers as if no peers were connected.
+	b.round()
+
+	lk.Lock()
+	defer lk.Unlock()
+	assert.Equal(map[peer.ID]bool{peers[0].ID: true, peers[1].ID: true}, probed)
+	assert.Equal(probed, closed)
+
+	observed := b.ObservedPeers()
+	require.Len(observed, 2)
+	for _, op := range observed {
+		assert.True(hasPeerInfo(peers, op.Info.ID))
+		assert.False(op.ObservedAt.IsZero())
+	}
+	assert.False(b.DebugDump().ThresholdMet)
+}
+
+func TestBootstrapperWhyNotConnected(t *testing.T) {
+	assert := assert.New(t)
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	connectedPeer := requireRandPeerID(t)
+	failingPeer := requireRandPeerID(t)
+	dialingPeer := requireRandPeerID(t)
+	idlePeer := requireRandPeerID(t)
+
+	dialStarted := make(chan struct{})
+	release := make(chan struct{})
+	connect := func(_ context.Context, pi pstore.PeerInfo) error {
+		switch pi.ID {
+		case failingPeer:
+			return errors.New("connection refused")
+		case dialingPeer:
+			close(dialStarted)
+			<-release
+		}
+		return nil
+	}
+	fakeDialer := &fakeDialer{PeersImpl: func() []peer.ID { return []peer.ID{connectedPeer} }}
+
+	bootstrapPeers := []pstore.PeerInfo{{ID: connectedPeer}, {ID: failingPeer}, {ID: dialingPeer}, {ID: idlePeer}}
+	b := NewBootstrapper(bootstrapPeers, &fakeHost{ConnectImpl: connect}, fakeDialer, fakeRouter, 4, time.Minute)
+	b.ctx = context.Background()
+	// Failed peers are backed off for a period by default.
+	assert.Equal(time.Minute, b.DialBackoff)
+	now := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+
+	// Only failingPeer is needed.
+	b.bootstrap([]peer.ID{connectedPeer, dialingPeer, idlePeer})
+	assert.Equal("last dial at 2019-03-01T12:00:00Z failed: connection refused; backing off until 2019-03-01T12:01:00Z after 1 failed dials", b.WhyNotConnected(failingPeer))
+	now = now.Add(time.Minute)
+	assert.Equal("last dial at 2019-03-01T12:00:00Z failed: connection refused; dialed again when fewer than 4 peers are connected", b.WhyNotConnected(failingPeer))
+	assert.Equal("not dialed while at least 4 peers are connected", b.WhyNotConnected(idlePeer))
+
+	// Only dialingPeer is needed.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.bootstrap([]peer.ID{connectedPeer, failingPeer, idlePeer})
+	}()
+	<-dialStarted
+	assert.Equal("currently dialing", b.WhyNotConnected(dialingPeer))
+	close(release)
+	<-done
+	assert.Equal("not dialed while at least 4 peers are connected", b.WhyNotConnected(dialingPeer))
+
+	assert.Equal("connected", b.WhyNotConnected(connectedPeer))
+	assert.Equal("not a bootstrap peer or good peer, so never dialed", b.WhyNotConnected(requireRandPeerID(t)))
+}
+
+func TestBootstrapperDialBackoff(t *testing.T) {
+	assert := assert.New(t)
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	failingPeer := requireRandPeerID(t)
+	healthyPeer := requireRandPeerID(t)
+
+	// protects failing and dials
+	var lk sync.Mutex
+	failing := true
+	dials := map[peer.ID]int{}
+	connect := func(_ context.Context, pi pstore.PeerInfo) error {
+		lk.Lock()
+		defer lk.Unlock()
+		dials[pi.ID]++
+		if pi.ID == failingPeer && failing {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	fakeDialer := &fakeDialer{PeersImpl: nopPeers}
+
+	bootstrapPeers := []pstore.PeerInfo{{ID: failingPeer}, {ID: healthyPeer}}
+	b := NewBootstrapper(bootstrapPeers, &fakeHost{ConnectImpl: connect}, fakeDialer, fakeRouter, 2, time.Minute)
+	b.DialBackoff = time.Minute
+	b.MaxDialBackoff = 4 * time.Minute
+	b.ctx = context.Background()
+	now := time.Unix(1000, 0)
+	b.now = func() time.Time { return now }
+
+	// Run a round a minute, recording the minutes failingPeer is dialed in.
+	var dialedAt []int
+	runRounds := func(from, to int) {
+		for minute := from; minute < to; minute++ {
+			lk.Lock()
+			before := dials[failingPeer]
+			lk.Unlock()
+			b.bootstrap([]peer.ID{})
+			lk.Lock()
+			if dials[failingPeer] > before {
+				dialedAt = append(dialedAt, minute)
+			}
+			lk.Unlock()
+			now = now.Add(time.Minute)
+		}
+	}
+
+	// The wait between dials doubles, up to MaxDialBackoff.
+	runRounds(0, 15)
+	assert.Equal([]int{0, 1, 3, 7, 11}, dialedAt)
+	// The healthy peer isn't backed off.
+	assert.Equal(15, dials[healthyPeer])
+
+	// A successful dial resets the backoff.
+	lk.Lock()
+	failing = false
+	lk.Unlock()
+	dialedAt = nil
+	runRounds(15, 17)
+	lk.Lock()
+	failing = true
+	lk.Unlock()
+	runRounds(17, 21)
+	assert.Equal([]int{15, 16, 17, 18, 20}, dialedAt)
+}
+
+func TestBootstrapperMaxConcurrentDials(t *testing.T) {
+	assert := assert.New(t)
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	// protects inFlight, maxInFlight and dialed
+	var lk sync.Mutex
+	var inFlight, maxInFlight, dialed int
+	release := make(chan struct{})
+	connect := func(context.Context, pstore.PeerInfo) error {
+		lk.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		lk.Unlock()
+
+		<-release
+
+		lk.Lock()
+		defer lk.Unlock()
+		inFlight--
+		dialed++
+		return nil
+	}
+	fakeDialer := &fakeDialer{PeersImpl: nopPeers}
+
+	var bootstrapPeers []pstore.PeerInfo
+	for i := 0; i < 20; i++ {
+		bootstrapPeers = append(bootstrapPeers, pstore.PeerInfo{ID: requireRandPeerID(t)})
+	}
+	b := NewBootstrapper(bootstrapPeers, &fakeHost{ConnectImpl: connect}, fakeDialer, fakeRouter, 20, time.Minute)
+	b.MaxConcurrentDials = 3
+	b.ctx = context.Background()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.bootstrap([]peer.ID{})
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	lk.Lock()
+	assert.Equal(3, inFlight)
+	lk.Unlock()
+
+	close(release)
+	<-done
+	assert.Equal(3, maxInFlight)
+	assert.Equal(20, dialed)
+}
+
+func TestBootstrapperPeriodJitter(t *testing.T) {
+	t.Run("intervals fall within the jittered range", func(t *testing.T) {
+		assert := assert.New(t)
+		fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+		b := NewBootstrapper([]pstore.PeerInfo{}, &fakeHost{ConnectImpl: nopConnect}, &fakeDialer{PeersImpl: nopPeers}, fakeRouter, 1, time.Minute)
+		assert.Equal(time.Minute, b.nextPeriod())
+
+		b.PeriodJitter = 0.2
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 100; i++ {
+			period := b.nextPeriod()
+			assert.True(period >= 48*time.Second && period <= 72*time.Second, "period %s", period)
+			seen[period] = true
+		}
+		assert.True(len(seen) > 1)
+	})
+
+	t.Run("rounds run with jitter", func(t *testing.T) {
+		fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+		rounds := make(chan struct{}, 3)
+		b := NewBootstrapper([]pstore.PeerInfo{}, &fakeHost{ConnectImpl: nopConnect}, &fakeDialer{PeersImpl: nopPeers}, fakeRouter, 1, 10*time.Millisecond)
+		b.PeriodJitter = 0.5
+		b.Bootstrap = func([]peer.ID) {
+			select {
+			case rounds <- struct{}{}:
+			default:
+			}
+		}
+		b.Start(context.Background())
+		defer b.Stop()
+
+		for i := 0; i < 3; i++ {
+			<-rounds
+		}
+	})
+}
+
+func TestBootstrapperTimeToFirstPeer(t *testing.T) {
+	assert := assert.New(t)
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	// protects now and peers
+	var lk sync.Mutex
+	now := time.Unix(1000, 0)
+	var peers []peer.ID
+	fakeDialer := &fakeDialer{PeersImpl: func() []peer.ID {
+		lk.Lock()
+		defer lk.Unlock()
+		return peers
+	}}
+	advance := func(d time.Duration) {
+		lk.Lock()
+		defer lk.Unlock()
+		now = now.Add(d)
+	}
+
+	b := NewBootstrapper([]pstore.PeerInfo{}, &fakeHost{ConnectImpl: nopConnect}, fakeDialer, fakeRouter, 1, time.Hour)
+	b.Bootstrap = func([]peer.ID) {}
+	b.now = func() time.Time {
+		lk.Lock()
+		defer lk.Unlock()
+		return now
+	}
+	b.Start(context.Background())
+	defer b.Stop()
+
+	for i := 0; i < 3; i++ {
+		advance(5 * time.Second)
+		b.round()
+		_, ok := b.TimeToFirstPeer()
+		assert.False(ok)
+	}
+
+	lk.Lock()
+	peers = []peer.ID{requireRandPeerID(t)}
+	lk.Unlock()
+	advance(5 * time.Second)
+	b.round()
+
+	ttfp, ok := b.TimeToFirstPeer()
+	assert.True(ok)
+	assert.Equal(20*time.Second, ttfp)
+
+	// Later rounds don't change it.
+	advance(5 * time.Second)
+	b.round()
+	ttfp, _ = b.TimeToFirstPeer()
+	assert.Equal(20*time.Second, ttfp)
+}
+
+func TestBootstrapperIsBootstrapPeer(t *testing.T) {
+	assert := assert.New(t)
+	fakeHost := &fakeHost{ConnectImpl: panicConnect}
+	fakeDialer := &fakeDialer{PeersImpl: panicPeers}
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	bootstrapPeer := requireRandPeerID(t)
+	b := NewBootstrapper([]pstore.PeerInfo{{ID: bootstrapPeer}}, fakeHost, fakeDialer, fakeRouter, 1, time.Minute)
+
+	assert.True(b.IsBootstrapPeer(bootstrapPeer))
+	assert.False(b.IsBootstrapPeer(requireRandPeerID(t)))
+}
+
+type recordedSpan struct {
+	name     string
+	parent   *recordedSpan
+	tags     map[string]interface{}
+	finished bool
+	err      error
+}
+
+// recordingTracer records every span it starts, and the span in the context
+// each was started from.
+type recordingTracer struct {
+	lk    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpanKey struct{}
+
+func (rt *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	rt.lk.Lock()
+	defer rt.lk.Unlock()
+
+	parent, _ := ctx.Value(recordedSpanKey{}).(*recordedSpan)
+	s := &recordedSpan{name: name, parent: parent, tags: make(map[string]interface{})}
+	rt.spans = append(rt.spans, s)
+	return context.WithValue(ctx, recordedSpanKey{}, s), &recordingSpan{rt: rt, s: s}
+}
+
+type recordingSpan struct {
+	rt *recordingTracer
+	s  *recordedSpan
+}
+
+func (rs *recordingSpan) SetTag(key string, value interface{}) {
+	rs.rt.lk.Lock()
+	defer rs.rt.lk.Unlock()
+	rs.s.tags[key] = value
+}
+
+func (rs *recordingSpan) Finish(err error) {
+	rs.rt.lk.Lock()
+	defer rs.rt.lk.Unlock()
+	rs.s.finished = true
+	rs.s.err = err
+}
+
+func TestBootstrapperTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	goodPeer := requireRandPeerID(t)
+	badPeer := requireRandPeerID(t)
+	dialErr := errors.New("unreachable")
+	connect := func(_ context.Context, pi pstore.PeerInfo) error {
+		if pi.ID == badPeer {
+			return dialErr
+		}
+		return nil
+	}
+	fakeHost := &fakeHost{ConnectImpl: connect}
+	fakeDialer := &fakeDialer{PeersImpl: panicPeers}
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	tracer := &recordingTracer{}
+	b := NewBootstrapper([]pstore.PeerInfo{{ID: goodPeer}, {ID: badPeer}}, fakeHost, fakeDialer, fakeRouter, 2, time.Minute)
+	b.Tracer = tracer
+	b.ctx = context.Background()
+	b.bootstrap([]peer.ID{})
+
+	tracer.lk.Lock()
+	defer tracer.lk.Unlock()
+	if !assert.Len(tracer.spans, 3) {
+		return
+	}
+
+	round := tracer.spans[0]
+	assert.Equal("Bootstrapper.bootstrap", round.name)
+	assert.Nil(round.parent)
+	assert.True(round.finished)
+	assert.Equal(0, round.tags["connected_peers"])
+	assert.Equal(2, round.tags["dials"])
+
+	outcomes := make(map[string]interface{})
+	for _, dial := range tracer.spans[1:] {
+		assert.Equal("Bootstrapper.dial", dial.name)
+		assert.Equal(round, dial.parent)
+		assert.True(dial.finished)
+		outcomes[dial.tags["peer"].(string)] = dial.tags["outcome"]
+		if dial.tags["peer"] == badPeer.Pretty() {
+			assert.Equal(dialErr, dial.err)
+		} else {
+			assert.NoError(dial.err)
+		}
+	}
+	assert.Equal(map[string]interface{}{
+		goodPeer.Pretty(): "connected",
+		badPeer.Pretty():  "failed",
+	}, outcomes)
+}
+
 func TestBootstrapperBootstrap(t *testing.T) {
 	t.Run("Doesn't connect if already have enough peers", func(t *testing.T) {
 		assert := assert.New(t)
@@ -132,4 +1351,515 @@ func TestBootstrapperBootstrap(t *testing.T) {
 		assert.Equal(0, connectCount)
 		lk.Unlock()
 	})
+	t.Run("Doesn't dial duplicate peers", func(t *testing.T) {
+		assert := assert.New(t)
+		fakeHost := &fakeHost{ConnectImpl: countingConnect}
+		lk.Lock()
+		connectCount = 0
+		lk.Unlock()
+		fakeDialer := &fakeDialer{PeersImpl: panicPeers}
+		fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+		peerA, peerB := requireRandPeerID(t), requireRandPeerID(t)
+		bootstrapPeers := []pstore.PeerInfo{{ID: peerA}, {ID: peerB}, {ID: peerA}, {ID: peerB}, {ID: peerA}}
+
+		b := NewBootstrapper(bootstrapPeers, fakeHost, fakeDialer, fakeRouter, 5, time.Minute)
+		b.ctx = context.Background()
+		assert.Len(b.candidates(), 2)
+		b.bootstrap([]peer.ID{})
+		lk.Lock()
+		assert.Equal(2, connectCount)
+		lk.Unlock()
+	})
+
+	t.Run("Doesn't dial itself", func(t *testing.T) {
+		assert := assert.New(t)
+		self := requireRandPeerID(t)
+		fakeHost := &fakeHost{ConnectImpl: countingConnect, IDImpl: self}
+		lk.Lock()
+		connectCount = 0
+		lk.Unlock()
+		fakeDialer := &fakeDialer{PeersImpl: panicPeers}
+		fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+		connectedPeerID := requireRandPeerID(t)
+		bootstrapPeers := []pstore.PeerInfo{{ID: self}, {ID: connectedPeerID}, {ID: requireRandPeerID(t)}}
+
+		b := NewBootstrapper(bootstrapPeers, fakeHost, fakeDialer, fakeRouter, 3, time.Minute)
+		b.ctx = context.Background()
+		assert.False(b.IsBootstrapPeer(self))
+		// The already connected peer isn't dialed either.
+		b.bootstrap([]peer.ID{connectedPeerID})
+		lk.Lock()
+		assert.Equal(1, connectCount)
+		lk.Unlock()
+	})
+
+	t.Run("Dials recently lost peers first", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var dialed []peer.ID
+		recordingConnect := func(_ context.Context, pi pstore.PeerInfo) error {
+			lk.Lock()
+			defer lk.Unlock()
+			dialed = append(dialed, pi.ID)
+			return nil
+		}
+		fakeHost := &fakeHost{ConnectImpl: recordingConnect}
+		fakeDialer := &fakeDialer{PeersImpl: panicPeers}
+		fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+		var bootstrapPeers []pstore.PeerInfo
+		for i := 0; i < 10; i++ {
+			bootstrapPeers = append(bootstrapPeers, pstore.PeerInfo{ID: requireRandPeerID(t)})
+		}
+		lostPeer := bootstrapPeers[7].ID
+
+		b := NewBootstrapper(bootstrapPeers, fakeHost, fakeDialer, fakeRouter, 1, time.Minute)
+		b.RecentlyLostWindow = time.Minute
+		b.ctx = context.Background()
+
+		// Connected to the peer in the first round, so nothing is dialed.
+		b.bootstrap([]peer.ID{lostPeer})
+		// The peer drops; it should be the one peer dialed on the next round.
+		b.bootstrap([]peer.ID{})
+		time.Sleep(20 * time.Millisecond)
+
+		lk.Lock()
+		defer lk.Unlock()
+		assert.Equal([]peer.ID{lostPeer}, dialed)
+	})
+
+	t.Run("Dials good peers first", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var dialed []peer.ID
+		recordingConnect := func(_ context.Context, pi pstore.PeerInfo) error {
+			lk.Lock()
+			defer lk.Unlock()
+			dialed = append(dialed, pi.ID)
+			return nil
+		}
+		fakeHost := &fakeHost{ConnectImpl: recordingConnect}
+		fakeDialer := &fakeDialer{PeersImpl: panicPeers}
+		fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+		var bootstrapPeers []pstore.PeerInfo
+		for i := 0; i < 10; i++ {
+			bootstrapPeers = append(bootstrapPeers, pstore.PeerInfo{ID: requireRandPeerID(t)})
+		}
+		syncPeer := requireRandPeerID(t)
+
+		b := NewBootstrapper(bootstrapPeers, fakeHost, fakeDialer, fakeRouter, 1, time.Minute)
+		b.ctx = context.Background()
+		b.AddGoodPeer(bootstrapPeers[3].ID)
+		b.AddGoodPeer(syncPeer)
+
+		candidates := b.candidates()
+		assert.Equal(syncPeer, candidates[0].ID)
+		assert.Equal(bootstrapPeers[3], candidates[1])
+		assert.Len(candidates, 11)
+
+		// Only the most recently added good peer is needed.
+		b.bootstrap([]peer.ID{})
+		lk.Lock()
+		defer lk.Unlock()
+		assert.Equal([]peer.ID{syncPeer}, dialed)
+	})
+
+	t.Run("Forgets lost peers outside the window", func(t *testing.T) {
+		assert := assert.New(t)
+		fakeHost := &fakeHost{ConnectImpl: nopConnect}
+		fakeDialer := &fakeDialer{PeersImpl: panicPeers}
+		fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+		lostPeer := requireRandPeerID(t)
+		b := NewBootstrapper([]pstore.PeerInfo{{ID: lostPeer}}, fakeHost, fakeDialer, fakeRouter, 0, time.Minute)
+		b.RecentlyLostWindow = 10 * time.Millisecond
+		b.ctx = context.Background()
+
+		b.bootstrap([]peer.ID{lostPeer})
+		b.bootstrap([]peer.ID{})
+		assert.Contains(b.lostPeers, lostPeer)
+
+		time.Sleep(20 * time.Millisecond)
+		b.bootstrap([]peer.ID{})
+		assert.NotContains(b.lostPeers, lostPeer)
+	})
+	t.Run("Connects to a peer from every group", func(t *testing.T) {
+		var dialed []peer.ID
+		recordingConnect := func(_ context.Context, pi pstore.PeerInfo) error {
+			lk.Lock()
+			defer lk.Unlock()
+			dialed = append(dialed, pi.ID)
+			return nil
+		}
+		fakeHost := &fakeHost{ConnectImpl: recordingConnect}
+		fakeDialer := &fakeDialer{PeersImpl: panicPeers}
+		fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+		var bigGroup []pstore.PeerInfo
+		for i := 0; i < 5; i++ {
+			bigGroup = append(bigGroup, pstore.PeerInfo{ID: requireRandPeerID(t)})
+		}
+		smallGroup := []pstore.PeerInfo{{ID: requireRandPeerID(t)}}
+
+		t.Run("when below the threshold", func(t *testing.T) {
+			assert := assert.New(t)
+			lk.Lock()
+			dialed = nil
+			lk.Unlock()
+
+			// The threshold could be met from the big group alone.
+			b := NewGroupedBootstrapper([][]pstore.PeerInfo{bigGroup, smallGroup}, fakeHost, fakeDialer, fakeRouter, 2, time.Minute)
+			b.ctx = context.Background()
+			b.bootstrap([]peer.ID{})
+			time.Sleep(20 * time.Millisecond)
+
+			lk.Lock()
+			defer lk.Unlock()
+			assert.Len(dialed, 2)
+			assert.Contains(dialed, smallGroup[0].ID)
+			assert.True(hasPeerInfo(bigGroup, dialed[0]) || hasPeerInfo(bigGroup, dialed[1]))
+		})
+
+		t.Run("when the threshold is already met", func(t *testing.T) {
+			assert := assert.New(t)
+			lk.Lock()
+			dialed = nil
+			lk.Unlock()
+
+			b := NewGroupedBootstrapper([][]pstore.PeerInfo{bigGroup, smallGroup}, fakeHost, fakeDialer, fakeRouter, 2, time.Minute)
+			b.ctx = context.Background()
+			b.bootstrap([]peer.ID{bigGroup[0].ID, bigGroup[1].ID})
+			time.Sleep(20 * time.Millisecond)
+
+			lk.Lock()
+			defer lk.Unlock()
+			assert.Equal([]peer.ID{smallGroup[0].ID}, dialed)
+		})
+	})
+	t.Run("Meets the threshold of every peer class", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var dialed []peer.ID
+		recordingConnect := func(_ context.Context, pi pstore.PeerInfo) error {
+			lk.Lock()
+			defer lk.Unlock()
+			dialed = append(dialed, pi.ID)
+			return nil
+		}
+		fakeHost := &fakeHost{ConnectImpl: recordingConnect}
+		fakeDialer := &fakeDialer{PeersImpl: panicPeers}
+		fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+		var bootstrapPeers []pstore.PeerInfo
+		validators := map[peer.ID]bool{}
+		for i := 0; i < 20; i++ {
+			pid := requireRandPeerID(t)
+			bootstrapPeers = append(bootstrapPeers, pstore.PeerInfo{ID: pid})
+			if i < 4 {
+				validators[pid] = true
+			}
+		}
+
+		b := NewBootstrapper(bootstrapPeers, fakeHost, fakeDialer, fakeRouter, 5, time.Minute)
+		b.ctx = context.Background()
+		b.PeerClass = func(p peer.ID) string {
+			if validators[p] {
+				return "validator"
+			}
+			return "general"
+		}
+		b.ClassThresholds = map[string]int{"validator": 2, "general": 3}
+
+		// One validator is already connected.
+		var connectedValidator peer.ID
+		for p := range validators {
+			connectedValidator = p
+			break
+		}
+		b.bootstrap([]peer.ID{connectedValidator})
+
+		lk.Lock()
+		defer lk.Unlock()
+		dialedValidators := 0
+		for _, p := range dialed {
+			assert.NotEqual(connectedValidator, p)
+			if validators[p] {
+				dialedValidators++
+			}
+		}
+		assert.Equal(1, dialedValidators)
+		assert.Len(dialed, 4)
+	})
+}
+
+func TestBootstrapperConnectTimeout(t *testing.T) {
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+	fakeDialer := &fakeDialer{PeersImpl: nopPeers}
+	hangingConnect := func(ctx context.Context, _ pstore.PeerInfo) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	bootstrapPeers := []pstore.PeerInfo{{ID: requireRandPeerID(t)}, {ID: requireRandPeerID(t)}}
+
+	t.Run("Abandons a hung connect and frees its slot", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b := NewBootstrapper(bootstrapPeers, &fakeHost{ConnectImpl: hangingConnect}, fakeDialer, fakeRouter, 2, time.Minute)
+		b.ctx = context.Background()
+		b.ConnectTimeout = 20 * time.Millisecond
+		b.MaxConcurrentDials = 1
+
+		start := time.Now()
+		b.bootstrap([]peer.ID{})
+		elapsed := time.Since(start)
+		// Both peers got the slot in turn, and neither waited for ConnectionTimeout.
+		assert.True(elapsed >= 40*time.Millisecond, "took %s", elapsed)
+		assert.True(elapsed < time.Second, "took %s", elapsed)
+		for _, pinfo := range bootstrapPeers {
+			assert.Contains(b.WhyNotConnected(pinfo.ID), context.DeadlineExceeded.Error())
+		}
+	})
+
+	t.Run("Zero waits for ConnectionTimeout", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b := NewBootstrapper(bootstrapPeers, &fakeHost{ConnectImpl: hangingConnect}, fakeDialer, fakeRouter, 2, time.Minute)
+		b.ctx = context.Background()
+		b.ConnectionTimeout = 100 * time.Millisecond
+
+		start := time.Now()
+		b.bootstrap([]peer.ID{})
+		elapsed := time.Since(start)
+		assert.True(elapsed >= 100*time.Millisecond, "took %s", elapsed)
+	})
+}
+
+func TestBootstrapperPeerStorePath(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	dir, err := ioutil.TempDir("", "bootstrap")
+	require.NoError(err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "peers.json")
+
+	// The first run is connected to two peers, only one of whose addresses
+	// the host knows.
+	knownPeer, unknownPeer := requireRandPeerID(t), requireRandPeerID(t)
+	addr, err := ma.NewMultiaddr("/ip4/10.0.0.1/tcp/6000")
+	require.NoError(err)
+	peerstore := pstoremem.NewPeerstore()
+	peerstore.AddAddr(knownPeer, addr, pstore.PermanentAddrTTL)
+	connected := &fakeDialer{PeersImpl: func() []peer.ID { return []peer.ID{knownPeer, unknownPeer} }}
+
+	b := NewBootstrapper([]pstore.PeerInfo{}, &fakeHost{ConnectImpl: panicConnect, PeerstoreImpl: peerstore}, connected, fakeRouter, 1, time.Hour)
+	b.PeerStorePath = path
+	b.Start(context.Background())
+	b.Stop()
+
+	// After a restart the persisted peer is dialed along with the bootstrap peers.
+	var lk sync.Mutex
+	var dialed []pstore.PeerInfo
+	connect := func(_ context.Context, pinfo pstore.PeerInfo) error {
+		lk.Lock()
+		defer lk.Unlock()
+		dialed = append(dialed, pinfo)
+		return nil
+	}
+	bootstrapPeer := pstore.PeerInfo{ID: requireRandPeerID(t)}
+
+	b = NewBootstrapper([]pstore.PeerInfo{bootstrapPeer}, &fakeHost{ConnectImpl: connect}, &fakeDialer{PeersImpl: nopPeers}, fakeRouter, 2, time.Hour)
+	b.PeerStorePath = path
+	b.Start(context.Background())
+	defer b.cancel()
+	b.bootstrap([]peer.ID{})
+
+	lk.Lock()
+	defer lk.Unlock()
+	require.Len(dialed, 2)
+	assert.Contains(dialed, bootstrapPeer)
+	for _, pinfo := range dialed {
+		if pinfo.ID == knownPeer {
+			assert.Equal([]ma.Multiaddr{addr}, pinfo.Addrs)
+		}
+	}
+	assert.NotContains(b.candidates(), pstore.PeerInfo{ID: unknownPeer})
+}
+
+func TestBootstrapperResolver(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	mustAddr := func(s string) ma.Multiaddr {
+		addr, err := ma.NewMultiaddr(s)
+		require.NoError(err)
+		return addr
+	}
+	// The stub resolver maps the "hostname" 10.0.0.1 to whatever target is,
+	// and fails to resolve 10.0.0.2.
+	rotating, broken := mustAddr("/ip4/10.0.0.1/tcp/6000"), mustAddr("/ip4/10.0.0.2/tcp/6000")
+	var lk sync.Mutex
+	target := mustAddr("/ip4/192.168.0.1/tcp/6000")
+	resolves := 0
+	resolver := func(_ context.Context, addr ma.Multiaddr) ([]ma.Multiaddr, error) {
+		lk.Lock()
+		defer lk.Unlock()
+		resolves++
+		if addr.Equal(broken) {
+			return nil, errors.New("no such host")
+		}
+		return []ma.Multiaddr{target}, nil
+	}
+
+	dialed := map[peer.ID][]ma.Multiaddr{}
+	connect := func(_ context.Context, pinfo pstore.PeerInfo) error {
+		lk.Lock()
+		defer lk.Unlock()
+		dialed[pinfo.ID] = pinfo.Addrs
+		return nil
+	}
+	rotatingPeer := pstore.PeerInfo{ID: requireRandPeerID(t), Addrs: []ma.Multiaddr{rotating}}
+	brokenPeer := pstore.PeerInfo{ID: requireRandPeerID(t), Addrs: []ma.Multiaddr{broken}}
+
+	b := NewBootstrapper([]pstore.PeerInfo{rotatingPeer, brokenPeer}, &fakeHost{ConnectImpl: connect}, &fakeDialer{PeersImpl: nopPeers}, fakeRouter, 2, time.Minute)
+	b.ctx = context.Background()
+	b.Resolver = resolver
+	b.ResolveInterval = time.Hour
+	now := time.Unix(1000000, 0)
+	b.now = func() time.Time { return now }
+
+	// A peer that fails to resolve is still dialed at its unresolved address.
+	b.bootstrap([]peer.ID{})
+	lk.Lock()
+	assert.Equal(2, resolves)
+	assert.Equal([]ma.Multiaddr{target}, dialed[rotatingPeer.ID])
+	assert.Equal([]ma.Multiaddr{broken}, dialed[brokenPeer.ID])
+	target = mustAddr("/ip4/192.168.0.2/tcp/6000")
+	lk.Unlock()
+
+	// The resolved addresses are used until ResolveInterval passes.
+	now = now.Add(30 * time.Minute)
+	b.bootstrap([]peer.ID{})
+	lk.Lock()
+	assert.Equal(2, resolves)
+	assert.Equal([]ma.Multiaddr{mustAddr("/ip4/192.168.0.1/tcp/6000")}, dialed[rotatingPeer.ID])
+	lk.Unlock()
+
+	now = now.Add(time.Hour)
+	b.bootstrap([]peer.ID{})
+	lk.Lock()
+	assert.Equal(4, resolves)
+	assert.Equal([]ma.Multiaddr{target}, dialed[rotatingPeer.ID])
+	lk.Unlock()
+}
+
+func TestBootstrapperSetMinPeerThreshold(t *testing.T) {
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	var lk sync.Mutex
+	dials := 0
+	connect := func(context.Context, pstore.PeerInfo) error {
+		lk.Lock()
+		defer lk.Unlock()
+		dials++
+		return nil
+	}
+	var bootstrapPeers []pstore.PeerInfo
+	for i := 0; i < 10; i++ {
+		bootstrapPeers = append(bootstrapPeers, pstore.PeerInfo{ID: requireRandPeerID(t)})
+	}
+
+	t.Run("Can be changed while running", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		// Dialed peers stay connected.
+		var connectedLk sync.Mutex
+		var connected []peer.ID
+		dialAndConnect := func(_ context.Context, pinfo pstore.PeerInfo) error {
+			connectedLk.Lock()
+			defer connectedLk.Unlock()
+			if !hasPID(connected, pinfo.ID) {
+				connected = append(connected, pinfo.ID)
+			}
+			return nil
+		}
+		connectedPeers := func() []peer.ID {
+			connectedLk.Lock()
+			defer connectedLk.Unlock()
+			return append([]peer.ID{}, connected...)
+		}
+
+		b := NewBootstrapper(bootstrapPeers, &fakeHost{ConnectImpl: dialAndConnect}, &fakeDialer{PeersImpl: connectedPeers}, fakeRouter, 1, time.Millisecond)
+		b.Start(context.Background())
+		defer b.Stop()
+
+		for _, threshold := range []int{2, 4, 7} {
+			b.SetMinPeerThreshold(threshold)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			require.NoError(b.WaitForPeers(ctx, threshold))
+			cancel()
+
+			assert.Equal(BootstrapperThresholdMet, b.Status())
+			assert.Equal(threshold, b.DebugDump().MinPeerThreshold)
+		}
+	})
+
+	t.Run("Takes effect from the next round", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b := NewBootstrapper(bootstrapPeers, &fakeHost{ConnectImpl: connect}, &fakeDialer{PeersImpl: nopPeers}, fakeRouter, 1, time.Minute)
+		b.ctx = context.Background()
+
+		for _, threshold := range []int{1, 5, 3} {
+			lk.Lock()
+			dials = 0
+			lk.Unlock()
+
+			b.SetMinPeerThreshold(threshold)
+			b.bootstrap([]peer.ID{})
+			lk.Lock()
+			assert.Equal(threshold, dials)
+			lk.Unlock()
+		}
+		assert.Equal(3, b.DebugDump().MinPeerThreshold)
+	})
+}
+
+func TestBootstrapperWaitForPeers(t *testing.T) {
+	fakeRouter := offroute.NewOfflineRouter(repo.NewInMemoryRepo().Datastore(), blankValidator{})
+
+	// Each call to peers reports one more connected peer than the last.
+	var lk sync.Mutex
+	var connected []peer.ID
+	peers := func() []peer.ID {
+		lk.Lock()
+		defer lk.Unlock()
+		connected = append(connected, requireRandPeerID(t))
+		return connected
+	}
+
+	t.Run("Unblocks at the threshold", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b := NewBootstrapper([]pstore.PeerInfo{}, &fakeHost{ConnectImpl: panicConnect}, &fakeDialer{PeersImpl: peers}, fakeRouter, 1, time.Minute)
+		assert.NoError(b.WaitForPeers(context.Background(), 3))
+		lk.Lock()
+		assert.Len(connected, 3)
+		lk.Unlock()
+	})
+
+	t.Run("Returns when ctx is done", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b := NewBootstrapper([]pstore.PeerInfo{}, &fakeHost{ConnectImpl: panicConnect}, &fakeDialer{PeersImpl: nopPeers}, fakeRouter, 1, time.Minute)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.Equal(context.DeadlineExceeded, b.WaitForPeers(ctx, 1))
+	})
 }
@@ -44,13 +44,26 @@ func requireRandPeerID(t testing.TB) peer.ID { // nolint: deadcode
 var _ host.Host = &fakeHost{}
 
 type fakeHost struct {
-	ConnectImpl func(context.Context, pstore.PeerInfo) error
+	ConnectImpl   func(context.Context, pstore.PeerInfo) error
+	NetworkImpl   inet.Network
+	IDImpl        peer.ID
+	PeerstoreImpl pstore.Peerstore
 }
 
-func (fh *fakeHost) ID() peer.ID                  { panic("not implemented") }
-func (fh *fakeHost) Peerstore() pstore.Peerstore  { panic("not implemented") }
-func (fh *fakeHost) Addrs() []ma.Multiaddr        { panic("not implemented") }
-func (fh *fakeHost) Network() inet.Network        { panic("not implemented") }
+func (fh *fakeHost) ID() peer.ID { return fh.IDImpl }
+func (fh *fakeHost) Peerstore() pstore.Peerstore {
+	if fh.PeerstoreImpl == nil {
+		panic("not implemented")
+	}
+	return fh.PeerstoreImpl
+}
+func (fh *fakeHost) Addrs() []ma.Multiaddr { panic("not implemented") }
+func (fh *fakeHost) Network() inet.Network {
+	if fh.NetworkImpl == nil {
+		panic("not implemented")
+	}
+	return fh.NetworkImpl
+}
 func (fh *fakeHost) Mux() *msmux.MultistreamMuxer { panic("not implemented") }
 func (fh *fakeHost) Connect(ctx context.Context, pi pstore.PeerInfo) error {
 	return fh.ConnectImpl(ctx, pi)
@@ -68,17 +81,31 @@ func (fh *fakeHost) NewStream(context.Context, peer.ID, ...protocol.ID) (inet.St
 func (fh *fakeHost) Close() error                       { panic("not implemented") }
 func (fh *fakeHost) ConnManager() ifconnmgr.ConnManager { panic("not implemented") }
 
+// fakeNetwork implements only Connectedness of inet.Network; its other
+// methods panic.
+type fakeNetwork struct {
+	inet.Network
+	ConnectednessImpl func(peer.ID) inet.Connectedness
+}
+
+func (fn *fakeNetwork) Connectedness(p peer.ID) inet.Connectedness {
+	return fn.ConnectednessImpl(p)
+}
+
 var _ inet.Dialer = &fakeDialer{}
 
 type fakeDialer struct {
-	PeersImpl func() []peer.ID
+	PeersImpl     func() []peer.ID
+	ClosePeerImpl func(peer.ID) error
 }
 
 func (fd *fakeDialer) Peerstore() pstore.Peerstore                          { panic("not implemented") }
 func (fd *fakeDialer) LocalPeer() peer.ID                                   { panic("not implemented") }
 func (fd *fakeDialer) DialPeer(context.Context, peer.ID) (inet.Conn, error) { panic("not implemented") }
-func (fd *fakeDialer) ClosePeer(peer.ID) error                              { panic("not implemented") }
-func (fd *fakeDialer) Connectedness(peer.ID) inet.Connectedness             { panic("not implemented") }
+func (fd *fakeDialer) ClosePeer(p peer.ID) error {
+	return fd.ClosePeerImpl(p)
+}
+func (fd *fakeDialer) Connectedness(peer.ID) inet.Connectedness { panic("not implemented") }
 func (fd *fakeDialer) Peers() []peer.ID {
 	return fd.PeersImpl()
 }
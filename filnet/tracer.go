@@ -0,0 +1,55 @@
+package filnet
+
+import (
+	"context"
+
+	logging "gx/ipfs/QmcuXC5cxs79ro2cUuHs4HQ2bkDLJUYokwL8aivcX6HW3C/go-log"
+)
+
+// Tracer starts spans around units of networking work, such as a bootstrap
+// round and each of its dials.
+type Tracer interface {
+	// StartSpan starts a span with the given name as a child of any span
+	// in ctx. The returned context carries the new span.
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	// SetTag attaches an attribute to the span.
+	SetTag(key string, value interface{})
+	// Finish ends the span, marking it failed if err is non-nil.
+	Finish(err error)
+}
+
+// EventLogTracer is a Tracer that records spans through a go-log EventLogger,
+// which is how the rest of the node is traced.
+type EventLogTracer struct {
+	Log logging.EventLogger
+}
+
+// StartSpan implements Tracer.
+func (t EventLogTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	ctx = t.Log.Start(ctx, name)
+	return ctx, eventLogSpan{log: t.Log, ctx: ctx}
+}
+
+type eventLogSpan struct {
+	log logging.EventLogger
+	ctx context.Context
+}
+
+func (s eventLogSpan) SetTag(key string, value interface{}) { s.log.SetTag(s.ctx, key, value) }
+func (s eventLogSpan) Finish(err error)                     { s.log.FinishWithErr(s.ctx, err) }
+
+// noopTracer is used when no Tracer is configured.
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetTag(string, interface{}) {}
+func (noopSpan) Finish(error)               {}
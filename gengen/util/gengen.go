@@ -98,7 +98,7 @@ func GenGen(ctx context.Context, cfg *GenesisCfg, cst *hamt.CborIpldStore, bs bl
 	}
 
 	st := state.NewEmptyStateTreeWithActors(cst, builtin.Actors)
-	storageMap := vm.NewStorageMap(bs)
+	storageMap := vm.NewStorageMap(bs, vm.StorageMapOptions{})
 
 	if err := consensus.SetupDefaultActors(ctx, st, storageMap); err != nil {
 		return nil, err
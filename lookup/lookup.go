@@ -50,7 +50,7 @@ func (c *ChainLookupService) GetPeerIDByMinerAddress(ctx context.Context, minerA
 		return peer.ID(""), errors.Wrap(err, "failed to obtain a default from-address")
 	}
 
-	vms := vm.NewStorageMap(c.bstore)
+	vms := vm.NewStorageMap(c.bstore, vm.StorageMapOptions{})
 	retValue, retCode, err := consensus.CallQueryMethod(ctx, st, vms, minerAddr, "getPeerID", []byte{}, addr, nil)
 	if err != nil {
 		return peer.ID(""), errors.Wrapf(err, "failed to query local state tree(from %s, miner %s)", addr.String(), minerAddr.String())
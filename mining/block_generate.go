@@ -59,7 +59,7 @@ func (w *DefaultWorker) Generate(ctx context.Context,
 
 	copy(messages, core.OrderMessagesByNonce(pending))
 
-	vms := vm.NewStorageMap(w.blockstore)
+	vms := vm.NewStorageMap(w.blockstore, vm.StorageMapOptions{})
 	res, err := w.processor.ApplyMessagesAndPayRewards(ctx, stateTree, vms, messages, w.minerAddr, types.NewBlockHeight(blockHeight), ancestors)
 	if err != nil {
 		return nil, errors.Wrap(err, "generate apply messages")
@@ -55,7 +55,7 @@ func (p *Previewer) Preview(ctx context.Context, optFrom, to address.Address, me
 		return types.NewGasUnits(0), errors.Wrap(err, "couldnt get base tipset height")
 	}
 
-	vms := vm.NewStorageMap(p.bs)
+	vms := vm.NewStorageMap(p.bs, vm.StorageMapOptions{})
 	usedGas, err := consensus.PreviewQueryMethod(ctx, st, vms, to, method, encodedParams, optFrom, types.NewBlockHeight(h))
 	if err != nil {
 		return types.NewGasUnits(0), errors.Wrap(err, "query method returned an error")
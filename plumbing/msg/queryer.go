@@ -69,7 +69,7 @@ func (q *Queryer) Query(ctx context.Context, optFrom, to address.Address, method
 		return nil, nil, errors.Wrap(err, "couldnt get base tipset height")
 	}
 
-	vms := vm.NewStorageMap(q.bs)
+	vms := vm.NewStorageMap(q.bs, vm.StorageMapOptions{})
 	r, ec, err := consensus.CallQueryMethod(ctx, st, vms, to, method, encodedParams, optFrom, types.NewBlockHeight(h))
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "querymethod returned an error")
@@ -32,7 +32,7 @@ func TestQuery(t *testing.T) {
 		fakeActorCodeCid := types.NewCidForTestGetter()()
 		fakeActorAddr := newAddr()
 		fromAddr := newAddr()
-		vms := vm.NewStorageMap(bs)
+		vms := vm.NewStorageMap(bs, vm.StorageMapOptions{})
 		fakeActor := th.RequireNewFakeActor(require, vms, fakeActorAddr, fakeActorCodeCid)
 		// The genesis init function we give below will install the fake actor at
 		// the given address but doesn't set up the mapping from its code cid to
@@ -71,7 +71,7 @@ func TestQuery(t *testing.T) {
 		fakeActorCodeCid := types.NewCidForTestGetter()()
 		fakeActorAddr := newAddr()
 		fromAddr := newAddr()
-		vms := vm.NewStorageMap(bs)
+		vms := vm.NewStorageMap(bs, vm.StorageMapOptions{})
 		fakeActor := th.RequireNewFakeActor(require, vms, fakeActorAddr, fakeActorCodeCid)
 		// The genesis init function we give below will install the fake actor at
 		// the given address but doesn't set up the mapping from its code cid to
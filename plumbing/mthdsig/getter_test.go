@@ -40,7 +40,7 @@ func TestGet(t *testing.T) {
 		cst := hamt.NewCborStore()
 		addr := address.NewForTestGetter()()
 		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
-		vms := vm.NewStorageMap(bs)
+		vms := vm.NewStorageMap(bs, vm.StorageMapOptions{})
 
 		// Install the fake actor so we can query one of its method signatures.
 		emptyActorCodeCid := types.NewCidForTestGetter()()
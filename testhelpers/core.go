@@ -94,7 +94,7 @@ func RequireRandomPeerID() peer.ID {
 
 // VMStorage creates a new storage object backed by an in memory datastore
 func VMStorage() vm.StorageMap {
-	return vm.NewStorageMap(blockstore.NewBlockstore(datastore.NewMapDatastore()))
+	return vm.NewStorageMap(blockstore.NewBlockstore(datastore.NewMapDatastore()), vm.StorageMapOptions{})
 }
 
 // MustSign signs a given address with the provided mocksigner or panics if it
@@ -0,0 +1,184 @@
+package types
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"gx/ipfs/QmVmDhyTTUcQXFD1rRQ64fGLMSAoaQvNH3hwuaCFAPq2hy/errors"
+)
+
+// BitField is a set of non-negative integers, such as the ids of faulty
+// sectors. It is stored and encoded as runs of consecutive set bits, so both
+// dense and sparse sets are compact.
+//
+// The encoding is a sequence of unsigned LEB128 integers in pairs: the number
+// of unset bits preceding a run followed by the length of the run. Every run
+// has a non-zero length and every gap but the first is non-zero, so each set
+// has exactly one encoding.
+type BitField struct {
+	// runs are sorted, non-empty, and neither overlap nor touch.
+	runs []bitRun
+}
+
+type bitRun struct {
+	start  uint64
+	length uint64
+}
+
+// maxBitFieldCount bounds the number of bits set in a decoded BitField, so a
+// short encoding can't describe a set too large to list with Indices.
+const maxBitFieldCount = 1 << 20
+
+// NewBitField returns a BitField with the given bits set.
+func NewBitField(indices ...uint64) *BitField {
+	bf := &BitField{}
+	for _, i := range indices {
+		bf.Set(i)
+	}
+	return bf
+}
+
+// NewBitFieldFromBytes decodes a BitField from its encoding as returned by
+// Bytes. It rejects encodings with more than maxBitFieldCount bits set.
+func NewBitFieldFromBytes(buf []byte) (*BitField, error) {
+	bf := &BitField{}
+	var next, count uint64
+	for len(buf) > 0 {
+		gap, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errors.New("malformed bitfield gap")
+		}
+		buf = buf[n:]
+
+		length, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errors.New("malformed bitfield run length")
+		}
+		buf = buf[n:]
+
+		if gap == 0 && len(bf.runs) > 0 {
+			return nil, errors.New("non-canonical bitfield: empty gap between runs")
+		}
+		if length == 0 {
+			return nil, errors.New("non-canonical bitfield: empty run")
+		}
+		if length > maxBitFieldCount-count {
+			return nil, fmt.Errorf("bitfield exceeds maximum of %d set bits", maxBitFieldCount)
+		}
+		count += length
+
+		start := next + gap
+		if start < next || (len(bf.runs) > 0 && next == 0) {
+			return nil, errors.New("bitfield overflows uint64")
+		}
+		next = start + length
+		if next != 0 && next < start {
+			return nil, errors.New("bitfield overflows uint64")
+		}
+
+		bf.runs = append(bf.runs, bitRun{start: start, length: length})
+	}
+	return bf, nil
+}
+
+// Set sets bit i.
+func (bf *BitField) Set(i uint64) {
+	// k is the first run that starts after i.
+	k := sort.Search(len(bf.runs), func(j int) bool { return bf.runs[j].start > i })
+
+	mergeLeft := false
+	if k > 0 {
+		prev := bf.runs[k-1]
+		if i-prev.start < prev.length {
+			return
+		}
+		mergeLeft = i-prev.start == prev.length
+	}
+	mergeRight := k < len(bf.runs) && bf.runs[k].start == i+1
+
+	switch {
+	case mergeLeft && mergeRight:
+		bf.runs[k-1].length += 1 + bf.runs[k].length
+		bf.runs = append(bf.runs[:k], bf.runs[k+1:]...)
+	case mergeLeft:
+		bf.runs[k-1].length++
+	case mergeRight:
+		bf.runs[k].start--
+		bf.runs[k].length++
+	default:
+		bf.runs = append(bf.runs, bitRun{})
+		copy(bf.runs[k+1:], bf.runs[k:])
+		bf.runs[k] = bitRun{start: i, length: 1}
+	}
+}
+
+// Has returns whether bit i is set.
+func (bf *BitField) Has(i uint64) bool {
+	k := sort.Search(len(bf.runs), func(j int) bool { return bf.runs[j].start > i })
+	return k > 0 && i-bf.runs[k-1].start < bf.runs[k-1].length
+}
+
+// Count returns the number of set bits.
+func (bf *BitField) Count() uint64 {
+	var count uint64
+	for _, r := range bf.runs {
+		count += r.length
+	}
+	return count
+}
+
+// Indices returns the set bits in ascending order.
+func (bf *BitField) Indices() []uint64 {
+	var indices []uint64
+	for _, r := range bf.runs {
+		for i := uint64(0); i < r.length; i++ {
+			indices = append(indices, r.start+i)
+		}
+	}
+	return indices
+}
+
+// Bytes returns the canonical encoding of the BitField.
+func (bf *BitField) Bytes() []byte {
+	buf := make([]byte, 0, 2*len(bf.runs))
+	tmp := make([]byte, binary.MaxVarintLen64)
+	var next uint64
+	for _, r := range bf.runs {
+		n := binary.PutUvarint(tmp, r.start-next)
+		buf = append(buf, tmp[:n]...)
+		n = binary.PutUvarint(tmp, r.length)
+		buf = append(buf, tmp[:n]...)
+		next = r.start + r.length
+	}
+	return buf
+}
+
+// Equal returns true if bf and other have the same bits set.
+func (bf *BitField) Equal(other *BitField) bool {
+	if len(bf.runs) != len(other.runs) {
+		return false
+	}
+	for i := range bf.runs {
+		if bf.runs[i] != other.runs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns a string version of the BitField, listing runs of set bits.
+func (bf *BitField) String() string {
+	s := "["
+	for i, r := range bf.runs {
+		if i > 0 {
+			s += " "
+		}
+		if r.length == 1 {
+			s += fmt.Sprint(r.start)
+		} else {
+			s += fmt.Sprintf("%d-%d", r.start, r.start+r.length-1)
+		}
+	}
+	return s + "]"
+}
@@ -0,0 +1,95 @@
+package types
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitFieldSetAndHas(t *testing.T) {
+	assert := assert.New(t)
+
+	bf := NewBitField()
+	assert.Equal(uint64(0), bf.Count())
+	assert.False(bf.Has(0))
+
+	// Out of order, duplicated, and merging runs from both sides.
+	for _, i := range []uint64{5, 3, 7, 4, 4, 6, 10, math.MaxUint64} {
+		bf.Set(i)
+	}
+
+	assert.Equal([]uint64{3, 4, 5, 6, 7, 10, math.MaxUint64}, bf.Indices())
+	assert.Equal(uint64(7), bf.Count())
+	assert.True(bf.Has(3))
+	assert.True(bf.Has(7))
+	assert.True(bf.Has(math.MaxUint64))
+	assert.False(bf.Has(2))
+	assert.False(bf.Has(8))
+	assert.Equal("[3-7 10 18446744073709551615]", bf.String())
+	assert.True(bf.Equal(NewBitField(bf.Indices()...)))
+	assert.False(bf.Equal(NewBitField(3, 4, 5)))
+}
+
+func TestBitFieldEncoding(t *testing.T) {
+	cases := map[string]struct {
+		indices []uint64
+		encoded []byte
+	}{
+		"empty":  {nil, []byte{}},
+		"dense":  {[]uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, []byte{0, 16}},
+		"sparse": {[]uint64{3, 1000}, []byte{3, 1, 0xe4, 0x07, 1}},
+	}
+
+	for tname, tcase := range cases {
+		t.Run(tname, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			bf := NewBitField(tcase.indices...)
+			assert.Equal(tcase.encoded, bf.Bytes())
+
+			decoded, err := NewBitFieldFromBytes(bf.Bytes())
+			require.NoError(err)
+			assert.Equal(tcase.indices, decoded.Indices())
+			assert.True(bf.Equal(decoded))
+		})
+	}
+}
+
+func TestBitFieldDecodingFailures(t *testing.T) {
+	cases := map[string][]byte{
+		"truncated varint":  {0x80},
+		"missing length":    {3},
+		"empty run":         {3, 0},
+		"empty gap":         {0, 1, 0, 1},
+		"overflowing run":   {0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 3},
+		"run after the end": {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 1, 1, 1},
+	}
+
+	for tname, encoded := range cases {
+		t.Run(tname, func(t *testing.T) {
+			_, err := NewBitFieldFromBytes(encoded)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestBitFieldDecodingLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	// A single run of about 2^63 bits.
+	_, err := NewBitFieldFromBytes([]byte{0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f})
+	assert.EqualError(err, "bitfield exceeds maximum of 1048576 set bits")
+
+	// Runs that are each within the limit but not together.
+	// Two runs of 2^19+1 bits, with a gap of one between them.
+	_, err = NewBitFieldFromBytes([]byte{0, 0x81, 0x80, 0x20, 1, 0x81, 0x80, 0x20})
+	assert.EqualError(err, "bitfield exceeds maximum of 1048576 set bits")
+
+	// Exactly the limit is accepted.
+	bf, err := NewBitFieldFromBytes([]byte{0, 0x80, 0x80, 0x40})
+	assert.NoError(err)
+	assert.Equal(uint64(maxBitFieldCount), bf.Count())
+}
@@ -0,0 +1,36 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	cbor "gx/ipfs/QmRoARq3nkUb13HSKZGepCZSWe5GrVPwx7xURJGZ7KWv9V/go-ipld-cbor"
+)
+
+func init() {
+	cbor.RegisterCborType(LogEntry{})
+}
+
+// LogEntry is an entry in an append-only log, such as an actor's event log.
+// Each entry links to the one before it, so the cid of the latest entry
+// identifies the whole log.
+type LogEntry struct {
+	// Prev is the cid of the previous entry, or undefined for the first.
+	Prev cid.Cid `refmt:",omitempty"`
+	// Payload is the content of the entry.
+	Payload []byte
+}
+
+// Equal returns true if le and other have the same previous entry and payload.
+func (le *LogEntry) Equal(other *LogEntry) bool {
+	return le.Prev.Equals(other.Prev) && bytes.Equal(le.Payload, other.Payload)
+}
+
+// String returns a string version of the LogEntry.
+func (le *LogEntry) String() string {
+	if !le.Prev.Defined() {
+		return fmt.Sprintf("%x", le.Payload)
+	}
+	return fmt.Sprintf("%s <- %x", le.Prev, le.Payload)
+}
@@ -0,0 +1,40 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	cbor "gx/ipfs/QmRoARq3nkUb13HSKZGepCZSWe5GrVPwx7xURJGZ7KWv9V/go-ipld-cbor"
+)
+
+func init() {
+	cbor.RegisterCborType(ProofPath{})
+}
+
+// ProofPath is a path through an actor's state from its head down to a leaf
+// value, such as an entry in a HAMT, used to prove the value is present.
+type ProofPath struct {
+	// Cids are the cids of the nodes on the path, starting with the head.
+	Cids []cid.Cid
+	// Leaf is the encoded value the path ends at.
+	Leaf []byte
+}
+
+// Equal returns true if pp and other have the same cids and leaf.
+func (pp *ProofPath) Equal(other *ProofPath) bool {
+	if len(pp.Cids) != len(other.Cids) {
+		return false
+	}
+	for i := range pp.Cids {
+		if !pp.Cids[i].Equals(other.Cids[i]) {
+			return false
+		}
+	}
+	return bytes.Equal(pp.Leaf, other.Leaf)
+}
+
+// String returns a string version of the ProofPath.
+func (pp *ProofPath) String() string {
+	return fmt.Sprintf("%v -> %x", pp.Cids, pp.Leaf)
+}
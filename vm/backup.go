@@ -0,0 +1,89 @@
+package vm
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync/atomic"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	car "gx/ipfs/QmRa5sdhUGtLptMNYSHFWcU3axEJntpKht3LngrBpuurv1/go-car"
+	carutil "gx/ipfs/QmRa5sdhUGtLptMNYSHFWcU3axEJntpKht3LngrBpuurv1/go-car/util"
+	cbor "gx/ipfs/QmRoARq3nkUb13HSKZGepCZSWe5GrVPwx7xURJGZ7KWv9V/go-ipld-cbor"
+	blocks "gx/ipfs/QmWoXtvgC8inqFkAATB7cp2Dax7XBi9VDvSg9RCCZufmRk/go-block-format"
+)
+
+// maxBackupQueue is the number of flushes that may be waiting to be written
+// to a backup before more are dropped.
+const maxBackupQueue = 16
+
+// backupQueue writes the CARs of flushed blocks to a backup writer in the
+// background, so that a slow backup doesn't slow down flushes.
+type backupQueue struct {
+	w       io.Writer
+	cars    chan []byte
+	dropped *uint64
+}
+
+func newBackupQueue(w io.Writer, dropped *uint64) *backupQueue {
+	q := &backupQueue{
+		w:       w,
+		cars:    make(chan []byte, maxBackupQueue),
+		dropped: dropped,
+	}
+	go q.run()
+	return q
+}
+
+func (q *backupQueue) run() {
+	for data := range q.cars {
+		if _, err := q.w.Write(data); err != nil {
+			atomic.AddUint64(q.dropped, 1)
+		}
+	}
+}
+
+// enqueue queues a CAR of blks with the given roots to be written, or drops it
+// if the queue is full.
+func (q *backupQueue) enqueue(roots []cid.Cid, blks []blocks.Block) {
+	data, err := encodeCAR(roots, blks)
+	if err != nil {
+		atomic.AddUint64(q.dropped, 1)
+		return
+	}
+
+	select {
+	case q.cars <- data:
+	default:
+		atomic.AddUint64(q.dropped, 1)
+	}
+}
+
+// close stops the queue once the CARs already queued have been written.
+func (q *backupQueue) close() {
+	close(q.cars)
+}
+
+// encodeCAR returns a CAR with the given roots holding each of blks once.
+func encodeCAR(roots []cid.Cid, blks []blocks.Block) ([]byte, error) {
+	sort.Slice(roots, func(i, j int) bool { return roots[i].KeyString() < roots[j].KeyString() })
+	header, err := cbor.DumpObject(&car.CarHeader{Roots: roots, Version: 1})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := carutil.LdWrite(&buf, header); err != nil {
+		return nil, err
+	}
+	seen := cid.NewSet()
+	for _, blk := range blks {
+		if !seen.Visit(blk.Cid()) {
+			continue
+		}
+		if err := carutil.LdWrite(&buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,79 @@
+package vm
+
+import (
+	"container/list"
+	"sync"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	blocks "gx/ipfs/QmWoXtvgC8inqFkAATB7cp2Dax7XBi9VDvSg9RCCZufmRk/go-block-format"
+)
+
+// chunkCache holds the chunks most recently read from a blockstore, so
+// repeated reads of them don't go to the blockstore. It holds at most size
+// chunks, evicting the least recently used.
+type chunkCache struct {
+	lk      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[cid.Cid]*list.Element
+}
+
+func newChunkCache(size int) *chunkCache {
+	return &chunkCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[cid.Cid]*list.Element{},
+	}
+}
+
+// get returns the cached chunk c, if there is one.
+func (cc *chunkCache) get(c cid.Cid) (blocks.Block, bool) {
+	if cc == nil {
+		return nil, false
+	}
+
+	cc.lk.Lock()
+	defer cc.lk.Unlock()
+	elem, ok := cc.entries[c]
+	if !ok {
+		return nil, false
+	}
+	cc.order.MoveToFront(elem)
+	return elem.Value.(blocks.Block), true
+}
+
+// add caches blk, evicting the least recently used chunk if the cache is full.
+func (cc *chunkCache) add(blk blocks.Block) {
+	if cc == nil {
+		return
+	}
+
+	cc.lk.Lock()
+	defer cc.lk.Unlock()
+	if elem, ok := cc.entries[blk.Cid()]; ok {
+		cc.order.MoveToFront(elem)
+		return
+	}
+	cc.entries[blk.Cid()] = cc.order.PushFront(blk)
+	if cc.order.Len() > cc.size {
+		oldest := cc.order.Back()
+		cc.order.Remove(oldest)
+		delete(cc.entries, oldest.Value.(blocks.Block).Cid())
+	}
+}
+
+// remove drops blks from the cache.
+func (cc *chunkCache) remove(blks []blocks.Block) {
+	if cc == nil {
+		return
+	}
+
+	cc.lk.Lock()
+	defer cc.lk.Unlock()
+	for _, blk := range blks {
+		if elem, ok := cc.entries[blk.Cid()]; ok {
+			cc.order.Remove(elem)
+			delete(cc.entries, blk.Cid())
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package vm
+
+import (
+	"sort"
+	"sync"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	cbor "gx/ipfs/QmRoARq3nkUb13HSKZGepCZSWe5GrVPwx7xURJGZ7KWv9V/go-ipld-cbor"
+	"gx/ipfs/QmS2aqUZLJp8kF1ihE5rvDGE5LvmKDPnx32w9Z1BW9xLV5/go-ipfs-blockstore"
+	blocks "gx/ipfs/QmWoXtvgC8inqFkAATB7cp2Dax7XBi9VDvSg9RCCZufmRk/go-block-format"
+	ipld "gx/ipfs/QmcKKBwfz6FyQdHR2jsXrrF6XeSBXYL86anmWNewpFpoF5/go-ipld-format"
+
+	vmerrors "github.com/filecoin-project/go-filecoin/vm/errors"
+)
+
+func init() {
+	cbor.RegisterCborType(packIndexNode{})
+}
+
+// packEntry locates a chunk packed into a container block.
+type packEntry struct {
+	container cid.Cid
+	pos       int
+}
+
+// packIndexNode is the block persisting the index of the chunks packed into a
+// container. The nodes for all containers form a chain, so the whole index
+// can be read back from the cid of the last one.
+type packIndexNode struct {
+	// Prev is the cid of the node for the previous container, or undefined
+	// for the first.
+	Prev      cid.Cid `refmt:",omitempty"`
+	Container cid.Cid
+	// Leaves are the cids of the chunks in the container, in order.
+	Leaves []cid.Cid
+}
+
+// packIndex records where chunks packed by compacting flushes are, so they
+// can still be retrieved by their own cids. The index is persisted in the
+// blockstore alongside the containers, and read back from its root the first
+// time it is needed.
+type packIndex struct {
+	lk sync.RWMutex
+	bs blockstore.Blockstore
+	// root is the cid of the last packIndexNode written, or undefined if
+	// there are none.
+	root cid.Cid
+	// loaded is whether the nodes reachable from root have been read into
+	// entries.
+	loaded  bool
+	entries map[cid.Cid]packEntry
+}
+
+// newPackIndex returns the index persisted in bs with the given root, which
+// is cid.Undef for a new index.
+func newPackIndex(bs blockstore.Blockstore, root cid.Cid) *packIndex {
+	return &packIndex{
+		bs:      bs,
+		root:    root,
+		loaded:  !root.Defined(),
+		entries: map[cid.Cid]packEntry{},
+	}
+}
+
+// packNode describes the chunks a flush packed into a container, to be added
+// to the index once the container is written.
+type packNode struct {
+	container cid.Cid
+	leaves    []cid.Cid
+}
+
+// pack returns the blocks to write in place of blks, with the leaf blocks in
+// blks smaller than threshold bytes, other than roots, packed into a single
+// container block hashed with hashFunction, and what to add to the index once
+// they are written. Nothing is packed if threshold is not positive or there
+// are fewer than two such leaves.
+func (pi *packIndex) pack(threshold int, hashFunction uint64, roots []cid.Cid, blks []blocks.Block) ([]blocks.Block, *packNode, error) {
+	if pi == nil || threshold <= 0 {
+		return blks, nil, nil
+	}
+
+	isRoot := cid.NewSet()
+	for _, root := range roots {
+		isRoot.Add(root)
+	}
+
+	var leaves, out []blocks.Block
+	for _, blk := range blks {
+		nd, ok := blk.(ipld.Node)
+		if ok && len(nd.Links()) == 0 && len(blk.RawData()) < threshold && !isRoot.Has(blk.Cid()) {
+			leaves = append(leaves, blk)
+		} else {
+			out = append(out, blk)
+		}
+	}
+	if len(leaves) < 2 {
+		return blks, nil, nil
+	}
+
+	// Order the leaves so the same leaves always make the same container.
+	sort.Slice(leaves, func(i, j int) bool {
+		return leaves[i].Cid().KeyString() < leaves[j].Cid().KeyString()
+	})
+	data := make([][]byte, 0, len(leaves))
+	node := &packNode{leaves: make([]cid.Cid, 0, len(leaves))}
+	for _, leaf := range leaves {
+		data = append(data, leaf.RawData())
+		node.leaves = append(node.leaves, leaf.Cid())
+	}
+	container, err := cbor.WrapObject(data, hashFunction, -1)
+	if err != nil {
+		return nil, nil, vmerrors.FaultErrorWrap(err, "could not pack chunks during flush")
+	}
+	node.container = container.Cid()
+
+	return append(out, container), node, nil
+}
+
+// add persists the index of the container described by node, which pack
+// returned, once the container has been written, and adds it to the index.
+func (pi *packIndex) add(hashFunction uint64, node *packNode) error {
+	if pi == nil || node == nil {
+		return nil
+	}
+
+	pi.lk.Lock()
+	defer pi.lk.Unlock()
+
+	nd, err := cbor.WrapObject(packIndexNode{Prev: pi.root, Container: node.container, Leaves: node.leaves}, hashFunction, -1)
+	if err != nil {
+		return vmerrors.FaultErrorWrap(err, "could not encode pack index")
+	}
+	if err := pi.bs.Put(nd); err != nil {
+		return vmerrors.FaultErrorWrap(err, "could not write pack index")
+	}
+
+	pi.root = nd.Cid()
+	for i, leaf := range node.leaves {
+		pi.entries[leaf] = packEntry{container: node.container, pos: i}
+	}
+	return nil
+}
+
+// rootCid returns the cid of the last node of the persisted index, or
+// cid.Undef if nothing has been packed.
+func (pi *packIndex) rootCid() cid.Cid {
+	if pi == nil {
+		return cid.Undef
+	}
+
+	pi.lk.RLock()
+	defer pi.lk.RUnlock()
+	return pi.root
+}
+
+// lookup returns where the chunk c is packed, and whether it has been.
+func (pi *packIndex) lookup(c cid.Cid) (packEntry, bool, error) {
+	if pi == nil {
+		return packEntry{}, false, nil
+	}
+
+	pi.lk.RLock()
+	loaded := pi.loaded
+	entry, ok := pi.entries[c]
+	pi.lk.RUnlock()
+	if loaded {
+		return entry, ok, nil
+	}
+
+	pi.lk.Lock()
+	defer pi.lk.Unlock()
+	if err := pi.load(); err != nil {
+		return packEntry{}, false, err
+	}
+	entry, ok = pi.entries[c]
+	return entry, ok, nil
+}
+
+// load reads the persisted index into entries, if it hasn't been. Entries
+// added since the index was opened are newer than any it reads, so they are
+// kept. pi.lk must be held.
+func (pi *packIndex) load() error {
+	if pi.loaded {
+		return nil
+	}
+
+	for c := pi.root; c.Defined(); {
+		blk, err := pi.bs.Get(c)
+		if err != nil {
+			return vmerrors.FaultErrorWrapf(err, "could not read pack index %s", c)
+		}
+		var node packIndexNode
+		if err := cbor.DecodeInto(blk.RawData(), &node); err != nil {
+			return vmerrors.FaultErrorWrapf(err, "could not decode pack index %s", c)
+		}
+		for i, leaf := range node.Leaves {
+			if _, ok := pi.entries[leaf]; !ok {
+				pi.entries[leaf] = packEntry{container: node.Container, pos: i}
+			}
+		}
+		c = node.Prev
+	}
+
+	pi.loaded = true
+	return nil
+}
+
+// has returns whether c has been packed.
+func (pi *packIndex) has(c cid.Cid) (bool, error) {
+	_, ok, err := pi.lookup(c)
+	return ok, err
+}
+
+// get unpacks the chunk c from its container. It returns ErrNotFound if c has
+// not been packed.
+func (pi *packIndex) get(c cid.Cid) (blocks.Block, error) {
+	entry, ok, err := pi.lookup(c)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	container, err := pi.bs.Get(entry.container)
+	if err != nil {
+		if err == blockstore.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if container, err = decompressBlock(container); err != nil {
+		return nil, err
+	}
+
+	var data [][]byte
+	if err := cbor.DecodeInto(container.RawData(), &data); err != nil {
+		return nil, vmerrors.FaultErrorWrapf(err, "could not unpack container %s", entry.container)
+	}
+	if entry.pos >= len(data) {
+		return nil, vmerrors.NewFaultErrorf("container %s holds no chunk %d", entry.container, entry.pos)
+	}
+
+	return blocks.NewBlockWithCid(data[entry.pos], c)
+}
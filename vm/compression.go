@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+
+	blocks "gx/ipfs/QmWoXtvgC8inqFkAATB7cp2Dax7XBi9VDvSg9RCCZufmRk/go-block-format"
+
+	vmerrors "github.com/filecoin-project/go-filecoin/vm/errors"
+)
+
+// compressedChunkPrefix starts the stored data of a compressed chunk. It is
+// the CBOR break code, which can't start a CBOR item, so it can't be mistaken
+// for the start of an uncompressed chunk.
+const compressedChunkPrefix = 0xff
+
+// compressBlocks returns blks with the data of each compressed, keeping its
+// cid, which is still that of the uncompressed data. Blocks that compression
+// wouldn't make smaller are returned as they are.
+func compressBlocks(blks []blocks.Block) ([]blocks.Block, error) {
+	out := make([]blocks.Block, len(blks))
+	for i, blk := range blks {
+		var buf bytes.Buffer
+		buf.WriteByte(compressedChunkPrefix)
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, vmerrors.FaultErrorWrap(err, "could not compress chunks during flush")
+		}
+		if _, err := w.Write(blk.RawData()); err != nil {
+			return nil, vmerrors.FaultErrorWrapf(err, "could not compress chunk %s during flush", blk.Cid())
+		}
+		if err := w.Close(); err != nil {
+			return nil, vmerrors.FaultErrorWrapf(err, "could not compress chunk %s during flush", blk.Cid())
+		}
+
+		if buf.Len() >= len(blk.RawData()) {
+			out[i] = blk
+			continue
+		}
+		if out[i], err = blocks.NewBlockWithCid(buf.Bytes(), blk.Cid()); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// decompressBlock returns blk with its data decompressed, if it was stored
+// compressed by compressBlocks, or blk itself otherwise.
+func decompressBlock(blk blocks.Block) (blocks.Block, error) {
+	data := blk.RawData()
+	if len(data) == 0 || data[0] != compressedChunkPrefix {
+		return blk, nil
+	}
+
+	r := flate.NewReader(bytes.NewReader(data[1:]))
+	defer r.Close() // nolint: errcheck
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, vmerrors.FaultErrorWrapf(err, "could not decompress chunk %s", blk.Cid())
+	}
+	return blocks.NewBlockWithCid(raw, blk.Cid())
+}
@@ -35,7 +35,7 @@ func TestVMContextStorage(t *testing.T) {
 	cstate := state.NewCachedStateTree(st)
 
 	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
-	vms := NewStorageMap(bs)
+	vms := NewStorageMap(bs, StorageMapOptions{})
 
 	toActor, err := account.NewActor(nil)
 	assert.NoError(err)
@@ -85,7 +85,7 @@ func TestVMContextSendFailures(t *testing.T) {
 	mockStateTree.BuiltinActors[fakeActorCid] = &actor.FakeActor{}
 	tree := state.NewCachedStateTree(&mockStateTree)
 	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
-	vms := NewStorageMap(bs)
+	vms := NewStorageMap(bs, StorageMapOptions{})
 
 	vmCtxParams := NewContextParams{
 		From:        actor1,
@@ -276,7 +276,7 @@ func TestVMContextIsAccountActor(t *testing.T) {
 	require := require.New(t)
 
 	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
-	vms := NewStorageMap(bs)
+	vms := NewStorageMap(bs, StorageMapOptions{})
 
 	accountActor, err := account.NewActor(types.NewAttoFILFromFIL(1000))
 	require.NoError(err)
@@ -0,0 +1,96 @@
+package vm
+
+import (
+	"sync"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	"gx/ipfs/QmS2aqUZLJp8kF1ihE5rvDGE5LvmKDPnx32w9Z1BW9xLV5/go-ipfs-blockstore"
+	blocks "gx/ipfs/QmWoXtvgC8inqFkAATB7cp2Dax7XBi9VDvSg9RCCZufmRk/go-block-format"
+)
+
+// BlockstoreStats are counts of the calls made to an InstrumentedBlockstore.
+type BlockstoreStats struct {
+	// Gets and GetBytes count blocks successfully read and their size.
+	Gets     uint64
+	GetBytes uint64
+	// Puts and PutBytes count blocks written, by Put or PutMany, and their size.
+	Puts     uint64
+	PutBytes uint64
+	// Has counts calls to Has.
+	Has uint64
+}
+
+// InstrumentedBlockstore wraps a blockstore, counting the blocks read and
+// written through it. Wrapping the blockstore given to NewStorageMap measures
+// the load storage flushes put on the datastore.
+type InstrumentedBlockstore struct {
+	blockstore.Blockstore
+
+	lk    sync.Mutex
+	stats BlockstoreStats
+}
+
+var _ blockstore.Blockstore = (*InstrumentedBlockstore)(nil)
+
+// NewInstrumentedBlockstore returns an InstrumentedBlockstore wrapping bs.
+func NewInstrumentedBlockstore(bs blockstore.Blockstore) *InstrumentedBlockstore {
+	return &InstrumentedBlockstore{Blockstore: bs}
+}
+
+// Stats returns the counts of calls made so far.
+func (ibs *InstrumentedBlockstore) Stats() BlockstoreStats {
+	ibs.lk.Lock()
+	defer ibs.lk.Unlock()
+	return ibs.stats
+}
+
+// Get implements blockstore.Blockstore.
+func (ibs *InstrumentedBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	blk, err := ibs.Blockstore.Get(c)
+	if err != nil {
+		return nil, err
+	}
+
+	ibs.lk.Lock()
+	defer ibs.lk.Unlock()
+	ibs.stats.Gets++
+	ibs.stats.GetBytes += uint64(len(blk.RawData()))
+	return blk, nil
+}
+
+// Has implements blockstore.Blockstore.
+func (ibs *InstrumentedBlockstore) Has(c cid.Cid) (bool, error) {
+	ibs.lk.Lock()
+	ibs.stats.Has++
+	ibs.lk.Unlock()
+	return ibs.Blockstore.Has(c)
+}
+
+// Put implements blockstore.Blockstore.
+func (ibs *InstrumentedBlockstore) Put(blk blocks.Block) error {
+	if err := ibs.Blockstore.Put(blk); err != nil {
+		return err
+	}
+
+	ibs.countPuts([]blocks.Block{blk})
+	return nil
+}
+
+// PutMany implements blockstore.Blockstore.
+func (ibs *InstrumentedBlockstore) PutMany(blks []blocks.Block) error {
+	if err := ibs.Blockstore.PutMany(blks); err != nil {
+		return err
+	}
+
+	ibs.countPuts(blks)
+	return nil
+}
+
+func (ibs *InstrumentedBlockstore) countPuts(blks []blocks.Block) {
+	ibs.lk.Lock()
+	defer ibs.lk.Unlock()
+	for _, blk := range blks {
+		ibs.stats.Puts++
+		ibs.stats.PutBytes += uint64(len(blk.RawData()))
+	}
+}
@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"testing"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	cbor "gx/ipfs/QmRoARq3nkUb13HSKZGepCZSWe5GrVPwx7xURJGZ7KWv9V/go-ipld-cbor"
+	"gx/ipfs/QmS2aqUZLJp8kF1ihE5rvDGE5LvmKDPnx32w9Z1BW9xLV5/go-ipfs-blockstore"
+	"gx/ipfs/Qmf4xQhNomPNhrtZc67qSnfJSjxjXs9LWvknJtSXwimPrM/go-datastore"
+
+	"github.com/filecoin-project/go-filecoin/actor"
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrumentedBlockstore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := NewInstrumentedBlockstore(blockstore.NewBlockstore(datastore.NewMapDatastore()))
+	storage := NewStorageMap(bs, StorageMapOptions{})
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	leaf, err := cbor.WrapObject([]byte("leaf"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+	leafCid, err := stage.Put(leaf.RawData())
+	require.NoError(err)
+
+	// An unlinked chunk isn't part of the live set and isn't flushed.
+	garbage, err := cbor.WrapObject([]byte("garbage"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+	_, err = stage.Put(garbage.RawData())
+	require.NoError(err)
+
+	root, err := cbor.WrapObject([]cid.Cid{leafCid}, types.DefaultHashFunction, -1)
+	require.NoError(err)
+	rootCid, err := stage.Put(root.RawData())
+	require.NoError(err)
+	require.NoError(stage.Commit(rootCid, stage.Head()))
+
+	require.NoError(storage.Flush())
+
+	stats := bs.Stats()
+	assert.Equal(uint64(2), stats.Puts)
+	assert.Equal(uint64(len(leaf.RawData())+len(root.RawData())), stats.PutBytes)
+	assert.Equal(uint64(0), stats.Gets)
+
+	blk, err := bs.Get(leafCid)
+	require.NoError(err)
+	_, err = bs.Get(garbage.Cid())
+	assert.Error(err)
+	has, err := bs.Has(rootCid)
+	require.NoError(err)
+	assert.True(has)
+
+	stats = bs.Stats()
+	assert.Equal(uint64(1), stats.Gets)
+	assert.Equal(uint64(len(blk.RawData())), stats.GetBytes)
+	assert.Equal(uint64(1), stats.Has)
+}
@@ -0,0 +1,104 @@
+package vm
+
+import (
+	"fmt"
+
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	ipld "gx/ipfs/QmcKKBwfz6FyQdHR2jsXrrF6XeSBXYL86anmWNewpFpoF5/go-ipld-format"
+
+	"github.com/filecoin-project/go-filecoin/address"
+)
+
+// SnapshotID identifies a snapshot of a StorageMap taken by Snapshot.
+type SnapshotID int
+
+// storageSnapshot is the state of a single actor's storage in a snapshot.
+type storageSnapshot struct {
+	chunks map[cid.Cid]ipld.Node
+	head   cid.Cid
+}
+
+// Snapshot records the chunks staged in the map and the heads of its actors,
+// so they can be restored by Revert, e.g. if a message executed speculatively
+// fails. Each snapshot holds a copy of every actor's staged chunks until it
+// is released by Release, or discarded by a Revert to an earlier one.
+func (s *storageMap) Snapshot() SnapshotID {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	snapshot := make(map[address.Address]storageSnapshot, len(s.storageMap))
+	for addr, storage := range s.storageMap {
+		storage.fence.lk.RLock()
+		chunks := make(map[cid.Cid]ipld.Node, len(storage.chunks))
+		for c, n := range storage.chunks {
+			chunks[c] = n
+		}
+		snapshot[addr] = storageSnapshot{chunks: chunks, head: storage.actor.Head}
+		storage.fence.lk.RUnlock()
+	}
+
+	s.snapshots = append(s.snapshots, snapshot)
+	return SnapshotID(len(s.snapshots) - 1)
+}
+
+// Revert restores the chunks staged in the map and the heads of its actors to
+// what they were when the snapshot id was taken. Chunks staged since are
+// discarded, and storage for actors created since is removed from the map.
+// Snapshots taken after id can no longer be reverted to, while id itself can
+// be reverted to again.
+func (s *storageMap) Revert(id SnapshotID) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if id < 0 || int(id) >= len(s.snapshots) {
+		return fmt.Errorf("unknown snapshot %d", id)
+	}
+	snapshot := s.snapshots[id]
+	s.dropSnapshots(int(id) + 1)
+
+	for addr, storage := range s.storageMap {
+		saved, ok := snapshot[addr]
+		if !ok {
+			delete(s.storageMap, addr)
+			continue
+		}
+
+		// The chunks map is shared by copies of the storage, so restore it
+		// in place.
+		storage.fence.lk.Lock()
+		for c := range storage.chunks {
+			delete(storage.chunks, c)
+		}
+		for c, n := range saved.chunks {
+			storage.chunks[c] = n
+		}
+		storage.actor.Head = saved.head
+		storage.fence.generation++
+		storage.fence.lk.Unlock()
+	}
+
+	return nil
+}
+
+// Release discards the snapshot id and any taken after it, keeping the
+// changes made since, e.g. once a message executed speculatively succeeds.
+// Snapshots taken before id can still be reverted to.
+func (s *storageMap) Release(id SnapshotID) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if id < 0 || int(id) >= len(s.snapshots) {
+		return fmt.Errorf("unknown snapshot %d", id)
+	}
+	s.dropSnapshots(int(id))
+	return nil
+}
+
+// dropSnapshots discards the snapshots from the nth on, clearing them so the
+// chunks they hold can be collected. s.lk must be held.
+func (s *storageMap) dropSnapshots(n int) {
+	for i := n; i < len(s.snapshots); i++ {
+		s.snapshots[i] = nil
+	}
+	s.snapshots = s.snapshots[:n]
+}
@@ -1,7 +1,15 @@
 package vm
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
 	cbor "gx/ipfs/QmRoARq3nkUb13HSKZGepCZSWe5GrVPwx7xURJGZ7KWv9V/go-ipld-cbor"
@@ -20,6 +28,17 @@ import (
 // ErrNotFound is returned by storage when no chunk in storage matches a requested Cid
 var ErrNotFound = errors.New("chunk not found")
 
+// ErrConcurrentModification is returned by a flush when storage it was
+// flushing was modified during the flush. If the modification was made before
+// the flush started writing, nothing is written. Otherwise the chunks written
+// are those live when the flush started. Either way, flush again to write the
+// modifications.
+var ErrConcurrentModification = errors.New("storage modified during flush")
+
+// ErrReadOnly is returned by the methods of a read-only Storage that would
+// modify it.
+var ErrReadOnly = errors.New("storage is read-only")
+
 // Content-addressed storage API.
 // The storage API has a few goals:
 // 1. Provide access to content-addressed persistent storage
@@ -27,26 +46,188 @@ var ErrNotFound = errors.New("chunk not found")
 // 3. Isolate staged changes across actors to reduce concurrency/message ordering issues.
 // 4. Associate storage with actors by managing actor.Head.
 
+// WriteAheadLog records blocks before a flush writes them to the blockstore, so
+// that a flush interrupted by a crash can be replayed on restart.
+type WriteAheadLog interface {
+	// Append durably records blocks that are about to be written.
+	Append(blks []blocks.Block) error
+	// Truncate discards the log once its blocks have been written.
+	Truncate() error
+}
+
+// StorageMapOptions configures a StorageMap and the Storages it returns. The
+// zero value is the default configuration.
+type StorageMapOptions struct {
+	// WAL, if set, has blocks appended to it before flushes write them, and
+	// is truncated once they are written.
+	WAL WriteAheadLog
+	// CacheSize is the number of the chunks most recently read from the
+	// blockstore that are cached, so that repeated reads of them are served
+	// from memory. Flushes drop the chunks they write from the cache. Zero
+	// disables the cache.
+	CacheSize int
+	// FlushDeadline bounds how long a flush waits for the blockstore write.
+	// A flush that takes longer returns a fault error, though the write
+	// itself is not interrupted and may still complete. Zero means no
+	// deadline.
+	FlushDeadline time.Duration
+	// SkipExisting makes flushes check which chunks the blockstore already
+	// has and write only the others. This trades a Has call per live chunk
+	// for fewer writes, which is a win when re-flushing mostly unchanged
+	// state to a blockstore that is expensive to write to but cheap to query.
+	SkipExisting bool
+	// StrictFlush makes flushes rehash every chunk they are about to write
+	// and check the result against the chunk's cid. If any chunk doesn't
+	// match, e.g. because its bytes were modified in memory after it was Put,
+	// the flush returns a fault error and writes nothing. This costs a hash
+	// per live chunk.
+	StrictFlush bool
+	// CompactBelow is a size threshold below which flushes pack the leaf
+	// chunks they write into a single container block instead of writing
+	// each of them. Actor heads are never packed. Packed chunks can still be
+	// retrieved by their own cids, through an index written to the
+	// blockstore along with the containers; they are not individually
+	// present in the blockstore. Zero disables compaction.
+	CompactBelow int
+	// PackIndex is the root of the index of packed chunks to open, as
+	// returned by PackIndex of the map that packed them, e.g. before a
+	// restart. The index is read the first time a chunk is looked up in it,
+	// and compacting flushes add to it.
+	PackIndex cid.Cid
+	// Compress makes flushes compress the chunks they write. A compressed
+	// chunk keeps the cid of its uncompressed data, and is decompressed when
+	// retrieved through any Storage, but other readers of the blockstore see
+	// the compressed data. Chunks that compression wouldn't make smaller are
+	// written uncompressed.
+	Compress bool
+	// HashFunction is the multihash function the cids of chunks put into a
+	// Storage are computed with. Zero means types.DefaultHashFunction.
+	// Chunks put as blocks keep the cids they have.
+	HashFunction uint64
+	// Metrics, if set, is reported to by the Storages and flushes of the map.
+	Metrics StorageMetrics
+	// BaseStore is a read-only blockstore underlying the map's blockstore,
+	// such as a shared snapshot that a writable overlay is layered on.
+	// Flushes don't write chunks the base already has, and chunks in the
+	// base may be retrieved and linked to as if they were in the map's
+	// blockstore. Nothing is ever written to the base.
+	BaseStore blockstore.Blockstore
+	// Backup, if set, receives after each successful flush of the map a CAR
+	// holding the chunks flushed with the flushed actors' heads as its
+	// roots. CARs are written in the background in the order of the flushes.
+	// If the writer falls too far behind, CARs are dropped rather than
+	// holding up flushes; see BackupDropped. Flushes of a Storage returned by
+	// the map are not backed up.
+	Backup io.Writer
+}
+
+// storageConfig is the configuration shared by a StorageMap and the Storages
+// it returns. It doesn't change once they are created.
+type storageConfig struct {
+	blockstore    blockstore.Blockstore
+	base          blockstore.Blockstore
+	wal           WriteAheadLog
+	flushDeadline time.Duration
+	skipExisting  bool
+	strictFlush   bool
+	compactBelow  int
+	packs         *packIndex
+	compress      bool
+	hashFunction  uint64
+	cache         *chunkCache
+	metrics       StorageMetrics
+}
+
+// newStorageConfig returns the configuration for a StorageMap for bs with the
+// given options.
+func newStorageConfig(bs blockstore.Blockstore, opts StorageMapOptions) *storageConfig {
+	cfg := &storageConfig{
+		blockstore:    bs,
+		base:          opts.BaseStore,
+		wal:           opts.WAL,
+		flushDeadline: opts.FlushDeadline,
+		skipExisting:  opts.SkipExisting,
+		strictFlush:   opts.StrictFlush,
+		compactBelow:  opts.CompactBelow,
+		compress:      opts.Compress,
+		hashFunction:  opts.HashFunction,
+		metrics:       opts.Metrics,
+	}
+	if opts.CompactBelow > 0 || opts.PackIndex.Defined() {
+		cfg.packs = newPackIndex(bs, opts.PackIndex)
+	}
+	if opts.CacheSize > 0 {
+		cfg.cache = newChunkCache(opts.CacheSize)
+	}
+	if cfg.hashFunction == 0 {
+		cfg.hashFunction = types.DefaultHashFunction
+	}
+	if cfg.metrics == nil {
+		cfg.metrics = nopStorageMetrics{}
+	}
+	return cfg
+}
+
 // storageMap implements StorageMap as a map of Storage structs keyed by actor address.
 type storageMap struct {
-	blockstore blockstore.Blockstore
+	*storageConfig
+	backup        *backupQueue
+	backupDropped uint64
+
+	// lk guards the fields below. Flushes hold it for reading, so that
+	// NewStorage and reverting to snapshots wait for them.
+	lk         sync.RWMutex
+	snapshots  []map[address.Address]storageSnapshot
 	storageMap map[address.Address]Storage
 }
 
-// StorageMap manages Storages.
+// StorageMap manages Storages. Its methods may be called concurrently, e.g.
+// NewStorage for different actors from goroutines processing different
+// messages. Flushes of the map run concurrently with each other, while
+// NewStorage and snapshot operations wait for flushes in progress. A Storage
+// returned by NewStorage is safe to use concurrently with the map.
 type StorageMap interface {
 	NewStorage(addr address.Address, actor *actor.Actor) Storage
 	Flush() error
+	FlushReport() (map[address.Address]ActorFlushResult, error)
+	FlushAddrs(addrs []address.Address) error
+	CommitBatch(ops []CommitOp) error
+	Snapshot() SnapshotID
+	Revert(id SnapshotID) error
+	Release(id SnapshotID) error
+	PackIndex() cid.Cid
+	BackupDropped() uint64
+	Close()
+}
+
+// CommitOp is a single head update in a StorageMap.CommitBatch.
+type CommitOp struct {
+	Addr   address.Address
+	NewCid cid.Cid
+	OldCid cid.Cid
+}
+
+// ActorFlushResult describes what a flush wrote for a single actor.
+type ActorFlushResult struct {
+	// Blocks is the number of the actor's chunks written.
+	Blocks int
+	// Bytes is the total size of those chunks.
+	Bytes int
 }
 
 var _ StorageMap = &storageMap{}
 
-// NewStorageMap returns a storage object for the given datastore.
-func NewStorageMap(bs blockstore.Blockstore) StorageMap {
-	return &storageMap{
-		blockstore: bs,
-		storageMap: map[address.Address]Storage{},
+// NewStorageMap returns a storage object for the given datastore, configured
+// with the given options.
+func NewStorageMap(bs blockstore.Blockstore, opts StorageMapOptions) StorageMap {
+	s := &storageMap{
+		storageConfig: newStorageConfig(bs, opts),
+		storageMap:    map[address.Address]Storage{},
 	}
+	if opts.Backup != nil {
+		s.backup = newBackupQueue(opts.Backup, &s.backupDropped)
+	}
+	return s
 }
 
 // NewStorage gets or creates a Storage for the given address
@@ -54,17 +235,16 @@ func NewStorageMap(bs blockstore.Blockstore) StorageMap {
 // The instance of actor passed into this method needs to be the instance ultimately
 // persisted.
 func (s *storageMap) NewStorage(addr address.Address, actor *actor.Actor) Storage {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
 	storage, ok := s.storageMap[addr]
 	if ok {
 		// Return a hybrid storage with the pre-existing chunks, but the given instance of the actor.
 		// This ensures changes made to the actor appear in the state tree cache.
-		storage = Storage{
-			actor:      actor,
-			chunks:     storage.chunks,
-			blockstore: s.blockstore,
-		}
+		storage.actor = actor
 	} else {
-		storage = NewStorage(s.blockstore, actor)
+		storage = newStorage(s.storageConfig, actor)
 	}
 
 	s.storageMap[addr] = storage
@@ -72,81 +252,605 @@ func (s *storageMap) NewStorage(addr address.Address, actor *actor.Actor) Storag
 	return storage
 }
 
-// Flush saves all valid staged changes to the datastore
+// PackIndex returns the root of the index of the chunks packed by compacting
+// flushes of the map, or cid.Undef if none have been.
+func (s *storageMap) PackIndex() cid.Cid {
+	return s.packs.rootCid()
+}
+
+// BackupDropped returns the number of flushes whose CARs were not written to
+// the backup, because too many were queued or writing failed.
+func (s *storageMap) BackupDropped() uint64 {
+	return atomic.LoadUint64(&s.backupDropped)
+}
+
+// Close stops writing to the backup, if there is one, once the CARs already
+// queued for it are written. The map must not be flushed afterwards.
+func (s *storageMap) Close() {
+	if s.backup != nil {
+		s.backup.close()
+	}
+}
+
+// CommitBatch commits each op as Storage.Commit would, to the storage of the
+// actor at op.Addr. Every op is validated before any head is updated, so if
+// any op would fail no head is changed. Each actor may appear at most once.
+// The storages of all the actors are locked, in order of address, for the
+// whole batch, so no other commit to them can come between its validation and
+// its update.
+func (s *storageMap) CommitBatch(ops []CommitOp) error {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+
+	storages := make([]Storage, len(ops))
+	for i, op := range ops {
+		for _, prev := range ops[:i] {
+			if prev.Addr == op.Addr {
+				return fmt.Errorf("actor %s appears more than once in commit batch", op.Addr)
+			}
+		}
+
+		storage, ok := s.storageMap[op.Addr]
+		if !ok {
+			return fmt.Errorf("no storage for actor %s", op.Addr)
+		}
+		storages[i] = storage
+	}
+
+	order := make([]int, len(ops))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(ops[order[i]].Addr.Bytes(), ops[order[j]].Addr.Bytes()) < 0
+	})
+	for _, i := range order {
+		storages[i].fence.lk.Lock()
+		defer storages[i].fence.lk.Unlock()
+	}
+
+	for i, op := range ops {
+		if err := storages[i].validateCommit(op.NewCid, op.OldCid); err != nil {
+			return err
+		}
+	}
+	for i, op := range ops {
+		storages[i].actor.Head = op.NewCid
+		storages[i].fence.generation++
+	}
+
+	return nil
+}
+
+// Flush saves all valid staged changes to the datastore. The chunks reachable
+// from every actor's head are validated before anything is written, so if any
+// actor's storage links to a missing chunk nothing is written at all. Actors
+// whose heads haven't moved since they were last flushed, or since their
+// storage was created, are skipped.
 func (s *storageMap) Flush() error {
-	for _, storage := range s.storageMap {
-		err := storage.Flush()
+	_, err := s.FlushReport()
+	return err
+}
+
+// FlushReport flushes like Flush and reports what was written for each actor
+// with storage in the map. Actors with nothing staged report zero. A chunk
+// reachable from more than one actor's head is counted for each of them,
+// though it is only written once. If an actor's storage is modified while it
+// is written, the report is also returned with ErrConcurrentModification,
+// since the chunks were written.
+func (s *storageMap) FlushReport() (map[address.Address]ActorFlushResult, error) {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+
+	report := make(map[address.Address]ActorFlushResult, len(s.storageMap))
+	var blks []blocks.Block
+	var roots []cid.Cid
+	var flushed []Storage
+	var heads []cid.Cid
+	var generations []uint64
+	for addr, storage := range s.storageMap {
+		// Actors whose heads haven't moved have nothing to flush, so skip
+		// walking their state.
+		if !storage.dirty() {
+			report[addr] = ActorFlushResult{}
+			continue
+		}
+
+		live, head, generation, err := storage.snapshotWithHead()
+		if err != nil {
+			return nil, err
+		}
+		if head.Defined() {
+			roots = append(roots, head)
+		}
+		flushed = append(flushed, storage)
+		heads = append(heads, head)
+		generations = append(generations, generation)
+
+		result := ActorFlushResult{Blocks: len(live)}
+		for _, blk := range live {
+			result.Bytes += len(blk.RawData())
+		}
+		report[addr] = result
+		blks = append(blks, live...)
+	}
+
+	if err := s.putBlocks(roots, blks, flushed, generations); err != nil {
+		return nil, err
+	}
+	for i, storage := range flushed {
+		storage.markFlushed(heads[i])
+	}
+	s.backUp(roots, blks)
+	if anyModifiedSince(flushed, generations) {
+		return report, ErrConcurrentModification
+	}
+	return report, nil
+}
+
+// FlushAddrs saves the valid staged changes of only the actors at the given
+// addresses to the datastore, validating all of them before writing any. It
+// returns an error if any address has no storage in the map, and
+// ErrConcurrentModification if any of the storage is modified during the
+// flush.
+func (s *storageMap) FlushAddrs(addrs []address.Address) error {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+
+	var blks []blocks.Block
+	var roots []cid.Cid
+	storages := make([]Storage, len(addrs))
+	heads := make([]cid.Cid, len(addrs))
+	generations := make([]uint64, len(addrs))
+	for i, addr := range addrs {
+		storage, ok := s.storageMap[addr]
+		if !ok {
+			return fmt.Errorf("no storage for actor %s", addr)
+		}
+
+		live, head, generation, err := storage.snapshotWithHead()
 		if err != nil {
 			return err
 		}
+		if head.Defined() {
+			roots = append(roots, head)
+		}
+		blks = append(blks, live...)
+		storages[i], heads[i], generations[i] = storage, head, generation
 	}
 
+	if err := s.putBlocks(roots, blks, storages, generations); err != nil {
+		return err
+	}
+	for i, storage := range storages {
+		storage.markFlushed(heads[i])
+	}
+	s.backUp(roots, blks)
+	if anyModifiedSince(storages, generations) {
+		return ErrConcurrentModification
+	}
+	return nil
+}
+
+// putBlocks writes the blocks flushed from the map, compacting them if
+// compaction is enabled. It writes nothing and returns
+// ErrConcurrentModification if any of the storages they were found in has
+// been modified since it was at the corresponding generation.
+func (s *storageMap) putBlocks(roots []cid.Cid, blks []blocks.Block, storages []Storage, generations []uint64) error {
+	blks, err := notInBase(s.base, blks)
+	if err != nil {
+		return err
+	}
+	packed, node, err := s.packs.pack(s.compactBelow, s.hashFunction, roots, blks)
+	if err != nil {
+		return err
+	}
+	if s.compress {
+		if packed, err = compressBlocks(packed); err != nil {
+			return err
+		}
+	}
+	if anyModifiedSince(storages, generations) {
+		return ErrConcurrentModification
+	}
+	if err := putBlocks(context.Background(), s.blockstore, s.wal, s.flushDeadline, s.skipExisting, packed); err != nil {
+		return err
+	}
+	if err := s.packs.add(s.hashFunction, node); err != nil {
+		return err
+	}
+	s.cache.remove(blks)
+	s.metrics.OnFlush(len(packed), blocksSize(packed))
 	return nil
 }
 
+// backUp queues a CAR of flushed blocks for the backup, if there is one and
+// anything was flushed.
+func (s *storageMap) backUp(roots []cid.Cid, blks []blocks.Block) {
+	if s.backup == nil || len(roots) == 0 {
+		return
+	}
+	s.backup.enqueue(roots, blks)
+}
+
 // Storage is a place to hold chunks that are created while processing a block.
 type Storage struct {
-	actor      *actor.Actor
-	chunks     map[cid.Cid]ipld.Node
-	blockstore blockstore.Blockstore
+	*storageConfig
+	actor    *actor.Actor
+	chunks   map[cid.Cid]ipld.Node
+	fence    *flushFence
+	readOnly bool
 }
 
 var _ exec.Storage = (*Storage)(nil)
 
+// flushFence guards a Storage's chunks and its actor's head, which are shared
+// by copies of the Storage, so they can be flushed while being modified. It
+// counts modifications that change what would be flushed, so a flush can tell
+// whether any were made while it was writing. It also records the head last
+// flushed, so flushes of a StorageMap can skip actors whose heads haven't
+// moved since.
+type flushFence struct {
+	lk         sync.RWMutex
+	generation uint64
+	flushed    cid.Cid
+}
+
 // NewStorage creates a datastore backed storage object for the given actor
 func NewStorage(bs blockstore.Blockstore, act *actor.Actor) Storage {
+	return newStorage(newStorageConfig(bs, StorageMapOptions{}), act)
+}
+
+// newStorage creates a storage object for the given actor with the given
+// configuration.
+func newStorage(cfg *storageConfig, act *actor.Actor) Storage {
 	return Storage{
-		chunks:     map[cid.Cid]ipld.Node{},
-		actor:      act,
-		blockstore: bs,
+		storageConfig: cfg,
+		chunks:        map[cid.Cid]ipld.Node{},
+		fence:         &flushFence{flushed: act.Head},
+		actor:         act,
 	}
 }
 
+// NewReadOnlyStorage creates a datastore backed storage object for the given
+// actor that can't be modified, e.g. to hand to code querying actor state.
+// Put, Delete, Commit and Prune return ErrReadOnly, while Get and Head work as
+// usual.
+func NewReadOnlyStorage(bs blockstore.Blockstore, act *actor.Actor) Storage {
+	return NewStorage(bs, act).ReadOnly()
+}
+
+// ReadOnly returns a view of the storage that can't be used to modify it, as
+// NewReadOnlyStorage does. The view sees modifications made through s.
+func (s Storage) ReadOnly() Storage {
+	s.readOnly = true
+	return s
+}
+
 // Put adds a node to temporary storage by id.
 func (s Storage) Put(v interface{}) (cid.Cid, error) {
+	if s.readOnly {
+		return cid.Undef, ErrReadOnly
+	}
+
 	var nd format.Node
 	var err error
 	if blk, ok := v.(blocks.Block); ok {
 		// optimize putting blocks
 		nd, err = cbor.DecodeBlock(blk)
 	} else if bytes, ok := v.([]byte); ok {
-		nd, err = cbor.Decode(bytes, types.DefaultHashFunction, -1)
+		nd, err = cbor.Decode(bytes, s.hashFunction, -1)
 	} else {
-		nd, err = cbor.WrapObject(v, types.DefaultHashFunction, -1)
+		nd, err = cbor.WrapObject(v, s.hashFunction, -1)
 	}
 	if err != nil {
 		return cid.Undef, exec.Errors[exec.ErrDecode]
 	}
 
+	s.metrics.OnPut()
+
 	c := nd.Cid()
+	s.fence.lk.Lock()
+	defer s.fence.lk.Unlock()
 	s.chunks[c] = nd
+	s.fence.generation++
 
 	return c, nil
 }
 
+// PutMany adds the chunks, given as cbor encoded nodes, to temporary storage
+// and returns their ids in the same order. If any chunk fails to decode
+// nothing is added.
+func (s Storage) PutMany(chunks [][]byte) ([]cid.Cid, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	nds := make([]format.Node, len(chunks))
+	for i, chunk := range chunks {
+		nd, err := cbor.Decode(chunk, s.hashFunction, -1)
+		if err != nil {
+			return nil, exec.Errors[exec.ErrDecode]
+		}
+		nds[i] = nd
+	}
+	for range nds {
+		s.metrics.OnPut()
+	}
+
+	cids := make([]cid.Cid, len(nds))
+	s.fence.lk.Lock()
+	defer s.fence.lk.Unlock()
+	for i, nd := range nds {
+		cids[i] = nd.Cid()
+		s.chunks[cids[i]] = nd
+	}
+	if len(nds) > 0 {
+		s.fence.generation++
+	}
+
+	return cids, nil
+}
+
 // Get retrieves a chunk from either temporary storage or its backing store.
 // If the chunk is not found in storage, a vm.ErrNotFound error is returned.
+// The returned bytes may share memory with the staged chunk, so callers must
+// not modify them; use GetCopy for bytes that are safe to modify.
 func (s Storage) Get(cid cid.Cid) ([]byte, error) {
+	return s.GetContext(context.Background(), cid)
+}
+
+// GetContext is like Get, but gives up reading from the backing store when
+// ctx is done, returning ctx.Err().
+func (s Storage) GetContext(ctx context.Context, cid cid.Cid) ([]byte, error) {
+	blk, err := s.rawGet(ctx, cid)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return blk.RawData(), nil
+}
+
+// GetCopy is like Get, but returns a copy of the chunk that the caller may
+// modify without affecting storage.
+func (s Storage) GetCopy(cid cid.Cid) ([]byte, error) {
+	chunk, err := s.Get(cid)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return append([]byte{}, chunk...), nil
+}
+
+// RawGet retrieves a chunk as a block, with its cid, from either temporary
+// storage or its backing store.
+// If the chunk is not found in storage, a vm.ErrNotFound error is returned.
+func (s Storage) RawGet(cid cid.Cid) (blocks.Block, error) {
+	return s.rawGet(context.Background(), cid)
+}
+
+// rawGet is RawGet, but gives up reading from the backing store when ctx is
+// done, returning ctx.Err().
+func (s Storage) rawGet(ctx context.Context, cid cid.Cid) (blocks.Block, error) {
+	s.fence.lk.RLock()
 	n, ok := s.chunks[cid]
+	s.fence.lk.RUnlock()
 	if ok {
-		return n.RawData(), nil
+		s.metrics.OnGet(true)
+		return n, nil
+	}
+	if blk, ok := s.cache.get(cid); ok {
+		s.metrics.OnGet(true)
+		return blk, nil
 	}
+	s.metrics.OnGet(false)
 
-	blk, err := s.blockstore.Get(cid)
-	if err != nil {
+	var blk blocks.Block
+	err := withContext(ctx, func() error {
+		var err error
+		blk, err = s.blockstore.Get(cid)
+		if err == blockstore.ErrNotFound && s.base != nil {
+			blk, err = s.base.Get(cid)
+		}
 		if err == blockstore.ErrNotFound {
-			return []byte{}, ErrNotFound
+			blk, err = s.packs.get(cid)
+		} else if err == nil {
+			blk, err = decompressBlock(blk)
 		}
-		return []byte{}, err
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return blk.RawData(), nil
+	s.cache.add(blk)
+	return blk, nil
+}
+
+// withContext calls fn and returns its error, unless ctx is done first, in
+// which case it returns ctx.Err() without waiting for fn to return.
+func withContext(ctx context.Context, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Has returns whether a chunk is in either temporary storage or its backing
+// store, without reading it, e.g. to check for optional state before loading
+// it.
+func (s Storage) Has(c cid.Cid) (bool, error) {
+	s.fence.lk.RLock()
+	_, ok := s.chunks[c]
+	s.fence.lk.RUnlock()
+	if ok {
+		return true, nil
+	}
+	if _, ok := s.cache.get(c); ok {
+		return true, nil
+	}
+
+	has, err := s.blockstore.Has(c)
+	if err == nil && !has && s.base != nil {
+		has, err = s.base.Has(c)
+	}
+	if err == nil && !has {
+		has, err = s.packs.has(c)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return has, nil
+}
+
+// Delete removes a staged chunk, such as a temporary intermediate node that
+// won't be linked to. It returns ErrNotFound if the chunk isn't staged. Only
+// the stage is changed; the backing store is never touched, so a chunk that
+// was already flushed can still be retrieved from it after being deleted.
+func (s Storage) Delete(c cid.Cid) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	s.fence.lk.Lock()
+	defer s.fence.lk.Unlock()
+
+	if _, ok := s.chunks[c]; !ok {
+		return ErrNotFound
+	}
+	delete(s.chunks, c)
+	s.fence.generation++
+
+	return nil
+}
+
+// Each calls fn with the cid and data of every chunk staged when it is
+// called, in no particular order, stopping at and returning the first error
+// fn returns. The backing store is not iterated. As with Get, fn must not
+// modify the data. fn may modify the storage, which doesn't change the
+// chunks visited.
+func (s Storage) Each(fn func(c cid.Cid, data []byte) error) error {
+	s.fence.lk.RLock()
+	nodes := make([]ipld.Node, 0, len(s.chunks))
+	for _, n := range s.chunks {
+		nodes = append(nodes, n)
+	}
+	s.fence.lk.RUnlock()
+
+	for _, n := range nodes {
+		if err := fn(n.Cid(), n.RawData()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LiveSize returns the number of bytes taken by the chunks reachable from the
+// actor's head, whether they are staged or only in the backing store. Each
+// chunk is counted once however many links point to it. A fault error is
+// returned if any chunk reachable from the head is missing.
+func (s Storage) LiveSize() (int, error) {
+	size := 0
+	visited := cid.NewSet()
+	stack := []cid.Cid{s.Head()}
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !id.Defined() || !visited.Visit(id) {
+			continue
+		}
+
+		blk, err := s.RawGet(id)
+		if err == ErrNotFound {
+			return 0, vmerrors.NewFaultErrorf("linked node, %s, missing from storage", id)
+		}
+		if err != nil {
+			return 0, vmerrors.FaultErrorWrapf(err, "could not get chunk %s", id)
+		}
+		size += len(blk.RawData())
+
+		nd, ok := blk.(ipld.Node)
+		if !ok {
+			if nd, err = cbor.DecodeBlock(blk); err != nil {
+				return 0, vmerrors.FaultErrorWrapf(err, "could not decode chunk %s", id)
+			}
+		}
+		for _, link := range nd.Links() {
+			stack = append(stack, link.Cid)
+		}
+	}
+
+	return size, nil
+}
+
+// StagedBlocks returns the blocks for all chunks staged in this storage, whether
+// or not they are reachable from the head, ordered by cid.
+func (s Storage) StagedBlocks() []blocks.Block {
+	s.fence.lk.RLock()
+	defer s.fence.lk.RUnlock()
+
+	blks := make([]blocks.Block, 0, len(s.chunks))
+	for _, n := range s.chunks {
+		blks = append(blks, n)
+	}
+	sort.Slice(blks, func(i, j int) bool {
+		return blks[i].Cid().KeyString() < blks[j].Cid().KeyString()
+	})
+
+	return blks
 }
 
 // Commit updates the head of the current actor to the given cid.
 // The new cid must be the content id of a chunk put in storage.
 // The given oldCid must match the cid of the current actor.
 func (s Storage) Commit(newCid cid.Cid, oldCid cid.Cid) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	s.fence.lk.Lock()
+	defer s.fence.lk.Unlock()
+
+	if err := s.validateCommit(newCid, oldCid); err != nil {
+		return err
+	}
+
+	s.actor.Head = newCid
+	s.fence.generation++
+
+	return nil
+}
+
+// ValidateCommit returns the error Commit would for the given cids, without
+// updating the head, so a commit can be checked before it's made.
+func (s Storage) ValidateCommit(newCid cid.Cid, oldCid cid.Cid) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	s.fence.lk.RLock()
+	defer s.fence.lk.RUnlock()
+	return s.validateCommit(newCid, oldCid)
+}
+
+// validateCommit returns the error Commit would for the given cids, without
+// updating the head. The fence must be held.
+func (s Storage) validateCommit(newCid cid.Cid, oldCid cid.Cid) error {
 	// commit to initialize actor only permitted if Head and expected id are nil
 	if oldCid.Defined() && s.actor.Head.Defined() && !oldCid.Equals(s.actor.Head) {
 		return exec.Errors[exec.ErrStaleHead]
@@ -159,41 +863,220 @@ func (s Storage) Commit(newCid cid.Cid, oldCid cid.Cid) error {
 		return exec.Errors[exec.ErrDanglingPointer]
 	}
 
-	s.actor.Head = newCid
-
 	return nil
 }
 
 // Head return the current head of the actor's memory
 func (s Storage) Head() cid.Cid {
+	s.fence.lk.RLock()
+	defer s.fence.lk.RUnlock()
 	return s.actor.Head
 }
 
 // Prune removes all chunks that are unlinked
 func (s *Storage) Prune() error {
-	liveIds, err := s.liveDescendantIds(s.actor.Head)
-	if err != nil {
-		return err
+	_, err := s.prune()
+	return err
+}
+
+// PruneWithManifest prunes like Prune and returns the cids of the chunks it
+// removed: those staged but not reachable from the head, ordered by cid. If
+// nothing was removed it returns an empty slice.
+func (s *Storage) PruneWithManifest() ([]cid.Cid, error) {
+	return s.prune()
+}
+
+// CommitAndPrune commits newCid as Commit does and then removes all staged
+// chunks that are not reachable from it, returning the number removed.
+func (s *Storage) CommitAndPrune(newCid cid.Cid, oldCid cid.Cid) (int, error) {
+	if err := s.Commit(newCid, oldCid); err != nil {
+		return 0, err
 	}
+	pruned, err := s.prune()
+	return len(pruned), err
+}
 
-	if liveIds.Len() == len(s.chunks) {
-		return nil
+// prune removes all chunks that are unlinked and returns their cids.
+func (s *Storage) prune() ([]cid.Cid, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	s.fence.lk.Lock()
+	defer s.fence.lk.Unlock()
+
+	liveIds, err := s.liveDescendantIds(s.actor.Head)
+	if err != nil {
+		return nil, err
 	}
 
+	pruned := []cid.Cid{}
 	for id := range s.chunks {
 		if !liveIds.Has(id) {
 			delete(s.chunks, id)
+			pruned = append(pruned, id)
 		}
 	}
+	sort.Slice(pruned, func(i, j int) bool { return pruned[i].KeyString() < pruned[j].KeyString() })
 
-	return nil
+	return pruned, nil
 }
 
-// Flush write storage to underlying datastore
+// Flush write storage to underlying datastore. Chunks are keyed by cid, so
+// each unique chunk reachable from the head is written exactly once, no matter
+// how many times it was Put or how many links in the graph point to it.
+// The whole reachable graph is validated before any chunk is written, so a
+// missing link leaves the underlying datastore untouched.
+// Flush may be called while the storage is being modified. If it is modified
+// before the flush starts writing, nothing is written and
+// ErrConcurrentModification is returned. If it is modified while the flush is
+// writing, the chunks live when the flush was called are written and
+// ErrConcurrentModification is also returned.
 func (s *Storage) Flush() error {
+	return s.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush, but gives up writing to the underlying
+// datastore when ctx is done, returning ctx.Err(). Chunks may still be
+// written after it returns.
+func (s *Storage) FlushContext(ctx context.Context) error {
+	_, err := s.flush(ctx)
+	return err
+}
+
+// FlushWithManifest flushes like Flush and returns the cids of the chunks it
+// flushed: those reachable from the head, ordered by cid. If nothing is
+// reachable from the head it returns an empty slice without writing. If the
+// storage is modified while the chunks are being written, the cids are also
+// returned with ErrConcurrentModification, since the chunks were written.
+func (s *Storage) FlushWithManifest() ([]cid.Cid, error) {
+	return s.flush(context.Background())
+}
+
+// flush flushes as FlushWithManifest does, giving up when ctx is done.
+func (s *Storage) flush(ctx context.Context) ([]cid.Cid, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	blks, head, generation, err := s.snapshotWithHead()
+	if err != nil {
+		return nil, err
+	}
+	if len(blks) == 0 {
+		return []cid.Cid{}, nil
+	}
+
+	manifest := make([]cid.Cid, len(blks))
+	for i, blk := range blks {
+		manifest[i] = blk.Cid()
+	}
+	sort.Slice(manifest, func(i, j int) bool { return manifest[i].KeyString() < manifest[j].KeyString() })
+
+	blks, err = notInBase(s.base, blks)
+	if err != nil {
+		return nil, err
+	}
+	packed, node, err := s.packs.pack(s.compactBelow, s.hashFunction, []cid.Cid{head}, blks)
+	if err != nil {
+		return nil, err
+	}
+	if s.compress {
+		if packed, err = compressBlocks(packed); err != nil {
+			return nil, err
+		}
+	}
+	if s.modifiedSince(generation) {
+		return nil, ErrConcurrentModification
+	}
+	if err := putBlocks(ctx, s.blockstore, s.wal, s.flushDeadline, s.skipExisting, packed); err != nil {
+		return nil, err
+	}
+	if err := s.packs.add(s.hashFunction, node); err != nil {
+		return nil, err
+	}
+	s.cache.remove(blks)
+	s.metrics.OnFlush(len(packed), blocksSize(packed))
+
+	s.fence.lk.Lock()
+	defer s.fence.lk.Unlock()
+	s.fence.flushed = head
+	if s.fence.generation != generation {
+		return manifest, ErrConcurrentModification
+	}
+	return manifest, nil
+}
+
+// dirty returns whether the actor's head has moved since it was last flushed,
+// or since the storage was created if it hasn't been flushed. Only a dirty
+// actor can have staged chunks to flush, since chunks are only reachable from
+// the head once it is moved to them.
+func (s Storage) dirty() bool {
+	s.fence.lk.RLock()
+	defer s.fence.lk.RUnlock()
+	return s.actor.Head != s.fence.flushed
+}
+
+// modifiedSince returns whether the storage has been modified since it was at
+// the given generation.
+func (s Storage) modifiedSince(generation uint64) bool {
+	s.fence.lk.RLock()
+	defer s.fence.lk.RUnlock()
+	return s.fence.generation != generation
+}
+
+// anyModifiedSince returns whether any of storages has been modified since it
+// was at the corresponding generation.
+func anyModifiedSince(storages []Storage, generations []uint64) bool {
+	for i, storage := range storages {
+		if storage.modifiedSince(generations[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// markFlushed records that head has been flushed.
+func (s Storage) markFlushed(head cid.Cid) {
+	s.fence.lk.Lock()
+	defer s.fence.lk.Unlock()
+	s.fence.flushed = head
+}
+
+// snapshotWithHead returns the live blocks, as liveBlocks does, the head they
+// are reachable from, and the generation of the storage they were found in.
+func (s Storage) snapshotWithHead() ([]blocks.Block, cid.Cid, uint64, error) {
+	s.fence.lk.RLock()
+	defer s.fence.lk.RUnlock()
+
+	blks, err := s.liveBlocks()
+	if err == nil && s.strictFlush {
+		err = verifyBlocks(blks)
+	}
+	return blks, s.actor.Head, s.fence.generation, err
+}
+
+// verifyBlocks returns a fault error if the data of any of blks doesn't hash
+// to its cid.
+func verifyBlocks(blks []blocks.Block) error {
+	for _, blk := range blks {
+		c, err := blk.Cid().Prefix().Sum(blk.RawData())
+		if err != nil {
+			return vmerrors.FaultErrorWrapf(err, "could not hash chunk %s during flush", blk.Cid())
+		}
+		if !c.Equals(blk.Cid()) {
+			return vmerrors.NewFaultErrorf("chunk %s is corrupt: its data hashes to %s", blk.Cid(), c)
+		}
+	}
+	return nil
+}
+
+// liveBlocks returns the staged chunks reachable from the actor's head, or an
+// error if any chunk reachable from the head is missing. The fence must be held.
+func (s Storage) liveBlocks() ([]blocks.Block, error) {
 	liveIds, err := s.liveDescendantIds(s.actor.Head)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	blks := make([]blocks.Block, 0, liveIds.Len())
@@ -202,43 +1085,146 @@ func (s *Storage) Flush() error {
 		return nil
 	})
 
-	return s.blockstore.PutMany(blks)
+	return blks, nil
 }
 
-// liveDescendantIds returns the ids of all chunks reachable from the given id for this storage.
-// That is the given id , any links in the chunk referenced by the given id, or any links
-// referenced from those links.
-func (s Storage) liveDescendantIds(id cid.Cid) (*cid.Set, error) {
-	if !id.Defined() {
-		return cid.NewSet(), nil
+// putBlocks writes blks as writeBlocks does, but if deadline is positive and
+// the write takes longer, returns a fault error without waiting for it. If ctx
+// is done first, it returns ctx.Err() without waiting. If skipExisting is
+// true, blocks already in bs are not written.
+func putBlocks(ctx context.Context, bs blockstore.Blockstore, wal WriteAheadLog, deadline time.Duration, skipExisting bool, blks []blocks.Block) error {
+	write := func() error {
+		if skipExisting {
+			var err error
+			if blks, err = missingBlocks(bs, blks); err != nil {
+				return err
+			}
+		}
+		return writeBlocks(bs, wal, blks)
+	}
+	if deadline <= 0 {
+		return withContext(ctx, write)
 	}
-	chunk, ok := s.chunks[id]
-	if !ok {
-		has, err := s.blockstore.Has(id)
+
+	writeCtx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	err := withContext(writeCtx, write)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return vmerrors.NewFaultErrorf("flush did not complete within %s", deadline)
+	}
+	return err
+}
+
+// missingBlocks returns the blocks in blks that bs does not have.
+func missingBlocks(bs blockstore.Blockstore, blks []blocks.Block) ([]blocks.Block, error) {
+	missing := make([]blocks.Block, 0, len(blks))
+	for _, blk := range blks {
+		has, err := bs.Has(blk.Cid())
 		if err != nil {
-			return nil, vmerrors.FaultErrorWrapf(err, "linked node, %s, missing from stage during flush", id)
+			return nil, vmerrors.FaultErrorWrapf(err, "could not check for chunk %s during flush", blk.Cid())
 		}
-
-		// unstaged chunk that exists in datastore is valid, but halts recursion.
-		if has {
-			return cid.NewSet(), nil
+		if !has {
+			missing = append(missing, blk)
 		}
+	}
+	return missing, nil
+}
+
+// notInBase returns the blocks in blks that base does not have, or blks if
+// base is nil.
+func notInBase(base blockstore.Blockstore, blks []blocks.Block) ([]blocks.Block, error) {
+	if base == nil {
+		return blks, nil
+	}
+	return missingBlocks(base, blks)
+}
 
-		return nil, vmerrors.NewFaultErrorf("linked node, %s, missing from storage during flush", id)
+// writeBlocks writes blks to bs. If wal is not nil the blocks are appended to it
+// first, and it is truncated once they have been written. If writing fails the
+// log is left intact so the write can be replayed.
+func writeBlocks(bs blockstore.Blockstore, wal WriteAheadLog, blks []blocks.Block) error {
+	if wal == nil {
+		return bs.PutMany(blks)
+	}
+
+	if err := wal.Append(blks); err != nil {
+		return err
+	}
+	if err := bs.PutMany(blks); err != nil {
+		return err
+	}
+	return wal.Truncate()
+}
+
+// liveDescendantIds returns the ids of all chunks reachable from the given id for this storage.
+// That is the given id , any links in the chunk referenced by the given id, or any links
+// referenced from those links. The graph is walked with an explicit stack rather than by
+// recursion, so arbitrarily deep graphs don't exhaust the goroutine's stack. A fault error
+// is returned if the staged chunks link in a cycle, which content addressing should make
+// impossible but corrupt or crafted data could cause.
+func (s Storage) liveDescendantIds(id cid.Cid) (*cid.Set, error) {
+	// walkFrame is an entry on the walk's stack: either a chunk to walk,
+	// linked from parent, or the marker that the walk has left id.
+	type walkFrame struct {
+		id     cid.Cid
+		parent cid.Cid
+		exit   bool
 	}
 
 	ids := cid.NewSet()
-	ids.Add(id)
+	// visited holds every id walked, staged or not, so each is checked once.
+	visited := cid.NewSet()
+	// onPath holds the ids on the path from the given id to the one being walked.
+	onPath := cid.NewSet()
+	stack := []walkFrame{{id: id}}
+	for len(stack) > 0 {
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if frame.exit {
+			onPath.Remove(frame.id)
+			continue
+		}
+		id := frame.id
+		if !id.Defined() {
+			continue
+		}
+		if onPath.Has(id) {
+			return nil, vmerrors.NewFaultErrorf("chunk %s links back to %s, forming a cycle", frame.parent, id)
+		}
+		if !visited.Visit(id) {
+			continue
+		}
 
-	for _, link := range chunk.Links() {
-		linked, err := s.liveDescendantIds(link.Cid)
-		if err != nil {
-			return nil, err
+		chunk, ok := s.chunks[id]
+		if !ok {
+			has, err := s.blockstore.Has(id)
+			if err == nil && !has && s.base != nil {
+				has, err = s.base.Has(id)
+			}
+			if err == nil && !has {
+				has, err = s.packs.has(id)
+			}
+			if err != nil {
+				return nil, vmerrors.FaultErrorWrapf(err, "linked node, %s, missing from stage during flush", id)
+			}
+
+			// unstaged chunk that exists in datastore is valid, but halts the walk.
+			if has {
+				continue
+			}
+
+			return nil, vmerrors.NewFaultErrorf("linked node, %s, missing from storage during flush", id)
+		}
+
+		ids.Add(id)
+		onPath.Add(id)
+		stack = append(stack, walkFrame{id: id, exit: true})
+
+		// Push links in reverse so they are walked in order.
+		links := chunk.Links()
+		for i := len(links) - 1; i >= 0; i-- {
+			stack = append(stack, walkFrame{id: links[i].Cid, parent: id})
 		}
-		linked.ForEach(func(id cid.Cid) error { // nolint: errcheck
-			ids.Add(id)
-			return nil
-		})
 	}
 
 	return ids, nil
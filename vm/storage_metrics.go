@@ -0,0 +1,39 @@
+package vm
+
+import (
+	blocks "gx/ipfs/QmWoXtvgC8inqFkAATB7cp2Dax7XBi9VDvSg9RCCZufmRk/go-block-format"
+)
+
+// StorageMetrics receives counts of what the Storages of a StorageMap do,
+// e.g. to export them as counters to a stats backend. Its methods may be
+// called concurrently. Each map reports to its own StorageMetrics, so to tell
+// apart, say, state growth from applying blocks and from a migration, give the
+// maps used for each a StorageMetrics tagging what it receives accordingly.
+type StorageMetrics interface {
+	// OnPut is called for every chunk put into a Storage.
+	OnPut()
+	// OnGet is called for every chunk retrieved from a Storage, with hit
+	// true if it was served from memory, because it was staged or cached,
+	// and false if it had to be read from the backing store.
+	OnGet(hit bool)
+	// OnFlush is called after every successful flush, with the number of
+	// blocks it wrote and their total size.
+	OnFlush(numBlocks, numBytes int)
+}
+
+// nopStorageMetrics is the StorageMetrics used when none is given, which does
+// nothing.
+type nopStorageMetrics struct{}
+
+func (nopStorageMetrics) OnPut()                          {}
+func (nopStorageMetrics) OnGet(hit bool)                  {}
+func (nopStorageMetrics) OnFlush(numBlocks, numBytes int) {}
+
+// blocksSize returns the total size of the data of blks.
+func blocksSize(blks []blocks.Block) int {
+	size := 0
+	for _, blk := range blks {
+		size += len(blk.RawData())
+	}
+	return size
+}
@@ -1,16 +1,30 @@
 package vm
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"gx/ipfs/QmR8BauakNcBa3RbE4nbQu76PDiJgoQgz8AJdhJuiU4TAw/go-cid"
+	car "gx/ipfs/QmRa5sdhUGtLptMNYSHFWcU3axEJntpKht3LngrBpuurv1/go-car"
 	cbor "gx/ipfs/QmRoARq3nkUb13HSKZGepCZSWe5GrVPwx7xURJGZ7KWv9V/go-ipld-cbor"
 	"gx/ipfs/QmS2aqUZLJp8kF1ihE5rvDGE5LvmKDPnx32w9Z1BW9xLV5/go-ipfs-blockstore"
+	blocks "gx/ipfs/QmWoXtvgC8inqFkAATB7cp2Dax7XBi9VDvSg9RCCZufmRk/go-block-format"
+	mh "gx/ipfs/QmerPMzPk1mJVowm8KgmoknWa4yCYvvugMPsgWmDNUvDLW/go-multihash"
 	"gx/ipfs/Qmf4xQhNomPNhrtZc67qSnfJSjxjXs9LWvknJtSXwimPrM/go-datastore"
 
 	"github.com/filecoin-project/go-filecoin/actor"
 	"github.com/filecoin-project/go-filecoin/address"
 	"github.com/filecoin-project/go-filecoin/exec"
 	"github.com/filecoin-project/go-filecoin/types"
+	vmerrors "github.com/filecoin-project/go-filecoin/vm/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -20,7 +34,7 @@ func TestGetAndPutWithEmptyStorage(t *testing.T) {
 	require := require.New(t)
 
 	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
-	vms := NewStorageMap(bs)
+	vms := NewStorageMap(bs, StorageMapOptions{})
 	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
 
 	t.Run("Put adds to storage", func(t *testing.T) {
@@ -97,6 +111,50 @@ func TestGetAndPutWithEmptyStorage(t *testing.T) {
 	})
 }
 
+func TestPutMany(t *testing.T) {
+	t.Run("adds chunks in order", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		stage := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
+
+		var chunks [][]byte
+		for i := 0; i < 3; i++ {
+			chunk, err := cbor.DumpObject(i)
+			require.NoError(err)
+			chunks = append(chunks, chunk)
+		}
+
+		cids, err := stage.PutMany(chunks)
+		require.NoError(err)
+		require.Len(cids, len(chunks))
+		for i, c := range cids {
+			data, err := stage.Get(c)
+			require.NoError(err)
+			assert.Equal(chunks[i], data)
+		}
+	})
+
+	t.Run("adds nothing if any chunk fails to decode", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		stage := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
+
+		valid, err := cbor.DumpObject("valid")
+		require.NoError(err)
+
+		cids, err := stage.PutMany([][]byte{valid, {0xff, 0xff}})
+		assert.Equal(exec.Errors[exec.ErrDecode], err)
+		assert.Nil(cids)
+		assert.Empty(stage.StagedBlocks())
+	})
+}
+
 func TestGetAndPutWithDataInStorage(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
@@ -104,7 +162,7 @@ func TestGetAndPutWithDataInStorage(t *testing.T) {
 	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
 
 	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
-	vms := NewStorageMap(bs)
+	vms := NewStorageMap(bs, StorageMapOptions{})
 
 	tempActorStage := vms.NewStorage(address.TestAddress, testActor)
 	data1, err := cbor.DumpObject("some data an actor might store")
@@ -151,7 +209,7 @@ func TestStorageHeadAndCommit(t *testing.T) {
 	t.Run("Committing changes head", func(t *testing.T) {
 		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
 
-		stage := NewStorageMap(bs).NewStorage(address.TestAddress, testActor)
+		stage := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
 
 		newMemory, err := cbor.WrapObject([]byte("New memory"), types.DefaultHashFunction, -1)
 		require.NoError(err)
@@ -170,7 +228,7 @@ func TestStorageHeadAndCommit(t *testing.T) {
 	t.Run("Committing a non existent chunk is an error", func(t *testing.T) {
 		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
 
-		stage := NewStorageMap(bs).NewStorage(address.TestAddress, testActor)
+		stage := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
 
 		newMemory, err := cbor.WrapObject([]byte("New memory"), types.DefaultHashFunction, -1)
 		require.NoError(err)
@@ -182,7 +240,7 @@ func TestStorageHeadAndCommit(t *testing.T) {
 	t.Run("Committing out of sequence is an error", func(t *testing.T) {
 		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
 
-		stage := NewStorageMap(bs).NewStorage(address.TestAddress, testActor)
+		stage := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
 
 		newMemory1, err := cbor.WrapObject([]byte("New memory 1"), types.DefaultHashFunction, -1)
 		require.NoError(err)
@@ -199,6 +257,33 @@ func TestStorageHeadAndCommit(t *testing.T) {
 		err = stage.Commit(newMemory2.Cid(), newMemory1.Cid())
 		assert.Equal(exec.Errors[exec.ErrStaleHead], err)
 	})
+
+	t.Run("ValidateCommit checks a commit without changing head", func(t *testing.T) {
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+
+		stage := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
+		head := stage.Head()
+
+		newMemory, err := cbor.WrapObject([]byte("New memory"), types.DefaultHashFunction, -1)
+		require.NoError(err)
+
+		// dangling pointer
+		assert.Equal(exec.Errors[exec.ErrDanglingPointer], stage.ValidateCommit(newMemory.Cid(), head))
+
+		newCid, err := stage.Put(newMemory.RawData())
+		require.NoError(err)
+
+		// stale head
+		assert.Equal(exec.Errors[exec.ErrStaleHead], stage.ValidateCommit(newCid, newCid))
+
+		assert.NoError(stage.ValidateCommit(newCid, head))
+		assert.Equal(head, stage.Head())
+		assert.Equal(head, testActor.Head)
+
+		assert.NoError(stage.Commit(newCid, head))
+		assert.Equal(newCid, stage.Head())
+		assert.Equal(ErrReadOnly, stage.ReadOnly().ValidateCommit(newCid, newCid))
+	})
 }
 
 func TestDatastoreBacking(t *testing.T) {
@@ -218,7 +303,7 @@ func TestDatastoreBacking(t *testing.T) {
 		require.NoError(bs.Put(memory2))
 
 		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
-		stage := NewStorageMap(bs).NewStorage(address.TestAddress, testActor)
+		stage := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
 
 		chunk, err := stage.Get(memory2.Cid())
 		require.NoError(err)
@@ -229,7 +314,7 @@ func TestDatastoreBacking(t *testing.T) {
 		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
 
 		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
-		storage := NewStorageMap(bs)
+		storage := NewStorageMap(bs, StorageMapOptions{})
 		stage := storage.NewStorage(address.TestAddress, testActor)
 
 		// put a value into stage
@@ -253,7 +338,7 @@ func TestDatastoreBacking(t *testing.T) {
 		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
 
 		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
-		storage := NewStorageMap(bs)
+		storage := NewStorageMap(bs, StorageMapOptions{})
 		stage := storage.NewStorage(address.TestAddress, testActor)
 
 		// put both values into stage
@@ -283,7 +368,7 @@ func TestDatastoreBacking(t *testing.T) {
 		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
 
 		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
-		storage := NewStorageMap(bs)
+		storage := NewStorageMap(bs, StorageMapOptions{})
 		stage := storage.NewStorage(address.TestAddress, testActor)
 
 		// put memory 2 into stage
@@ -311,64 +396,2213 @@ func TestDatastoreBacking(t *testing.T) {
 	})
 }
 
-func TestValidationAndPruning(t *testing.T) {
+func TestRawGet(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 
 	memory2, err := cbor.WrapObject([]byte("Memory chunk 2"), types.DefaultHashFunction, -1)
 	require.NoError(err)
 
-	t.Run("Linking to a non-existent cid fails in Commit", func(t *testing.T) {
-		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	memory3, err := cbor.WrapObject([]byte("Memory chunk 3"), types.DefaultHashFunction, -1)
+	require.NoError(err)
 
-		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
-		storage := NewStorageMap(bs)
-		stage := storage.NewStorage(address.TestAddress, testActor)
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	require.NoError(bs.Put(memory2))
 
-		// This links to memory 2, but memory 2 hasn't been added to anything.
-		memory, err := cbor.WrapObject(memory2.Cid(), types.DefaultHashFunction, -1)
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
+
+	stagedCid, err := stage.Put(memory3.RawData())
+	require.NoError(err)
+
+	t.Run("returns staged chunks", func(t *testing.T) {
+		blk, err := stage.RawGet(stagedCid)
 		require.NoError(err)
+		assert.Equal(stagedCid, blk.Cid())
+		assert.Equal(memory3.RawData(), blk.RawData())
+	})
 
-		// Add link
-		cid, err := stage.Put(memory.RawData())
-		assert.NoError(err)
+	t.Run("returns chunks from the blockstore", func(t *testing.T) {
+		blk, err := stage.RawGet(memory2.Cid())
+		require.NoError(err)
+		assert.Equal(memory2.Cid(), blk.Cid())
+		assert.Equal(memory2.RawData(), blk.RawData())
+	})
 
-		// Attempt to commit before adding linked memory
-		err = stage.Commit(cid, stage.Head())
-		assert.Equal(exec.Errors[exec.ErrDanglingPointer], err)
+	t.Run("returns ErrNotFound for missing chunks", func(t *testing.T) {
+		missing, err := cbor.WrapObject([]byte("missing"), types.DefaultHashFunction, -1)
+		require.NoError(err)
+
+		_, err = stage.RawGet(missing.Cid())
+		assert.Equal(ErrNotFound, err)
 	})
+}
 
-	t.Run("Prune removes unlinked chunks from stage", func(t *testing.T) {
-		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+// unreadableBlockstore is a blockstore whose blocks can't be read, only
+// checked for.
+type unreadableBlockstore struct {
+	blockstore.Blockstore
+}
 
-		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
-		storage := NewStorageMap(bs)
-		stage := storage.NewStorage(address.TestAddress, testActor)
+func (bs unreadableBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	return nil, errors.New("unreadable")
+}
 
-		// put both values into stage
-		cid1, err := stage.Put(memory2.RawData())
+func TestHas(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	memory2, err := cbor.WrapObject([]byte("Memory chunk 2"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	require.NoError(bs.Put(memory2))
+
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := NewStorageMap(unreadableBlockstore{bs}, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
+
+	stagedCid, err := stage.Put([]byte("Memory chunk 3"))
+	require.NoError(err)
+
+	has, err := stage.Has(stagedCid)
+	require.NoError(err)
+	assert.True(has)
+
+	has, err = stage.Has(memory2.Cid())
+	require.NoError(err)
+	assert.True(has)
+
+	missing, err := cbor.WrapObject([]byte("missing"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+	has, err = stage.Has(missing.Cid())
+	require.NoError(err)
+	assert.False(has)
+}
+
+func TestGetCopy(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	memory, err := cbor.WrapObject([]byte("Memory chunk"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := NewStorageMap(blockstore.NewBlockstore(datastore.NewMapDatastore()), StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
+
+	c, err := stage.Put(memory.RawData())
+	require.NoError(err)
+
+	chunk, err := stage.GetCopy(c)
+	require.NoError(err)
+	assert.Equal(memory.RawData(), chunk)
+
+	for i := range chunk {
+		chunk[i] = 0
+	}
+
+	chunk, err = stage.Get(c)
+	require.NoError(err)
+	assert.Equal(memory.RawData(), chunk)
+
+	_, err = stage.GetCopy(types.SomeCid())
+	assert.Equal(ErrNotFound, err)
+}
+
+func TestStagedBlocks(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
+
+	assert.Empty(stage.StagedBlocks())
+
+	var expected []cid.Cid
+	for _, data := range []string{"one", "two", "three", "four"} {
+		memory, err := cbor.WrapObject([]byte(data), types.DefaultHashFunction, -1)
 		require.NoError(err)
 
-		memory3, err := cbor.WrapObject([]byte("Memory chunk 3"), types.DefaultHashFunction, -1)
+		c, err := stage.Put(memory.RawData())
 		require.NoError(err)
+		expected = append(expected, c)
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i].KeyString() < expected[j].KeyString()
+	})
 
-		cid2, err := stage.Put(memory3.RawData())
+	blks := stage.StagedBlocks()
+	require.Len(blks, len(expected))
+	for i, blk := range blks {
+		assert.Equal(expected[i], blk.Cid())
+	}
+}
+
+// countingBlockstore records the number of times each block is written to it.
+type countingBlockstore struct {
+	blockstore.Blockstore
+	puts map[cid.Cid]int
+}
+
+func newCountingBlockstore() *countingBlockstore {
+	return &countingBlockstore{
+		Blockstore: blockstore.NewBlockstore(datastore.NewMapDatastore()),
+		puts:       map[cid.Cid]int{},
+	}
+}
+
+func (bs *countingBlockstore) Put(blk blocks.Block) error {
+	bs.puts[blk.Cid()]++
+	return bs.Blockstore.Put(blk)
+}
+
+func (bs *countingBlockstore) PutMany(blks []blocks.Block) error {
+	for _, blk := range blks {
+		bs.puts[blk.Cid()]++
+	}
+	return bs.Blockstore.PutMany(blks)
+}
+
+// blockingBlockstore is a blockstore whose PutMany doesn't return until
+// release is closed, and then discards the blocks.
+type blockingBlockstore struct {
+	blockstore.Blockstore
+	release chan struct{}
+}
+
+func (bs *blockingBlockstore) PutMany(blks []blocks.Block) error {
+	<-bs.release
+	return nil
+}
+
+func TestFlushDeadline(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := &blockingBlockstore{
+		Blockstore: blockstore.NewBlockstore(datastore.NewMapDatastore()),
+		release:    make(chan struct{}),
+	}
+	defer close(bs.release)
+
+	storage := NewStorageMap(bs, StorageMapOptions{FlushDeadline: 10 * time.Millisecond})
+
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	memory, err := cbor.WrapObject([]byte("Memory chunk"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+	c, err := stage.Put(memory.RawData())
+	require.NoError(err)
+	require.NoError(stage.Commit(c, stage.Head()))
+
+	err = storage.Flush()
+	require.Error(err)
+	assert.True(vmerrors.IsFault(err))
+	assert.Contains(err.Error(), "flush did not complete within 10ms")
+
+	err = stage.Flush()
+	require.Error(err)
+	assert.True(vmerrors.IsFault(err))
+}
+
+// blockingReadBlockstore is a blockingBlockstore whose Get also doesn't
+// return until release is closed.
+type blockingReadBlockstore struct {
+	*blockingBlockstore
+}
+
+func (bs blockingReadBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	<-bs.release
+	return bs.Blockstore.Get(c)
+}
+
+func TestStorageContext(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := blockingReadBlockstore{&blockingBlockstore{
+		Blockstore: blockstore.NewBlockstore(datastore.NewMapDatastore()),
+		release:    make(chan struct{}),
+	}}
+	defer close(bs.release)
+
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
+
+	c, err := stage.Put("staged")
+	require.NoError(err)
+	require.NoError(stage.Commit(c, stage.Head()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	stored, err := cbor.WrapObject("stored", types.DefaultHashFunction, -1)
+	require.NoError(err)
+	_, err = stage.GetContext(ctx, stored.Cid())
+	assert.Equal(context.Canceled, err)
+
+	// Staged chunks don't need the backing store.
+	data, err := stage.GetContext(ctx, c)
+	require.NoError(err)
+	expected, err := cbor.DumpObject("staged")
+	require.NoError(err)
+	assert.Equal(expected, data)
+
+	assert.Equal(context.Canceled, stage.FlushContext(ctx))
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	assert.Equal(context.Canceled, stage.FlushContext(ctx))
+}
+
+func TestFlushSkipExisting(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := newCountingBlockstore()
+	storage := NewStorageMap(bs, StorageMapOptions{SkipExisting: true})
+
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	leaf, err := cbor.WrapObject([]byte("leaf"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+	leafCid, err := stage.Put(leaf.RawData())
+	require.NoError(err)
+	require.NoError(stage.Commit(leafCid, stage.Head()))
+	require.NoError(storage.Flush())
+	assert.Equal(1, bs.puts[leafCid])
+
+	// The leaf is still staged, but is already in the blockstore.
+	root, err := cbor.WrapObject([]cid.Cid{leafCid}, types.DefaultHashFunction, -1)
+	require.NoError(err)
+	rootCid, err := stage.Put(root.RawData())
+	require.NoError(err)
+	require.NoError(stage.Commit(rootCid, stage.Head()))
+	require.NoError(stage.Flush())
+
+	assert.Equal(1, bs.puts[leafCid])
+	assert.Equal(1, bs.puts[rootCid])
+
+	has, err := bs.Has(rootCid)
+	require.NoError(err)
+	assert.True(has)
+}
+
+func TestStrictFlush(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	storage := NewStorageMap(bs, StorageMapOptions{StrictFlush: true})
+
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	memory, err := cbor.WrapObject([]byte("Memory chunk"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+	c, err := stage.Put(memory.RawData())
+	require.NoError(err)
+	require.NoError(stage.Commit(c, stage.Head()))
+	require.NoError(storage.Flush())
+
+	// Get shares memory with the staged chunk, so modifying its result
+	// corrupts the chunk.
+	data, err := stage.Get(c)
+	require.NoError(err)
+	data[len(data)-1] ^= 0xff
+
+	require.NoError(bs.DeleteBlock(c))
+	// FlushAddrs flushes the actor though its head hasn't moved.
+	err = storage.FlushAddrs([]address.Address{address.TestAddress})
+	require.Error(err)
+	assert.True(vmerrors.IsFault(err))
+	assert.Contains(err.Error(), "is corrupt")
+
+	err = stage.Flush()
+	require.Error(err)
+	assert.True(vmerrors.IsFault(err))
+
+	has, err := bs.Has(c)
+	require.NoError(err)
+	assert.False(has)
+}
+
+func TestFlushCompaction(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := newCountingBlockstore()
+	storage := NewStorageMap(bs, StorageMapOptions{CompactBelow: 64})
+
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	var leaves []cid.Cid
+	for _, s := range []string{"a", "b", "c"} {
+		leaf, err := stage.Put(s)
 		require.NoError(err)
+		leaves = append(leaves, leaf)
+	}
+	root, err := stage.Put(leaves)
+	require.NoError(err)
+	require.NoError(stage.Commit(root, stage.Head()))
+
+	require.NoError(storage.Flush())
+
+	// Only the head, the container holding the leaves and its index are
+	// written.
+	assert.Len(bs.puts, 3)
+	assert.Equal(1, bs.puts[root])
+	assert.Equal(1, bs.puts[storage.PackIndex()])
+	for _, leaf := range leaves {
+		assert.Equal(0, bs.puts[leaf])
+	}
+
+	// A storage without the leaves staged finds them in the container.
+	other := storage.NewStorage(address.NewForTestGetter()(), actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL()))
+	for i, s := range []string{"a", "b", "c"} {
+		data, err := other.Get(leaves[i])
+		require.NoError(err)
+		expected, err := cbor.DumpObject(s)
+		require.NoError(err)
+		assert.Equal(expected, data)
+	}
 
-		// only commit the second change
-		stage.Commit(cid2, stage.Head())
+	// Linking to packed leaves is not a dangling pointer.
+	otherRoot, err := other.Put(leaves[:2])
+	require.NoError(err)
+	assert.NoError(other.Commit(otherRoot, other.Head()))
+
+	// Another map on the blockstore, as after a restart, finds them through
+	// the persisted index.
+	reopened := NewStorageMap(bs, StorageMapOptions{PackIndex: storage.PackIndex()})
+	fresh := reopened.NewStorage(address.TestAddress, testActor)
+	for i, s := range []string{"a", "b", "c"} {
+		data, err := fresh.Get(leaves[i])
+		require.NoError(err)
+		expected, err := cbor.DumpObject(s)
+		require.NoError(err)
+		assert.Equal(expected, data)
+	}
+	_, err = NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor).Get(leaves[0])
+	assert.Equal(ErrNotFound, err)
+}
 
-		// Prune the stage
-		err = stage.Prune()
+func TestFlushCompactionIndexAccumulates(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	storage := NewStorageMap(bs, StorageMapOptions{CompactBelow: 64, HashFunction: mh.SHA2_256})
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	var leaves []cid.Cid
+	for round := 0; round < 3; round++ {
+		var linked []cid.Cid
+		for i := 0; i < 2; i++ {
+			leaf, err := stage.Put(fmt.Sprintf("leaf %d.%d", round, i))
+			require.NoError(err)
+			linked = append(linked, leaf)
+		}
+		root, err := stage.Put(linked)
 		require.NoError(err)
+		require.NoError(stage.Commit(root, stage.Head()))
+		require.NoError(storage.Flush())
+		leaves = append(leaves, linked...)
+	}
+
+	// The index and containers are hashed like the rest of the map's chunks.
+	index := storage.PackIndex()
+	assert.Equal(uint64(mh.SHA2_256), index.Prefix().MhType)
+
+	// Leaves packed by every flush are found through the index's root.
+	reopened := NewStorageMap(bs, StorageMapOptions{PackIndex: index})
+	fresh := reopened.NewStorage(address.TestAddress, testActor)
+	for _, leaf := range leaves {
+		has, err := fresh.Has(leaf)
+		require.NoError(err)
+		assert.True(has)
+		_, err = fresh.Get(leaf)
+		assert.NoError(err)
+	}
+}
 
-		// retrieve cid from stage
-		_, err = stage.Get(cid1)
-		require.Error(err)
-		assert.Equal(ErrNotFound, err)
+func TestFlushCompression(t *testing.T) {
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	payload := strings.Repeat("compressible ", 100)
 
-		chunk, err := stage.Get(cid2)
+	t.Run("round trips chunks through the blockstore", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+		storage := NewStorageMap(bs, StorageMapOptions{Compress: true})
+		stage := storage.NewStorage(address.TestAddress, testActor)
+
+		large, err := stage.Put(payload)
 		require.NoError(err)
-		assert.Equal(memory3.RawData(), chunk)
+		small, err := stage.Put("small")
+		require.NoError(err)
+		root, err := stage.Put([]cid.Cid{large, small})
+		require.NoError(err)
+		require.NoError(stage.Commit(root, stage.Head()))
+		expected := stage.StagedBlocks()
+		require.NoError(storage.Flush())
+
+		stored, err := bs.Get(large)
+		require.NoError(err)
+		assert.True(len(stored.RawData()) < len(payload))
+
+		// Chunks that don't compress are stored as they are.
+		stored, err = bs.Get(small)
+		require.NoError(err)
+		data, err := stage.Get(small)
+		require.NoError(err)
+		assert.Equal(data, stored.RawData())
+
+		fresh := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
+		for _, blk := range expected {
+			got, err := fresh.RawGet(blk.Cid())
+			require.NoError(err)
+			assert.Equal(blk.Cid(), got.Cid())
+			assert.Equal(blk.RawData(), got.RawData())
+
+			c, err := got.Cid().Prefix().Sum(got.RawData())
+			require.NoError(err)
+			assert.Equal(blk.Cid(), c)
+		}
+	})
+
+	t.Run("round trips compacted chunks", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+		storage := NewStorageMap(bs, StorageMapOptions{Compress: true, CompactBelow: 1024})
+		stage := storage.NewStorage(address.TestAddress, testActor)
+
+		var leaves []cid.Cid
+		for i := 0; i < 10; i++ {
+			leaf, err := stage.Put(fmt.Sprintf("compressible leaf %d", i))
+			require.NoError(err)
+			leaves = append(leaves, leaf)
+		}
+		root, err := stage.Put(leaves)
+		require.NoError(err)
+		require.NoError(stage.Commit(root, stage.Head()))
+		expected := stage.StagedBlocks()
+		require.NoError(storage.Flush())
+
+		fresh := storage.NewStorage(address.TestAddress2, testActor)
+		for _, blk := range expected {
+			data, err := fresh.Get(blk.Cid())
+			require.NoError(err)
+			assert.Equal(blk.RawData(), data)
+		}
+	})
+}
+
+func BenchmarkFlushCompression(b *testing.B) {
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compress %t", compress), func(b *testing.B) {
+			var stored, raw int
+			for i := 0; i < b.N; i++ {
+				bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+				storage := NewStorageMap(bs, StorageMapOptions{Compress: compress})
+
+				testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+				stage := storage.NewStorage(address.TestAddress, testActor)
+				var chunks []cid.Cid
+				for j := 0; j < 100; j++ {
+					payload := strings.Repeat(fmt.Sprintf("payload %d ", j), 400)
+					c, err := stage.Put(payload)
+					require.NoError(b, err)
+					chunks = append(chunks, c)
+				}
+				root, err := stage.Put(chunks)
+				require.NoError(b, err)
+				require.NoError(b, stage.Commit(root, stage.Head()))
+				require.NoError(b, storage.Flush())
+
+				stored, raw = 0, 0
+				for _, c := range append(chunks, root) {
+					blk, err := bs.Get(c)
+					require.NoError(b, err)
+					stored += len(blk.RawData())
+					data, err := stage.Get(c)
+					require.NoError(b, err)
+					raw += len(data)
+				}
+			}
+			b.Logf("stored %d bytes of %d", stored, raw)
+		})
+	}
+}
+
+func TestStorageHashFunction(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	storage := NewStorageMap(bs, StorageMapOptions{HashFunction: mh.SHA2_256})
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	leaf, err := stage.Put("leaf")
+	require.NoError(err)
+	assert.Equal(uint64(mh.SHA2_256), leaf.Prefix().MhType)
+	expected, err := cbor.WrapObject("leaf", mh.SHA2_256, -1)
+	require.NoError(err)
+	assert.Equal(expected.Cid(), leaf)
+
+	many, err := stage.PutMany([][]byte{expected.RawData()})
+	require.NoError(err)
+	assert.Equal([]cid.Cid{leaf}, many)
+
+	root, err := stage.Put([]cid.Cid{leaf})
+	require.NoError(err)
+	require.NoError(stage.Commit(root, stage.Head()))
+	require.NoError(storage.Flush())
+
+	fresh := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
+	data, err := fresh.Get(leaf)
+	require.NoError(err)
+	assert.Equal(expected.RawData(), data)
+}
+
+func TestFlushBaseStore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	base := newCountingBlockstore()
+	overlay := newCountingBlockstore()
+	storage := NewStorageMap(overlay, StorageMapOptions{BaseStore: base})
+
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	var leaves []cid.Cid
+	for _, s := range []string{"a", "b", "c"} {
+		leaf, err := cbor.WrapObject(s, types.DefaultHashFunction, -1)
+		require.NoError(err)
+		_, err = stage.Put(leaf.RawData())
+		require.NoError(err)
+		leaves = append(leaves, leaf.Cid())
+
+		// Half of the live chunks are already in the base.
+		if s != "c" {
+			require.NoError(base.Put(leaf))
+		}
+	}
+	root, err := stage.Put(leaves)
+	require.NoError(err)
+	require.NoError(stage.Commit(root, stage.Head()))
+
+	require.NoError(storage.Flush())
+	assert.Len(overlay.puts, 2)
+	assert.Equal(1, overlay.puts[root])
+	assert.Equal(1, overlay.puts[leaves[2]])
+	assert.Len(base.puts, 2)
+
+	// Chunks only in the base can be read and linked to.
+	other := storage.NewStorage(address.NewForTestGetter()(), actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL()))
+	data, err := other.Get(leaves[0])
+	require.NoError(err)
+	expected, err := cbor.DumpObject("a")
+	require.NoError(err)
+	assert.Equal(expected, data)
+
+	otherRoot, err := other.Put(leaves[:1])
+	require.NoError(err)
+	assert.NoError(other.Commit(otherRoot, other.Head()))
+}
+
+type flushRecord struct {
+	blocks int
+	bytes  int
+}
+
+// notifyingWriter sends everything written to it on a channel.
+type notifyingWriter struct {
+	writes chan []byte
+}
+
+func (w *notifyingWriter) Write(p []byte) (int, error) {
+	w.writes <- append([]byte{}, p...)
+	return len(p), nil
+}
+
+// recordingStorageMetrics counts the calls made to it.
+type recordingStorageMetrics struct {
+	lk      sync.Mutex
+	puts    int
+	hits    int
+	misses  int
+	flushes []flushRecord
+}
+
+func (m *recordingStorageMetrics) OnPut() {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.puts++
+}
+
+func (m *recordingStorageMetrics) OnGet(hit bool) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if hit {
+		m.hits++
+	} else {
+		m.misses++
+	}
+}
+
+func (m *recordingStorageMetrics) OnFlush(numBlocks, numBytes int) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.flushes = append(m.flushes, flushRecord{blocks: numBlocks, bytes: numBytes})
+}
+
+func TestStorageMetrics(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	metrics := &recordingStorageMetrics{}
+	storage := NewStorageMap(bs, StorageMapOptions{CacheSize: 10, Metrics: metrics})
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	c, err := stage.Put("chunk")
+	require.NoError(err)
+	other, err := cbor.DumpObject("other")
+	require.NoError(err)
+	_, err = stage.PutMany([][]byte{other, other})
+	require.NoError(err)
+	require.NoError(stage.Commit(c, stage.Head()))
+	assert.Equal(3, metrics.puts)
+
+	_, err = stage.Get(c)
+	require.NoError(err)
+	assert.Equal(1, metrics.hits)
+
+	require.NoError(storage.Flush())
+	flushed, err := cbor.DumpObject("chunk")
+	require.NoError(err)
+	assert.Equal([]flushRecord{{blocks: 1, bytes: len(flushed)}}, metrics.flushes)
+
+	// Reads from the backing store miss, and then hit the cache.
+	fresh := storage.NewStorage(address.TestAddress2, testActor)
+	for i := 0; i < 2; i++ {
+		_, err = fresh.Get(c)
+		require.NoError(err)
+	}
+	assert.Equal(1, metrics.misses)
+	assert.Equal(2, metrics.hits)
+}
+
+func TestStorageMetricsPerMap(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	blockMetrics, migrationMetrics := &recordingStorageMetrics{}, &recordingStorageMetrics{}
+	blockStorage := NewStorageMap(bs, StorageMapOptions{Metrics: blockMetrics})
+	migrationStorage := NewStorageMap(bs, StorageMapOptions{Metrics: migrationMetrics})
+
+	memory, err := cbor.WrapObject([]byte("Memory chunk"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+	for _, storage := range []StorageMap{blockStorage, migrationStorage} {
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		stage := storage.NewStorage(address.TestAddress, testActor)
+		c, err := stage.Put(memory.RawData())
+		require.NoError(err)
+		require.NoError(stage.Commit(c, stage.Head()))
+	}
+
+	require.NoError(blockStorage.Flush())
+	require.NoError(migrationStorage.Flush())
+	// FlushAddrs flushes the actor though its head hasn't moved.
+	require.NoError(migrationStorage.FlushAddrs([]address.Address{address.TestAddress}))
+
+	size := len(memory.RawData())
+	assert.Equal([]flushRecord{{1, size}}, blockMetrics.flushes)
+	assert.Equal([]flushRecord{{1, size}, {1, size}}, migrationMetrics.flushes)
+}
+
+func TestFlushBackup(t *testing.T) {
+	putChunks := func(require *require.Assertions, stage Storage, data ...string) cid.Cid {
+		var links []cid.Cid
+		for _, d := range data {
+			chunk, err := cbor.WrapObject([]byte(d), types.DefaultHashFunction, -1)
+			require.NoError(err)
+			c, err := stage.Put(chunk.RawData())
+			require.NoError(err)
+			links = append(links, c)
+		}
+		root, err := cbor.WrapObject(links, types.DefaultHashFunction, -1)
+		require.NoError(err)
+		rootCid, err := stage.Put(root.RawData())
+		require.NoError(err)
+		require.NoError(stage.Commit(rootCid, stage.Head()))
+		return rootCid
+	}
+
+	t.Run("writes a CAR of the flushed blocks", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+		backup := &notifyingWriter{writes: make(chan []byte, 1)}
+		storage := NewStorageMap(bs, StorageMapOptions{Backup: backup})
+		defer storage.Close()
+
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		stage := storage.NewStorage(address.TestAddress, testActor)
+		rootCid := putChunks(require, stage, "a", "b", "a")
+		require.NoError(storage.Flush())
+
+		data := <-backup.writes
+		cr, err := car.NewCarReader(bytes.NewReader(data))
+		require.NoError(err)
+		assert.Equal([]cid.Cid{rootCid}, cr.Header.Roots)
+
+		var got []cid.Cid
+		for {
+			blk, err := cr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			got = append(got, blk.Cid())
+
+			has, err := bs.Has(blk.Cid())
+			require.NoError(err)
+			assert.True(has)
+		}
+		assert.Len(got, 3)
+		assert.Contains(got, rootCid)
+		assert.Equal(uint64(0), storage.BackupDropped())
+	})
+
+	t.Run("drops CARs rather than blocking", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		backup := &blockingWriter{release: make(chan struct{})}
+		storage := NewStorageMap(blockstore.NewBlockstore(datastore.NewMapDatastore()), StorageMapOptions{Backup: backup})
+		defer storage.Close()
+		defer close(backup.release)
+
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		stage := storage.NewStorage(address.TestAddress, testActor)
+		putChunks(require, stage, "a")
+
+		// Once the queue is full, and perhaps one CAR is being written,
+		// the rest are dropped.
+		for i := 0; i < maxBackupQueue+5; i++ {
+			require.NoError(storage.FlushAddrs([]address.Address{address.TestAddress}))
+		}
+		dropped := storage.BackupDropped()
+		assert.True(dropped == 4 || dropped == 5, "dropped %d", dropped)
+	})
+}
+
+// blockingWriter is a writer whose writes don't return until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+// slowWriteBlockstore is a blockstore that takes a while to write each block.
+type slowWriteBlockstore struct {
+	blockstore.Blockstore
+}
+
+func (bs slowWriteBlockstore) PutMany(blks []blocks.Block) error {
+	time.Sleep(time.Duration(len(blks)) * 10 * time.Microsecond)
+	return bs.Blockstore.PutMany(blks)
+}
+
+func BenchmarkFlushSkipExisting(b *testing.B) {
+	for _, skip := range []bool{false, true} {
+		b.Run(fmt.Sprintf("skip existing %t", skip), func(b *testing.B) {
+			bs := slowWriteBlockstore{blockstore.NewBlockstore(datastore.NewMapDatastore())}
+			storage := NewStorageMap(bs, StorageMapOptions{SkipExisting: skip})
+
+			testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+			stage := storage.NewStorage(address.TestAddress, testActor)
+
+			var leaves []cid.Cid
+			for i := 0; i < 100; i++ {
+				leaf, err := cbor.WrapObject(i, types.DefaultHashFunction, -1)
+				require.NoError(b, err)
+				leafCid, err := stage.Put(leaf.RawData())
+				require.NoError(b, err)
+				leaves = append(leaves, leafCid)
+			}
+			root, err := cbor.WrapObject(leaves, types.DefaultHashFunction, -1)
+			require.NoError(b, err)
+			rootCid, err := stage.Put(root.RawData())
+			require.NoError(b, err)
+			require.NoError(b, stage.Commit(rootCid, stage.Head()))
+			require.NoError(b, storage.Flush())
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, storage.Flush())
+			}
+		})
+	}
+}
+
+// readCountingBlockstore is a blockstore that counts the blocks read from it.
+type readCountingBlockstore struct {
+	blockstore.Blockstore
+	lk    sync.Mutex
+	reads map[cid.Cid]int
+}
+
+func newReadCountingBlockstore() *readCountingBlockstore {
+	return &readCountingBlockstore{
+		Blockstore: blockstore.NewBlockstore(datastore.NewMapDatastore()),
+		reads:      map[cid.Cid]int{},
+	}
+}
+
+func (bs *readCountingBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	bs.lk.Lock()
+	bs.reads[c]++
+	bs.lk.Unlock()
+	return bs.Blockstore.Get(c)
+}
+
+func TestStorageCache(t *testing.T) {
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+
+	t.Run("serves repeated reads from memory", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		bs := newReadCountingBlockstore()
+		chunk, err := cbor.WrapObject("cached", types.DefaultHashFunction, -1)
+		require.NoError(err)
+		require.NoError(bs.Put(chunk))
+
+		storage := NewStorageMap(bs, StorageMapOptions{CacheSize: 10})
+		for _, addr := range []address.Address{address.TestAddress, address.TestAddress2} {
+			data, err := storage.NewStorage(addr, testActor).Get(chunk.Cid())
+			require.NoError(err)
+			assert.Equal(chunk.RawData(), data)
+		}
+		assert.Equal(1, bs.reads[chunk.Cid()])
+	})
+
+	t.Run("evicts the least recently used chunks", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		bs := newReadCountingBlockstore()
+		var chunks []cid.Cid
+		for i := 0; i < 3; i++ {
+			chunk, err := cbor.WrapObject(i, types.DefaultHashFunction, -1)
+			require.NoError(err)
+			require.NoError(bs.Put(chunk))
+			chunks = append(chunks, chunk.Cid())
+		}
+
+		stage := NewStorageMap(bs, StorageMapOptions{CacheSize: 2}).NewStorage(address.TestAddress, testActor)
+		for _, c := range []cid.Cid{chunks[0], chunks[1], chunks[0], chunks[2], chunks[0], chunks[1]} {
+			_, err := stage.Get(c)
+			require.NoError(err)
+		}
+		assert.Equal(1, bs.reads[chunks[0]])
+		assert.Equal(2, bs.reads[chunks[1]])
+		assert.Equal(1, bs.reads[chunks[2]])
+	})
+
+	t.Run("drops flushed chunks", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		bs := newReadCountingBlockstore()
+		storage := NewStorageMap(bs, StorageMapOptions{CacheSize: 10})
+		stage := storage.NewStorage(address.TestAddress, testActor)
+
+		c, err := stage.Put("flushed")
+		require.NoError(err)
+		require.NoError(stage.Commit(c, stage.Head()))
+		require.NoError(storage.Flush())
+
+		other := storage.NewStorage(address.TestAddress2, testActor)
+		_, err = other.Get(c)
+		require.NoError(err)
+		require.NoError(storage.FlushAddrs([]address.Address{address.TestAddress}))
+		_, err = other.Get(c)
+		require.NoError(err)
+		assert.Equal(2, bs.reads[c])
+	})
+}
+
+// slowReadBlockstore is a blockstore that takes a while to read each block.
+type slowReadBlockstore struct {
+	blockstore.Blockstore
+}
+
+func (bs slowReadBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	time.Sleep(10 * time.Microsecond)
+	return bs.Blockstore.Get(c)
+}
+
+func BenchmarkStorageCache(b *testing.B) {
+	for _, cacheSize := range []int{0, 100} {
+		b.Run(fmt.Sprintf("cache size %d", cacheSize), func(b *testing.B) {
+			bs := slowReadBlockstore{blockstore.NewBlockstore(datastore.NewMapDatastore())}
+			storage := NewStorageMap(bs, StorageMapOptions{CacheSize: cacheSize})
+
+			var chunks []cid.Cid
+			for i := 0; i < 100; i++ {
+				chunk, err := cbor.WrapObject(i, types.DefaultHashFunction, -1)
+				require.NoError(b, err)
+				require.NoError(b, bs.Put(chunk))
+				chunks = append(chunks, chunk.Cid())
+			}
+
+			testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+			stage := storage.NewStorage(address.TestAddress, testActor)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := stage.Get(chunks[i%len(chunks)])
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+// hookedBlockstore is a blockstore that calls a hook before PutMany writes.
+type hookedBlockstore struct {
+	blockstore.Blockstore
+	beforeHas     func()
+	beforePutMany func()
+}
+
+func (bs *hookedBlockstore) Has(c cid.Cid) (bool, error) {
+	if bs.beforeHas != nil {
+		bs.beforeHas()
+	}
+	return bs.Blockstore.Has(c)
+}
+
+func (bs *hookedBlockstore) PutMany(blks []blocks.Block) error {
+	if bs.beforePutMany != nil {
+		bs.beforePutMany()
+	}
+	return bs.Blockstore.PutMany(blks)
+}
+
+func TestStorageMapConcurrentNewStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	storage := NewStorageMap(bs, StorageMapOptions{})
+	addrGetter := address.NewForTestGetter()
+
+	const actors = 50
+	addrs := make([]address.Address, actors)
+	for i := range addrs {
+		addrs[i] = addrGetter()
+	}
+
+	done := make(chan struct{})
+	flushErrs := make(chan error, 1)
+	go func() {
+		defer close(flushErrs)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := storage.Flush(); err != nil {
+				flushErrs <- err
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, actors)
+	for i := 0; i < actors; i++ {
+		addr := addrs[i]
+		n := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stage := storage.NewStorage(addr, actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL()))
+			c, err := stage.Put(n)
+			if err == nil {
+				err = stage.Commit(c, stage.Head())
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(done)
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(err)
+	}
+	assert.NoError(<-flushErrs)
+
+	// Every actor's storage was kept, so a final flush writes all of them.
+	assert.NoError(storage.Flush())
+	for i := 0; i < actors; i++ {
+		nd, err := cbor.WrapObject(i, types.DefaultHashFunction, -1)
+		assert.NoError(err)
+		has, err := bs.Has(nd.Cid())
+		assert.NoError(err)
+		assert.True(has, "chunk %d", i)
+	}
+}
+
+func TestStorageEach(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	storage := NewStorageMap(bs, StorageMapOptions{})
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	// A flushed chunk that is no longer staged is not visited.
+	unstaged, err := stage.Put("flushed")
+	require.NoError(err)
+	require.NoError(stage.Commit(unstaged, stage.Head()))
+	require.NoError(stage.Flush())
+	require.NoError(stage.Delete(unstaged))
+
+	staged := map[cid.Cid][]byte{}
+	for i := 0; i < 10; i++ {
+		data, err := cbor.DumpObject(i)
+		require.NoError(err)
+		c, err := stage.Put(data)
+		require.NoError(err)
+		// Putting a chunk again doesn't stage it twice.
+		_, err = stage.Put(data)
+		require.NoError(err)
+		staged[c] = data
+	}
+
+	visited := map[cid.Cid]int{}
+	err = stage.Each(func(c cid.Cid, data []byte) error {
+		visited[c]++
+		assert.Equal(staged[c], data)
+		return nil
+	})
+	require.NoError(err)
+	assert.Len(visited, len(staged))
+	for c := range staged {
+		assert.Equal(1, visited[c])
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = stage.Each(func(cid.Cid, []byte) error {
+		calls++
+		return stop
+	})
+	assert.Equal(stop, err)
+	assert.Equal(1, calls)
+}
+
+func TestDeepChunkGraph(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	storage := NewStorageMap(bs, StorageMapOptions{})
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	// A chain of chunks thousands of links deep, each linking to the last.
+	const depth = 5000
+	head, err := stage.Put("bottom")
+	require.NoError(err)
+	for i := 1; i < depth; i++ {
+		head, err = stage.Put(map[string]cid.Cid{"next": head})
+		require.NoError(err)
+	}
+	garbage, err := stage.Put("garbage")
+	require.NoError(err)
+
+	require.NoError(stage.Commit(head, stage.Head()))
+	ids, err := stage.liveDescendantIds(head)
+	require.NoError(err)
+	assert.Equal(depth, ids.Len())
+
+	require.NoError(stage.Prune())
+	_, err = stage.Get(garbage)
+	assert.Equal(ErrNotFound, err)
+
+	require.NoError(storage.Flush())
+	has, err := bs.Has(head)
+	require.NoError(err)
+	assert.True(has)
+}
+
+func TestChunkCycles(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	storage := NewStorageMap(bs, StorageMapOptions{})
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	// Stage two chunks under cids they don't hash to, linking to each
+	// other, as corrupt data could.
+	newCid := types.NewCidForTestGetter()
+	a, b := newCid(), newCid()
+	toB, err := cbor.WrapObject(map[string]cid.Cid{"next": b}, types.DefaultHashFunction, -1)
+	require.NoError(err)
+	toA, err := cbor.WrapObject(map[string]cid.Cid{"next": a}, types.DefaultHashFunction, -1)
+	require.NoError(err)
+	root, err := stage.Put(map[string]cid.Cid{"a": a})
+	require.NoError(err)
+	stage.chunks[a] = toB
+	stage.chunks[b] = toA
+
+	_, err = stage.liveDescendantIds(root)
+	require.Error(err)
+	assert.True(vmerrors.IsFault(err))
+	assert.Contains(err.Error(), fmt.Sprintf("chunk %s links back to %s", b, a))
+
+	assert.Equal(exec.Errors[exec.ErrDanglingPointer], stage.Commit(root, stage.Head()))
+
+	// Chunks reachable by more than one path are not a cycle.
+	leaf, err := stage.Put("leaf")
+	require.NoError(err)
+	diamond, err := stage.Put([]cid.Cid{leaf, leaf})
+	require.NoError(err)
+	assert.NoError(stage.Commit(diamond, stage.Head()))
+}
+
+func TestReadOnlyStorage(t *testing.T) {
+	t.Run("rejects modification", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		stage := NewReadOnlyStorage(bs, testActor)
+
+		c, err := stage.Put("hello")
+		assert.Equal(ErrReadOnly, err)
+		assert.False(c.Defined())
+		_, err = stage.PutMany([][]byte{})
+		assert.Equal(ErrReadOnly, err)
+		assert.Empty(stage.StagedBlocks())
+
+		nd, err := cbor.WrapObject("hello", types.DefaultHashFunction, -1)
+		require.NoError(err)
+		require.NoError(bs.Put(nd))
+
+		assert.Equal(ErrReadOnly, stage.Commit(nd.Cid(), stage.Head()))
+		assert.False(stage.Head().Defined())
+		assert.Equal(ErrReadOnly, stage.Prune())
+		_, err = stage.CommitAndPrune(nd.Cid(), stage.Head())
+		assert.Equal(ErrReadOnly, err)
+		assert.Equal(ErrReadOnly, stage.Delete(nd.Cid()))
+
+		data, err := stage.Get(nd.Cid())
+		require.NoError(err)
+		assert.Equal(nd.RawData(), data)
+	})
+
+	t.Run("views a writable storage", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		stage := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
+		view := stage.ReadOnly()
+
+		c, err := stage.Put("hello")
+		require.NoError(err)
+		require.NoError(stage.Commit(c, stage.Head()))
+
+		assert.Equal(c, view.Head())
+		expected, err := cbor.DumpObject("hello")
+		require.NoError(err)
+		data, err := view.Get(c)
+		require.NoError(err)
+		assert.Equal(expected, data)
+
+		_, err = view.Put("world")
+		assert.Equal(ErrReadOnly, err)
+		assert.Equal(ErrReadOnly, view.Prune())
+
+		// The writable storage is unaffected.
+		_, err = stage.Put("world")
+		assert.NoError(err)
+	})
+}
+
+func TestLiveSize(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	storage := NewStorageMap(bs, StorageMapOptions{})
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	size, err := stage.LiveSize()
+	require.NoError(err)
+	assert.Equal(0, size)
+
+	// The shared leaf is linked twice but counted once, and the unreachable
+	// chunk isn't counted.
+	leaf, err := stage.Put("leaf")
+	require.NoError(err)
+	mid, err := stage.Put([]cid.Cid{leaf})
+	require.NoError(err)
+	root, err := stage.Put([]cid.Cid{mid, leaf})
+	require.NoError(err)
+	_, err = stage.Put("unreachable")
+	require.NoError(err)
+	require.NoError(stage.Commit(root, stage.Head()))
+
+	expected := 0
+	for _, c := range []cid.Cid{leaf, mid, root} {
+		data, err := stage.Get(c)
+		require.NoError(err)
+		expected += len(data)
+	}
+	size, err = stage.LiveSize()
+	require.NoError(err)
+	assert.Equal(expected, size)
+
+	// Once flushed, the chunks are counted from the blockstore.
+	require.NoError(storage.Flush())
+	fresh := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
+	newRoot, err := fresh.Put([]cid.Cid{root})
+	require.NoError(err)
+	require.NoError(fresh.Commit(newRoot, fresh.Head()))
+
+	data, err := fresh.Get(newRoot)
+	require.NoError(err)
+	size, err = fresh.LiveSize()
+	require.NoError(err)
+	assert.Equal(expected+len(data), size)
+}
+
+func TestFlushWithManifest(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := newCountingBlockstore()
+	storage := NewStorageMap(bs, StorageMapOptions{})
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	manifest, err := stage.FlushWithManifest()
+	require.NoError(err)
+	assert.NotNil(manifest)
+	assert.Empty(manifest)
+	assert.Empty(bs.puts)
+
+	leaf, err := stage.Put("leaf")
+	require.NoError(err)
+	root, err := stage.Put([]cid.Cid{leaf})
+	require.NoError(err)
+	_, err = stage.Put("unreachable")
+	require.NoError(err)
+	require.NoError(stage.Commit(root, stage.Head()))
+
+	manifest, err = stage.FlushWithManifest()
+	require.NoError(err)
+
+	ids, err := stage.liveDescendantIds(root)
+	require.NoError(err)
+	assert.Len(manifest, ids.Len())
+	for _, c := range manifest {
+		assert.True(ids.Has(c))
+		assert.Equal(1, bs.puts[c])
+	}
+	assert.Len(bs.puts, 2)
+}
+
+func TestFlushFence(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := &hookedBlockstore{Blockstore: blockstore.NewBlockstore(datastore.NewMapDatastore())}
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := NewStorageMap(bs, StorageMapOptions{}).NewStorage(address.TestAddress, testActor)
+
+	first, err := cbor.WrapObject([]byte("first"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+	firstCid, err := stage.Put(first.RawData())
+	require.NoError(err)
+	require.NoError(stage.Commit(firstCid, stage.Head()))
+
+	// A handler commits a new head from another goroutine while the flush is writing.
+	second, err := cbor.WrapObject([]byte("second"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+	bs.beforePutMany = func() {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			secondCid, err := stage.Put(second.RawData())
+			assert.NoError(err)
+			assert.NoError(stage.Commit(secondCid, firstCid))
+		}()
+		<-done
+	}
+
+	assert.Equal(ErrConcurrentModification, stage.Flush())
+
+	// The flush wrote the head it started with; retrying writes the new one.
+	has, err := bs.Has(firstCid)
+	require.NoError(err)
+	assert.True(has)
+	has, err = bs.Has(second.Cid())
+	require.NoError(err)
+	assert.False(has)
+
+	bs.beforePutMany = nil
+	require.NoError(stage.Flush())
+	has, err = bs.Has(second.Cid())
+	require.NoError(err)
+	assert.True(has)
+}
+
+func TestFlushFenceBeforeWriting(t *testing.T) {
+	// setup returns a map whose flushes find the live chunks of a storage
+	// holding a committed head, then let modify run before writing them, as
+	// checking the base store for them comes first.
+	setup := func(t *testing.T, modify func(stage Storage)) (*countingBlockstore, StorageMap, Storage) {
+		bs := newCountingBlockstore()
+		base := &hookedBlockstore{Blockstore: blockstore.NewBlockstore(datastore.NewMapDatastore())}
+		storage := NewStorageMap(bs, StorageMapOptions{BaseStore: base})
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		stage := storage.NewStorage(address.TestAddress, testActor)
+
+		c, err := stage.Put("first")
+		require.NoError(t, err)
+		require.NoError(t, stage.Commit(c, stage.Head()))
+
+		base.beforeHas = func() {
+			base.beforeHas = nil
+			modify(stage)
+		}
+		return bs, storage, stage
+	}
+	putChunk := func(stage Storage) {
+		_, err := stage.Put("second")
+		assert.NoError(t, err)
+	}
+
+	t.Run("Storage.Flush", func(t *testing.T) {
+		bs, _, stage := setup(t, putChunk)
+		assert.Equal(t, ErrConcurrentModification, stage.Flush())
+		assert.Empty(t, bs.puts)
+
+		require.NoError(t, stage.Flush())
+		assert.Len(t, bs.puts, 1)
+	})
+
+	t.Run("StorageMap.Flush", func(t *testing.T) {
+		bs, storage, _ := setup(t, putChunk)
+		assert.Equal(t, ErrConcurrentModification, storage.Flush())
+		assert.Empty(t, bs.puts)
+
+		require.NoError(t, storage.Flush())
+		assert.Len(t, bs.puts, 1)
+	})
+
+	t.Run("StorageMap.FlushAddrs", func(t *testing.T) {
+		bs, storage, _ := setup(t, putChunk)
+		assert.Equal(t, ErrConcurrentModification, storage.FlushAddrs([]address.Address{address.TestAddress}))
+		assert.Empty(t, bs.puts)
+
+		require.NoError(t, storage.FlushAddrs([]address.Address{address.TestAddress}))
+		assert.Len(t, bs.puts, 1)
+	})
+}
+
+func TestFlushWritesSharedChunksOnce(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := newCountingBlockstore()
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	storage := NewStorageMap(bs, StorageMapOptions{})
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	leaf, err := cbor.WrapObject([]byte("shared leaf"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+
+	// Put the leaf under three different parents, putting it again each time.
+	var parents []cid.Cid
+	for _, path := range []string{"a", "b", "c"} {
+		leafCid, err := stage.Put(leaf.RawData())
+		require.NoError(err)
+
+		parent, err := cbor.WrapObject(map[string]cid.Cid{path: leafCid}, types.DefaultHashFunction, -1)
+		require.NoError(err)
+
+		parentCid, err := stage.Put(parent.RawData())
+		require.NoError(err)
+		parents = append(parents, parentCid)
+	}
+
+	root, err := cbor.WrapObject(parents, types.DefaultHashFunction, -1)
+	require.NoError(err)
+
+	rootCid, err := stage.Put(root.RawData())
+	require.NoError(err)
+	require.NoError(stage.Commit(rootCid, stage.Head()))
+
+	require.NoError(storage.Flush())
+
+	assert.Equal(1, bs.puts[leaf.Cid()])
+	assert.Equal(1, bs.puts[rootCid])
+	for _, parent := range parents {
+		assert.Equal(1, bs.puts[parent])
+	}
+	assert.Len(bs.puts, 5)
+}
+
+func TestCommitBatch(t *testing.T) {
+	addrGetter := address.NewForTestGetter()
+	senderAddr, receiverAddr := addrGetter(), addrGetter()
+
+	// setup returns a storage map with a sender and receiver each with a
+	// staged chunk to commit.
+	setup := func(t *testing.T) (StorageMap, *actor.Actor, *actor.Actor, cid.Cid, cid.Cid) {
+		require := require.New(t)
+
+		storage := NewStorageMap(blockstore.NewBlockstore(datastore.NewMapDatastore()), StorageMapOptions{})
+		sender := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		receiver := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+
+		senderState, err := cbor.WrapObject([]byte("sender state"), types.DefaultHashFunction, -1)
+		require.NoError(err)
+		receiverState, err := cbor.WrapObject([]byte("receiver state"), types.DefaultHashFunction, -1)
+		require.NoError(err)
+
+		senderCid, err := storage.NewStorage(senderAddr, sender).Put(senderState.RawData())
+		require.NoError(err)
+		receiverCid, err := storage.NewStorage(receiverAddr, receiver).Put(receiverState.RawData())
+		require.NoError(err)
+
+		return storage, sender, receiver, senderCid, receiverCid
+	}
+
+	t.Run("updates every head", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		storage, sender, receiver, senderCid, receiverCid := setup(t)
+		require.NoError(storage.CommitBatch([]CommitOp{
+			{Addr: senderAddr, NewCid: senderCid, OldCid: cid.Undef},
+			{Addr: receiverAddr, NewCid: receiverCid, OldCid: cid.Undef},
+		}))
+
+		assert.Equal(senderCid, sender.Head)
+		assert.Equal(receiverCid, receiver.Head)
+	})
+
+	t.Run("updates no head if any op has a dangling pointer", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		storage, sender, receiver, senderCid, _ := setup(t)
+
+		danglingNode, err := cbor.WrapObject(map[string]cid.Cid{"missing": types.SomeCid()}, types.DefaultHashFunction, -1)
+		require.NoError(err)
+		danglingCid, err := storage.NewStorage(receiverAddr, receiver).Put(danglingNode.RawData())
+		require.NoError(err)
+
+		err = storage.CommitBatch([]CommitOp{
+			{Addr: senderAddr, NewCid: senderCid, OldCid: cid.Undef},
+			{Addr: receiverAddr, NewCid: danglingCid, OldCid: cid.Undef},
+		})
+		assert.Equal(exec.Errors[exec.ErrDanglingPointer], err)
+		assert.False(sender.Head.Defined())
+		assert.False(receiver.Head.Defined())
+	})
+
+	t.Run("updates no head if any op has a stale head", func(t *testing.T) {
+		assert := assert.New(t)
+
+		storage, sender, receiver, senderCid, receiverCid := setup(t)
+
+		err := storage.CommitBatch([]CommitOp{
+			{Addr: senderAddr, NewCid: senderCid, OldCid: cid.Undef},
+			{Addr: receiverAddr, NewCid: receiverCid, OldCid: senderCid},
+		})
+		assert.Equal(exec.Errors[exec.ErrStaleHead], err)
+		assert.False(sender.Head.Defined())
+		assert.False(receiver.Head.Defined())
+	})
+
+	t.Run("rejects unknown and repeated actors", func(t *testing.T) {
+		assert := assert.New(t)
+
+		storage, sender, _, senderCid, _ := setup(t)
+
+		err := storage.CommitBatch([]CommitOp{
+			{Addr: senderAddr, NewCid: senderCid, OldCid: cid.Undef},
+			{Addr: addrGetter(), NewCid: senderCid, OldCid: cid.Undef},
+		})
+		assert.Error(err)
+
+		err = storage.CommitBatch([]CommitOp{
+			{Addr: senderAddr, NewCid: senderCid, OldCid: cid.Undef},
+			{Addr: senderAddr, NewCid: senderCid, OldCid: senderCid},
+		})
+		assert.Error(err)
+		assert.False(sender.Head.Defined())
+	})
+
+	t.Run("is atomic with concurrent commits", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		for i := 0; i < 50; i++ {
+			storage, sender, receiver, senderCid, receiverCid := setup(t)
+			otherState, err := cbor.WrapObject([]byte("other sender state"), types.DefaultHashFunction, -1)
+			require.NoError(err)
+			senderStorage := storage.NewStorage(senderAddr, sender)
+			otherCid, err := senderStorage.Put(otherState.RawData())
+			require.NoError(err)
+
+			var wg sync.WaitGroup
+			var batchErr, commitErr, reversedErr error
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				batchErr = storage.CommitBatch([]CommitOp{
+					{Addr: senderAddr, NewCid: senderCid, OldCid: cid.Undef},
+					{Addr: receiverAddr, NewCid: receiverCid, OldCid: cid.Undef},
+				})
+			}()
+			go func() {
+				defer wg.Done()
+				commitErr = senderStorage.Commit(otherCid, cid.Undef)
+			}()
+			go func() {
+				// Listing the actors in the other order mustn't deadlock.
+				defer wg.Done()
+				reversedErr = storage.CommitBatch([]CommitOp{
+					{Addr: receiverAddr, NewCid: receiverCid, OldCid: cid.Undef},
+					{Addr: senderAddr, NewCid: otherCid, OldCid: cid.Undef},
+				})
+			}()
+			wg.Wait()
+
+			// Exactly one update of the sender wins, and a batch that loses
+			// leaves the receiver alone.
+			var winners int
+			for _, err := range []error{batchErr, commitErr, reversedErr} {
+				if err == nil {
+					winners++
+				} else {
+					assert.Equal(exec.Errors[exec.ErrStaleHead], err)
+				}
+			}
+			assert.Equal(1, winners)
+			switch {
+			case batchErr == nil:
+				assert.Equal(senderCid, sender.Head)
+				assert.Equal(receiverCid, receiver.Head)
+			case commitErr == nil:
+				assert.Equal(otherCid, sender.Head)
+				assert.False(receiver.Head.Defined())
+			default:
+				assert.Equal(otherCid, sender.Head)
+				assert.Equal(receiverCid, receiver.Head)
+			}
+		}
+	})
+}
+
+func TestStorageMapSnapshot(t *testing.T) {
+	t.Run("Revert restores staged chunks and heads", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		storage := NewStorageMap(blockstore.NewBlockstore(datastore.NewMapDatastore()), StorageMapOptions{})
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		stage := storage.NewStorage(address.TestAddress, testActor)
+
+		before, err := stage.Put("before")
+		require.NoError(err)
+		require.NoError(stage.Commit(before, stage.Head()))
+		staged := stage.StagedBlocks()
+
+		id := storage.Snapshot()
+
+		after, err := stage.Put("after")
+		require.NoError(err)
+		require.NoError(stage.Commit(after, stage.Head()))
+		require.NoError(stage.Delete(before))
+		otherActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		other := storage.NewStorage(address.TestAddress2, otherActor)
+		_, err = other.Put("other")
+		require.NoError(err)
+
+		require.NoError(storage.Revert(id))
+		assert.Equal(before, stage.Head())
+		assert.Equal(before, testActor.Head)
+		assert.Equal(staged, stage.StagedBlocks())
+
+		// Storage created after the snapshot is gone.
+		assert.Empty(storage.NewStorage(address.TestAddress2, otherActor).StagedBlocks())
+	})
+
+	t.Run("Revert to an earlier snapshot discards later ones", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		storage := NewStorageMap(blockstore.NewBlockstore(datastore.NewMapDatastore()), StorageMapOptions{})
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		stage := storage.NewStorage(address.TestAddress, testActor)
+
+		first := storage.Snapshot()
+		c, err := stage.Put("chunk")
+		require.NoError(err)
+		require.NoError(stage.Commit(c, stage.Head()))
+		second := storage.Snapshot()
+
+		require.NoError(storage.Revert(first))
+		assert.False(stage.Head().Defined())
+		assert.Empty(stage.StagedBlocks())
+
+		assert.Error(storage.Revert(second))
+		assert.Error(storage.Revert(SnapshotID(-1)))
+
+		// The snapshot reverted to can be reverted to again.
+		_, err = stage.Put("chunk")
+		require.NoError(err)
+		require.NoError(storage.Revert(first))
+		assert.Empty(stage.StagedBlocks())
+	})
+
+	t.Run("Release keeps changes and discards the snapshot", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		storage := NewStorageMap(blockstore.NewBlockstore(datastore.NewMapDatastore()), StorageMapOptions{})
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		stage := storage.NewStorage(address.TestAddress, testActor)
+
+		first := storage.Snapshot()
+		c, err := stage.Put("chunk")
+		require.NoError(err)
+		require.NoError(stage.Commit(c, stage.Head()))
+		second := storage.Snapshot()
+		third := storage.Snapshot()
+
+		require.NoError(storage.Release(second))
+		assert.Equal(c, stage.Head())
+		assert.Error(storage.Revert(second))
+		assert.Error(storage.Revert(third))
+		assert.Error(storage.Release(third))
+
+		// Snapshots taken before the one released are kept.
+		require.NoError(storage.Revert(first))
+		assert.False(stage.Head().Defined())
+	})
+
+	t.Run("a long sequence of released snapshots holds no chunks", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		storage := NewStorageMap(blockstore.NewBlockstore(datastore.NewMapDatastore()), StorageMapOptions{})
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		stage := storage.NewStorage(address.TestAddress, testActor)
+
+		outer := storage.Snapshot()
+		for i := 0; i < 1000; i++ {
+			id := storage.Snapshot()
+			c, err := stage.Put(fmt.Sprintf("chunk %d", i))
+			require.NoError(err)
+			require.NoError(stage.Commit(c, stage.Head()))
+			require.NoError(storage.Release(id))
+		}
+
+		snapshots := storage.(*storageMap).snapshots
+		assert.Len(snapshots, 1)
+		// Released snapshots aren't left in the backing array either.
+		for _, snapshot := range snapshots[:cap(snapshots)][1:] {
+			assert.Nil(snapshot)
+		}
+
+		require.NoError(storage.Revert(outer))
+		require.NoError(storage.Release(outer))
+		assert.Empty(storage.(*storageMap).snapshots)
+		assert.Empty(stage.StagedBlocks())
+	})
+}
+
+func TestFlushReport(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	addrGetter := address.NewForTestGetter()
+	bigAddr, smallAddr, cleanAddr := addrGetter(), addrGetter(), addrGetter()
+
+	storage := NewStorageMap(blockstore.NewBlockstore(datastore.NewMapDatastore()), StorageMapOptions{})
+
+	// stageChunks puts and links the given chunks under a new head for addr,
+	// returning the total size of the chunks put.
+	stageChunks := func(addr address.Address, chunks ...string) int {
+		stage := storage.NewStorage(addr, actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL()))
+
+		var links []cid.Cid
+		size := 0
+		for _, chunk := range chunks {
+			nd, err := cbor.WrapObject([]byte(chunk), types.DefaultHashFunction, -1)
+			require.NoError(err)
+			c, err := stage.Put(nd.RawData())
+			require.NoError(err)
+			links = append(links, c)
+			size += len(nd.RawData())
+		}
+
+		head, err := cbor.WrapObject(links, types.DefaultHashFunction, -1)
+		require.NoError(err)
+		headCid, err := stage.Put(head.RawData())
+		require.NoError(err)
+		require.NoError(stage.Commit(headCid, stage.Head()))
+
+		return size + len(head.RawData())
+	}
+
+	bigSize := stageChunks(bigAddr, "one", "two", "three")
+	smallSize := stageChunks(smallAddr, "four")
+	storage.NewStorage(cleanAddr, actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL()))
+
+	report, err := storage.FlushReport()
+	require.NoError(err)
+
+	assert.Equal(map[address.Address]ActorFlushResult{
+		bigAddr:   {Blocks: 4, Bytes: bigSize},
+		smallAddr: {Blocks: 2, Bytes: smallSize},
+		cleanAddr: {},
+	}, report)
+}
+
+func TestFlushSkipsCleanActors(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := newCountingBlockstore()
+	storage := NewStorageMap(bs, StorageMapOptions{})
+	testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	stage := storage.NewStorage(address.TestAddress, testActor)
+
+	first, err := stage.Put("first")
+	require.NoError(err)
+	require.NoError(stage.Commit(first, stage.Head()))
+	require.NoError(storage.Flush())
+	assert.Equal(1, bs.puts[first])
+
+	report, err := storage.FlushReport()
+	require.NoError(err)
+	assert.Equal(ActorFlushResult{}, report[address.TestAddress])
+	assert.Equal(1, bs.puts[first])
+
+	// An actor whose storage is created with a head it loaded is clean.
+	loadedActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	loadedActor.Head = first
+	storage.NewStorage(address.TestAddress2, loadedActor)
+	require.NoError(storage.Flush())
+	assert.Equal(1, bs.puts[first])
+
+	second, err := stage.Put([]cid.Cid{first})
+	require.NoError(err)
+	require.NoError(stage.Commit(second, stage.Head()))
+	require.NoError(storage.Flush())
+	assert.Equal(1, bs.puts[second])
+	assert.Equal(2, bs.puts[first])
+}
+
+func BenchmarkFlushDirtyActors(b *testing.B) {
+	const actors = 1000
+	for _, mutated := range []int{10, actors} {
+		b.Run(fmt.Sprintf("%d of %d actors mutated", mutated, actors), func(b *testing.B) {
+			storage := NewStorageMap(blockstore.NewBlockstore(datastore.NewMapDatastore()), StorageMapOptions{})
+			newAddress := address.NewForTestGetter()
+
+			var stages []Storage
+			var roots []cid.Cid
+			for i := 0; i < actors; i++ {
+				testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+				stage := storage.NewStorage(newAddress(), testActor)
+
+				var leaves []cid.Cid
+				for j := 0; j < 10; j++ {
+					leaf, err := stage.Put(fmt.Sprintf("actor %d leaf %d", i, j))
+					require.NoError(b, err)
+					leaves = append(leaves, leaf)
+				}
+				root, err := stage.Put(leaves)
+				require.NoError(b, err)
+				require.NoError(b, stage.Commit(root, stage.Head()))
+				stages = append(stages, stage)
+				roots = append(roots, root)
+			}
+			require.NoError(b, storage.Flush())
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j, stage := range stages[:mutated] {
+					root, err := stage.Put([]interface{}{i, roots[j]})
+					require.NoError(b, err)
+					require.NoError(b, stage.Commit(root, stage.Head()))
+				}
+				require.NoError(b, storage.Flush())
+			}
+		})
+	}
+}
+
+func TestFlushAddrs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	addrGetter := address.NewForTestGetter()
+	addrs := []address.Address{addrGetter(), addrGetter(), addrGetter()}
+
+	bs := newCountingBlockstore()
+	storage := NewStorageMap(bs, StorageMapOptions{})
+
+	var heads []cid.Cid
+	for i, addr := range addrs {
+		stage := storage.NewStorage(addr, actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL()))
+		nd, err := cbor.WrapObject([]byte{byte(i)}, types.DefaultHashFunction, -1)
+		require.NoError(err)
+		c, err := stage.Put(nd.RawData())
+		require.NoError(err)
+		require.NoError(stage.Commit(c, stage.Head()))
+		heads = append(heads, c)
+	}
+
+	require.NoError(storage.FlushAddrs(addrs[:2]))
+	assert.Equal(map[cid.Cid]int{heads[0]: 1, heads[1]: 1}, bs.puts)
+
+	err := storage.FlushAddrs([]address.Address{addrs[2], addrGetter()})
+	assert.Error(err)
+	assert.Len(bs.puts, 2)
+}
+
+func TestFlushValidatesBeforeWriting(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bs := newCountingBlockstore()
+	storage := NewStorageMap(bs, StorageMapOptions{})
+
+	// One actor with valid storage.
+	validActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	validStage := storage.NewStorage(address.TestAddress, validActor)
+	memory, err := cbor.WrapObject([]byte("valid memory"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+	validCid, err := validStage.Put(memory.RawData())
+	require.NoError(err)
+	require.NoError(validStage.Commit(validCid, validStage.Head()))
+
+	// Another whose head links to a chunk that was never put.
+	danglingActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+	danglingStage := storage.NewStorage(address.TestAddress2, danglingActor)
+	missing, err := cbor.WrapObject([]byte("missing memory"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+	linking, err := cbor.WrapObject(missing.Cid(), types.DefaultHashFunction, -1)
+	require.NoError(err)
+	linkingCid, err := danglingStage.Put(linking.RawData())
+	require.NoError(err)
+	// Commit would reject this, so set the head directly.
+	danglingActor.Head = linkingCid
+
+	assert.Error(danglingStage.Flush())
+	assert.Error(storage.Flush())
+	assert.Empty(bs.puts)
+}
+
+// eventLog records the order of write-ahead log and blockstore operations.
+type eventLog struct {
+	events []string
+}
+
+type fakeWAL struct {
+	log    *eventLog
+	blocks []blocks.Block
+}
+
+func (w *fakeWAL) Append(blks []blocks.Block) error {
+	w.log.events = append(w.log.events, "append")
+	w.blocks = append(w.blocks, blks...)
+	return nil
+}
+
+func (w *fakeWAL) Truncate() error {
+	w.log.events = append(w.log.events, "truncate")
+	w.blocks = nil
+	return nil
+}
+
+type loggingBlockstore struct {
+	blockstore.Blockstore
+	log *eventLog
+	err error
+}
+
+func (bs *loggingBlockstore) PutMany(blks []blocks.Block) error {
+	bs.log.events = append(bs.log.events, "putmany")
+	if bs.err != nil {
+		return bs.err
+	}
+	return bs.Blockstore.PutMany(blks)
+}
+
+func TestFlushWriteAheadLog(t *testing.T) {
+	memory, err := cbor.WrapObject([]byte("Memory chunk"), types.DefaultHashFunction, -1)
+	require.NoError(t, err)
+
+	setup := func(putErr error) (*eventLog, *fakeWAL, StorageMap) {
+		log := &eventLog{}
+		wal := &fakeWAL{log: log}
+		bs := &loggingBlockstore{
+			Blockstore: blockstore.NewBlockstore(datastore.NewMapDatastore()),
+			log:        log,
+			err:        putErr,
+		}
+		storage := NewStorageMap(bs, StorageMapOptions{WAL: wal})
+
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		stage := storage.NewStorage(address.TestAddress, testActor)
+		c, err := stage.Put(memory.RawData())
+		require.NoError(t, err)
+		require.NoError(t, stage.Commit(c, stage.Head()))
+
+		return log, wal, storage
+	}
+
+	t.Run("appends before writing and truncates after", func(t *testing.T) {
+		assert := assert.New(t)
+
+		log, wal, storage := setup(nil)
+		assert.NoError(storage.Flush())
+		assert.Equal([]string{"append", "putmany", "truncate"}, log.events)
+		assert.Empty(wal.blocks)
+	})
+
+	t.Run("leaves the log intact when writing fails", func(t *testing.T) {
+		assert := assert.New(t)
+
+		putErr := errors.New("disk full")
+		log, wal, storage := setup(putErr)
+		assert.Equal(putErr, storage.Flush())
+		assert.Equal([]string{"append", "putmany"}, log.events)
+		require.Len(t, wal.blocks, 1)
+		assert.Equal(memory.Cid(), wal.blocks[0].Cid())
+	})
+}
+
+func TestValidationAndPruning(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	memory2, err := cbor.WrapObject([]byte("Memory chunk 2"), types.DefaultHashFunction, -1)
+	require.NoError(err)
+
+	t.Run("Linking to a non-existent cid fails in Commit", func(t *testing.T) {
+		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		storage := NewStorageMap(bs, StorageMapOptions{})
+		stage := storage.NewStorage(address.TestAddress, testActor)
+
+		// This links to memory 2, but memory 2 hasn't been added to anything.
+		memory, err := cbor.WrapObject(memory2.Cid(), types.DefaultHashFunction, -1)
+		require.NoError(err)
+
+		// Add link
+		cid, err := stage.Put(memory.RawData())
+		assert.NoError(err)
+
+		// Attempt to commit before adding linked memory
+		err = stage.Commit(cid, stage.Head())
+		assert.Equal(exec.Errors[exec.ErrDanglingPointer], err)
+	})
+
+	t.Run("Prune removes unlinked chunks from stage", func(t *testing.T) {
+		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		storage := NewStorageMap(bs, StorageMapOptions{})
+		stage := storage.NewStorage(address.TestAddress, testActor)
+
+		// put both values into stage
+		cid1, err := stage.Put(memory2.RawData())
+		require.NoError(err)
+
+		memory3, err := cbor.WrapObject([]byte("Memory chunk 3"), types.DefaultHashFunction, -1)
+		require.NoError(err)
+
+		cid2, err := stage.Put(memory3.RawData())
+		require.NoError(err)
+
+		// only commit the second change
+		stage.Commit(cid2, stage.Head())
+
+		// Prune the stage
+		err = stage.Prune()
+		require.NoError(err)
+
+		// retrieve cid from stage
+		_, err = stage.Get(cid1)
+		require.Error(err)
+		assert.Equal(ErrNotFound, err)
+
+		chunk, err := stage.Get(cid2)
+		require.NoError(err)
+		assert.Equal(memory3.RawData(), chunk)
+	})
+	t.Run("Delete removes chunks from stage only", func(t *testing.T) {
+		bs := newCountingBlockstore()
+
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		storage := NewStorageMap(bs, StorageMapOptions{})
+		stage := storage.NewStorage(address.TestAddress, testActor)
+
+		temp, err := stage.Put(memory2.RawData())
+		require.NoError(err)
+		require.NoError(stage.Delete(temp))
+
+		_, err = stage.Get(temp)
+		assert.Equal(ErrNotFound, err)
+		assert.Equal(ErrNotFound, stage.Delete(temp))
+
+		// Deleting a flushed chunk leaves it in the blockstore.
+		flushed, err := stage.Put(memory2.RawData())
+		require.NoError(err)
+		require.NoError(stage.Commit(flushed, stage.Head()))
+		require.NoError(stage.Flush())
+		require.NoError(stage.Delete(flushed))
+		assert.Empty(stage.StagedBlocks())
+
+		chunk, err := stage.Get(flushed)
+		require.NoError(err)
+		assert.Equal(memory2.RawData(), chunk)
+		assert.Equal(1, bs.puts[flushed])
+	})
+
+	t.Run("CommitAndPrune removes chunks unreachable from the new head", func(t *testing.T) {
+		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		storage := NewStorageMap(bs, StorageMapOptions{})
+		stage := storage.NewStorage(address.TestAddress, testActor)
+
+		linkedCid, err := stage.Put(memory2.RawData())
+		require.NoError(err)
+
+		head, err := cbor.WrapObject(linkedCid, types.DefaultHashFunction, -1)
+		require.NoError(err)
+		headCid, err := stage.Put(head.RawData())
+		require.NoError(err)
+
+		var unreferenced []cid.Cid
+		for _, data := range []string{"stale 1", "stale 2"} {
+			memory, err := cbor.WrapObject([]byte(data), types.DefaultHashFunction, -1)
+			require.NoError(err)
+			c, err := stage.Put(memory.RawData())
+			require.NoError(err)
+			unreferenced = append(unreferenced, c)
+		}
+
+		pruned, err := stage.CommitAndPrune(headCid, stage.Head())
+		require.NoError(err)
+		assert.Equal(2, pruned)
+		assert.Equal(headCid, stage.Head())
+
+		for _, c := range unreferenced {
+			_, err := stage.Get(c)
+			assert.Equal(ErrNotFound, err)
+		}
+		for _, c := range []cid.Cid{headCid, linkedCid} {
+			_, err := stage.Get(c)
+			assert.NoError(err)
+		}
+	})
+
+	t.Run("PruneWithManifest returns the removed chunks", func(t *testing.T) {
+		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		storage := NewStorageMap(bs, StorageMapOptions{})
+		stage := storage.NewStorage(address.TestAddress, testActor)
+
+		leaf, err := stage.Put("leaf")
+		require.NoError(err)
+		root, err := stage.Put([]cid.Cid{leaf})
+		require.NoError(err)
+		var orphans []cid.Cid
+		for _, data := range []string{"orphan 1", "orphan 2", "orphan 3"} {
+			c, err := stage.Put(data)
+			require.NoError(err)
+			orphans = append(orphans, c)
+		}
+		require.NoError(stage.Commit(root, stage.Head()))
+
+		liveIds, err := stage.liveDescendantIds(root)
+		require.NoError(err)
+		pruned, err := stage.PruneWithManifest()
+		require.NoError(err)
+		assert.Len(pruned, len(orphans))
+		for _, c := range orphans {
+			assert.Contains(pruned, c)
+			assert.False(liveIds.Has(c))
+		}
+		assert.Len(stage.StagedBlocks(), 2)
+
+		pruned, err = stage.PruneWithManifest()
+		require.NoError(err)
+		assert.NotNil(pruned)
+		assert.Empty(pruned)
+	})
+
+	t.Run("CommitAndPrune leaves chunks alone when the commit fails", func(t *testing.T) {
+		bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+
+		testActor := actor.NewActor(types.AccountActorCodeCid, types.NewZeroAttoFIL())
+		storage := NewStorageMap(bs, StorageMapOptions{})
+		stage := storage.NewStorage(address.TestAddress, testActor)
+
+		c, err := stage.Put(memory2.RawData())
+		require.NoError(err)
+
+		pruned, err := stage.CommitAndPrune(c, c) // stale head
+		assert.Equal(exec.Errors[exec.ErrStaleHead], err)
+		assert.Equal(0, pruned)
+
+		_, err = stage.Get(c)
+		assert.NoError(err)
 	})
 }
@@ -50,7 +50,7 @@ func TestSendErrorHandling(t *testing.T) {
 	newMsg := types.NewMessageForTestGetter()
 
 	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
-	vms := NewStorageMap(bs)
+	vms := NewStorageMap(bs, StorageMapOptions{})
 
 	t.Run("returns exit code 1 and an unwrapped error if we fail to transfer value from one actor to another", func(t *testing.T) {
 		assert := assert.New(t)